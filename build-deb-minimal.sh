@@ -79,9 +79,9 @@ Description: Transparent HTTP/HTTPS Proxy Server
 Depends: libc6, adduser
 EOF
 
-# Copy systemd service file
-cp packaging/tproxy.service "$DEB_BUILD_DIR/lib/systemd/system/"
-chmod 644 "$DEB_BUILD_DIR/lib/systemd/system/tproxy.service"
+# Copy systemd service and socket files
+cp packaging/tproxy.service packaging/tproxy.socket "$DEB_BUILD_DIR/lib/systemd/system/"
+chmod 644 "$DEB_BUILD_DIR/lib/systemd/system/tproxy.service" "$DEB_BUILD_DIR/lib/systemd/system/tproxy.socket"
 
 # Copy post-install scripts
 cp packaging/deb/postinst "$DEB_BUILD_DIR/DEBIAN/postinst"
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"tproxy/internal/config"
+	"tproxy/internal/logging"
 	"tproxy/internal/server"
 )
 
@@ -15,13 +20,29 @@ func main() {
 	// Load configuration
 	config, err := config.LoadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		slog.Error("Failed to load config", "error", err)
+		os.Exit(1)
 	}
 
-	log.Printf("Starting proxy server with config from %s\n", *configPath)
+	if err := logging.Setup(config.Logging); err != nil {
+		slog.Error("Failed to set up logging", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Starting proxy server", "config", *configPath)
+
+	// SIGINT and SIGTERM stop accepting and drain the active connections,
+	// a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
 	// Start servers
-	if err := server.StartServers(config); err != nil {
-		log.Fatalf("Failed to start servers: %v", err)
+	if err := server.StartServers(ctx, config); err != nil {
+		slog.Error("Failed to start servers", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("Proxy server stopped")
 }
@@ -73,7 +73,7 @@ for ARCH in "${PACKAGE_ARCHS[@]}"; do
             mkdir -p /tmp/deb-build/usr/share/doc/tproxy && \
             cp README.md /tmp/deb-build/usr/share/doc/tproxy/ && \
             mkdir -p /tmp/deb-build/lib/systemd/system && \
-            cp packaging/tproxy.service /tmp/deb-build/lib/systemd/system/ && \
+            cp packaging/tproxy.service packaging/tproxy.socket /tmp/deb-build/lib/systemd/system/ && \
             cd /tmp/deb-build && \
             dpkg-deb --build . /app/$OUTPUT_DIR/deb/tproxy_${ARCH}.deb
         "
@@ -0,0 +1,189 @@
+// Package accesslog writes one structured record per proxied connection
+// when it closes, as JSON lines or logfmt.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	FORMAT_JSON   = "json"
+	FORMAT_LOGFMT = "logfmt"
+)
+
+// Close reasons
+const (
+	REASON_CLIENT_EOF = "client_eof" // the client closed the connection
+	REASON_REMOTE_EOF = "remote_eof" // the remote server or upstream closed the connection
+	REASON_TIMEOUT    = "timeout"    // the connection deadline expired
+	REASON_ERROR      = "error"      // reading or writing failed
+	REASON_KILLED     = "killed"     // closed through the admin API
+	REASON_DROPPED    = "dropped"    // dropped by a rule or policy
+	REASON_REJECTED   = "rejected"   // reset by a REJECT rule or quota
+	REASON_DIAL_ERROR = "dial_error" // connecting to the remote server or upstream failed
+	REASON_SHUTDOWN   = "shutdown"   // still open when the drain period on shutdown expired
+	REASON_QUOTA      = "quota"      // closed when the quota of the client was exhausted
+)
+
+// Record describes a connection after it was closed
+type Record struct {
+	Time        time.Time `json:"time"` // when the connection was closed
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	OriginalIP  string    `json:"original_ip"`
+	Host        string    `json:"host"` // SNI, Host header or original destination IP
+	Target      string    `json:"target"`
+	Rule        int       `json:"rule"` // 1-based index of the matching rule, 0 if none
+	Action      string    `json:"action"`
+	Upstream    string    `json:"upstream,omitempty"`
+	BytesIn     uint64    `json:"bytes_in"`  // from the client
+	BytesOut    uint64    `json:"bytes_out"` // to the client
+	DurationMs  float64   `json:"duration_ms"`
+	JA3         string    `json:"ja3,omitempty"` // TLS client fingerprints
+	JA4         string    `json:"ja4,omitempty"`
+	CloseReason string    `json:"close_reason"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Logger writes records to a file or standard stream
+type Logger struct {
+	format string
+
+	mu   sync.Mutex // serializes writes
+	w    io.Writer
+	file *rotatingFile // nil for standard streams
+}
+
+// Open creates a logger writing to "stdout", "stderr" or a file that is
+// opened for appending and rotated according to rotate
+func Open(output, format string, rotate RotateOptions) (*Logger, error) {
+	switch format {
+	case "":
+		format = FORMAT_JSON
+	case FORMAT_JSON, FORMAT_LOGFMT:
+	default:
+		return nil, fmt.Errorf("invalid access log format: %q", format)
+	}
+
+	switch output {
+	case "stdout":
+		return New(os.Stdout, format), nil
+	case "stderr":
+		return New(os.Stderr, format), nil
+	}
+
+	file, err := openRotatingFile(output, rotate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	l := New(file, format)
+	l.file = file
+	return l, nil
+}
+
+// New creates a logger writing to w
+func New(w io.Writer, format string) *Logger {
+	return &Logger{format: format, w: w}
+}
+
+// Log writes one record as a single line
+func (l *Logger) Log(r *Record) error {
+	var line []byte
+	if l.format == FORMAT_LOGFMT {
+		line = []byte(FormatLogfmt(r))
+	} else {
+		var err error
+		if line, err = json.Marshal(r); err != nil {
+			return err
+		}
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// Reopen closes and opens the log file again so that records go to a new
+// file after it was moved by logrotate. Standard streams are left as is.
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Reopen(); err != nil {
+		return fmt.Errorf("failed to reopen access log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log file. Standard streams are left open.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	// Later records fail with os.ErrClosed and Reopen does nothing
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// FormatLogfmt formats a record as key=value pairs in the order of the JSON
+// fields. Empty optional fields are omitted.
+func FormatLogfmt(r *Record) string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(value))
+	}
+
+	add("time", r.Time.Format(time.RFC3339Nano))
+	add("id", strconv.FormatUint(r.ID, 10))
+	add("client", r.Client)
+	add("original_ip", r.OriginalIP)
+	add("host", r.Host)
+	add("target", r.Target)
+	add("rule", strconv.Itoa(r.Rule))
+	add("action", r.Action)
+	if r.Upstream != "" {
+		add("upstream", r.Upstream)
+	}
+	add("bytes_in", strconv.FormatUint(r.BytesIn, 10))
+	add("bytes_out", strconv.FormatUint(r.BytesOut, 10))
+	add("duration_ms", strconv.FormatFloat(r.DurationMs, 'f', 3, 64))
+	if r.JA3 != "" {
+		add("ja3", r.JA3)
+	}
+	if r.JA4 != "" {
+		add("ja4", r.JA4)
+	}
+	add("close_reason", r.CloseReason)
+	if r.Error != "" {
+		add("error", r.Error)
+	}
+	return b.String()
+}
+
+// logfmtValue quotes values that are empty or contain spaces, quotes or '='
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\t\r\n\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord() *Record {
+	return &Record{
+		Time:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		ID:          42,
+		Client:      "192.168.1.2:40000",
+		OriginalIP:  "93.184.216.34",
+		Host:        "example.com",
+		Target:      "example.com:443",
+		Rule:        3,
+		Action:      "proxy",
+		Upstream:    "proxy.example.com:3128",
+		BytesIn:     517,
+		BytesOut:    4096,
+		DurationMs:  1234.5,
+		CloseReason: REASON_CLIENT_EOF,
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := New(&buf, FORMAT_JSON).Log(testRecord()); err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Expected a single JSON line, got %q", buf.String())
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if decoded["host"] != "example.com" || decoded["close_reason"] != "client_eof" || decoded["bytes_out"] != float64(4096) {
+		t.Errorf("Unexpected record %v", decoded)
+	}
+	if _, ok := decoded["error"]; ok {
+		t.Error("Expected empty error to be omitted")
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	record := testRecord()
+	record.CloseReason = REASON_ERROR
+	record.Error = `read tcp: connection reset by peer "x"`
+
+	expected := `time=2024-05-01T12:00:00Z id=42 client=192.168.1.2:40000 original_ip=93.184.216.34 ` +
+		`host=example.com target=example.com:443 rule=3 action=proxy upstream=proxy.example.com:3128 ` +
+		`bytes_in=517 bytes_out=4096 duration_ms=1234.500 close_reason=error ` +
+		`error="read tcp: connection reset by peer \"x\""`
+	if got := FormatLogfmt(record); got != expected {
+		t.Errorf("Unexpected logfmt:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	record.Upstream = ""
+	record.Host = ""
+	if got := FormatLogfmt(record); strings.Contains(got, "upstream=") || !strings.Contains(got, `host="" `) {
+		t.Errorf("Expected upstream to be omitted and empty host quoted: %s", got)
+	}
+
+	record.JA3 = "ada70206e40642a3e4461f35503241d5"
+	record.JA4 = "t13d1516h2_8daaf6152771_02713d6af862"
+	if got := FormatLogfmt(record); !strings.Contains(got, "ja3=ada70206e40642a3e4461f35503241d5 ja4=t13d1516h2_8daaf6152771_02713d6af862") {
+		t.Errorf("Expected the fingerprints, got %s", got)
+	}
+}
+
+func TestOpen_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	for i := 0; i < 2; i++ {
+		// The second logger appends to the existing file
+		logger, err := Open(path, FORMAT_LOGFMT, RotateOptions{})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := logger.Log(testRecord()); err != nil {
+			t.Fatalf("Log failed: %v", err)
+		}
+		if err := logger.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d:\n%s", lines, data)
+	}
+}
+
+func TestOpen_Errors(t *testing.T) {
+	if _, err := Open("stdout", "xml", RotateOptions{}); err == nil {
+		t.Error("Expected an error for an invalid format")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing", "access.log"), FORMAT_JSON, RotateOptions{}); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+	logger, err := Open("stdout", "", RotateOptions{})
+	if err != nil {
+		t.Fatalf("Open stdout failed: %v", err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Errorf("Closing a standard stream logger should not fail: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is appended to the file name of rotated files. It sorts
+// in chronological order.
+const backupTimeFormat = "20060102-150405.000000"
+
+// RotateOptions controls the rotation of a log file
+type RotateOptions struct {
+	MaxSize    int64         // bytes before the file is rotated, 0 disables it
+	MaxAge     time.Duration // time since the file was opened before it is rotated, 0 disables it
+	MaxBackups int           // rotated files to keep, 0 keeps all
+	Compress   bool          // gzip rotated files
+}
+
+// rotatingFile is an append-only log file that is renamed to a timestamped
+// backup when it grows too large or too old. It is not safe for concurrent
+// use, Logger serializes access.
+type rotatingFile struct {
+	path string
+	opts RotateOptions
+	now  func() time.Time
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	cleanup sync.Mutex     // serializes compression and removal of backups
+	pending sync.WaitGroup // background cleanups, waited for by Close
+}
+
+func openRotatingFile(path string, opts RotateOptions) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, opts: opts, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate access log: %w", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// shouldRotate reports whether writing n bytes would exceed a limit. An
+// empty file is never rotated so a single large record cannot cause a loop.
+func (f *rotatingFile) shouldRotate(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+int64(n) > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && f.now().Sub(f.opened) >= f.opts.MaxAge
+}
+
+// rotate renames the current file to a backup and starts a new one. The
+// backup is compressed and old backups are removed in the background.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup := f.path + "." + f.now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		// Keep writing to the current file
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+
+		if f.opts.Compress {
+			if err := compressFile(backup); err != nil {
+				slog.Error("Failed to compress access log", "file", backup, "error", err)
+			}
+		}
+		if err := f.removeOldBackups(); err != nil {
+			slog.Error("Failed to remove old access logs", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Reopen closes and opens the file again, for use after an external tool
+// such as logrotate moved it
+func (f *rotatingFile) Reopen() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			// The file is replaced either way
+			_ = err // explicitly ignore the error
+		}
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.pending.Wait()
+	return err
+}
+
+// backups returns the rotated files, oldest first
+func (f *rotatingFile) backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ".gz")); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(f.path), name))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *rotatingFile) removeOldBackups() error {
+	if f.opts.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := src.Close(); closeErr != nil {
+		// Only read from, nothing was lost
+		_ = closeErr // explicitly ignore the error
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
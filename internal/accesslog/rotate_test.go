@@ -0,0 +1,139 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock advances by one second on every call so backups get distinct names
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.t = c.t.Add(time.Second)
+	return c.t
+}
+
+func TestRotatingFile_MaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %v", err)
+	}
+	f.now = (&fakeClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}).now
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "fourth\n" {
+		t.Errorf("Expected the current file to hold the last line, got %q (%v)", data, err)
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatalf("backups failed: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for i, expected := range []string{"second\n", "third\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Fatalf("Expected a compressed backup, got %s", backups[i])
+		}
+		file, err := os.Open(backups[i])
+		if err != nil {
+			t.Fatalf("Failed to open backup: %v", err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Invalid gzip %s: %v", backups[i], err)
+		}
+		content, err := io.ReadAll(gz)
+		_ = file.Close()
+		if err != nil || string(content) != expected {
+			t.Errorf("Backup %s holds %q (%v), expected %q", backups[i], content, err, expected)
+		}
+	}
+}
+
+func TestRotatingFile_MaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, RotateOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %v", err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	f.now = clock.now
+	f.opened = clock.t
+
+	if _, err := f.Write([]byte("old\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	clock.t = clock.t.Add(time.Hour)
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	backups, err := f.backups()
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %v (%v)", backups, err)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "old\n" {
+		t.Errorf("Unexpected backup content %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("Unexpected current content %q", data)
+	}
+}
+
+func TestLogger_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	logger, err := Open(path, FORMAT_JSON, RotateOptions{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := logger.Log(testRecord()); err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+
+	// logrotate moves the file, then signals the proxy
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := logger.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if err := logger.Log(testRecord()); err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		data, err := os.ReadFile(name)
+		if err != nil || strings.Count(string(data), "\n") != 1 {
+			t.Errorf("Expected one record in %s, got %q (%v)", name, data, err)
+		}
+	}
+	if err := logger.Reopen(); err != nil {
+		t.Errorf("Reopen after Close should do nothing: %v", err)
+	}
+}
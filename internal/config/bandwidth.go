@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BandwidthLimit caps the bytes per second relayed for a rule, a group of
+// clients or an upstream. Each client gets its own buckets, shared by all
+// of its connections, unless Shared is set.
+type BandwidthLimit struct {
+	Upload   string `yaml:"upload"`   // client to server, e.g. 512kbit, 2mbit or 100k (bytes)
+	Download string `yaml:"download"` // server to client
+	Shared   bool   `yaml:"shared"`   // one bucket for all clients instead of one per client
+
+	UploadRate   int64 `yaml:"-"` // bytes per second parsed from Upload, 0 for no limit
+	DownloadRate int64 `yaml:"-"` // bytes per second parsed from Download, 0 for no limit
+}
+
+// ClientBandwidth limits clients with a source IP in Networks
+type ClientBandwidth struct {
+	Networks       []string `yaml:"networks"`
+	BandwidthLimit `yaml:",inline"`
+}
+
+type BandwidthConfig struct {
+	Clients   []ClientBandwidth         `yaml:"clients"`   // the first entry matching the client IP applies
+	Upstreams map[string]BandwidthLimit `yaml:"upstreams"` // keyed by proxy host:port as used in rules
+}
+
+// parse sets the rates from the configured strings
+func (l *BandwidthLimit) parse() error {
+	var err error
+	if l.UploadRate, err = ParseBandwidth(l.Upload); err != nil {
+		return err
+	}
+	if l.DownloadRate, err = ParseBandwidth(l.Download); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseBandwidth returns the bytes per second of a rate. A number is bytes
+// per second, the suffixes k, m and g multiply by 1000, and kbit, mbit and
+// gbit give bits per second. An empty rate is 0, i.e. no limit.
+func ParseBandwidth(rate string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier, divisor := 1.0, 1.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+		bits       bool
+	}{
+		{"kbit", 1e3, true}, {"mbit", 1e6, true}, {"gbit", 1e9, true}, {"bit", 1, true},
+		{"kb", 1e3, false}, {"mb", 1e6, false}, {"gb", 1e9, false},
+		{"k", 1e3, false}, {"m", 1e6, false}, {"g", 1e9, false}, {"b", 1, false},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.multiplier
+			if unit.bits {
+				divisor = 8
+			}
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth: %q", rate)
+	}
+	bytes := int64(value * multiplier / divisor)
+	if bytes < 1 {
+		return 0, fmt.Errorf("invalid bandwidth: %q", rate)
+	}
+	return bytes, nil
+}
+
+// FindClientBandwidth returns the first clients entry matching ip, nil if
+// none does
+func (b *BandwidthConfig) FindClientBandwidth(ip string) *ClientBandwidth {
+	for i := range b.Clients {
+		if matchesNetwork(b.Clients[i].Networks, ip) {
+			return &b.Clients[i]
+		}
+	}
+	return nil
+}
+
+// parseBandwidth parses the rates of the bandwidth section and the rules
+func parseBandwidth(config *Config) error {
+	for i := range config.Bandwidth.Clients {
+		if len(config.Bandwidth.Clients[i].Networks) == 0 {
+			return fmt.Errorf("bandwidth client %d has no networks", i+1)
+		}
+		if err := config.Bandwidth.Clients[i].parse(); err != nil {
+			return fmt.Errorf("bandwidth client %d: %w", i+1, err)
+		}
+	}
+	for upstream, limit := range config.Bandwidth.Upstreams {
+		if err := limit.parse(); err != nil {
+			return fmt.Errorf("bandwidth upstream %s: %w", upstream, err)
+		}
+		config.Bandwidth.Upstreams[upstream] = limit
+	}
+	for i := range config.Rules {
+		if config.Rules[i].Bandwidth == nil {
+			continue
+		}
+		if err := config.Rules[i].Bandwidth.parse(); err != nil {
+			return fmt.Errorf("rule %d bandwidth: %w", i+1, err)
+		}
+	}
+	return nil
+}
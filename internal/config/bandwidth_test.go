@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		rate     string
+		expected int64
+		wantErr  bool
+	}{
+		{"", 0, false},
+		{"1000", 1000, false},
+		{"100k", 100000, false},
+		{"2MB", 2000000, false},
+		{"1g", 1000000000, false},
+		{"512kbit", 64000, false},
+		{"10mbit", 1250000, false},
+		{"1.5 Mbit", 187500, false},
+		{"8bit", 1, false},
+		{"fast", 0, true},
+		{"-1m", 0, true},
+		{"1bit", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.rate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBandwidth(%q) error = %v, wantErr %v", tt.rate, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseBandwidth(%q) = %d, expected %d", tt.rate, got, tt.expected)
+		}
+	}
+}
+
+func TestLoadConfig_Bandwidth(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `rules:
+  - pattern: ".*\\.video\\.com"
+    proxy: DIRECT
+    bandwidth:
+      download: 2mbit
+  - pattern: ".*"
+    proxy: "proxy.corp:8080"
+bandwidth:
+  clients:
+    - networks: ["192.168.50.0/24"]
+      upload: 1mbit
+      download: 5mbit
+  upstreams:
+    "proxy.corp:8080":
+      download: 100mbit
+      shared: true
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if rule := config.Rules[0].Bandwidth; rule == nil || rule.DownloadRate != 250000 || rule.UploadRate != 0 {
+		t.Errorf("Unexpected rule bandwidth %+v", rule)
+	}
+	action, _ := FindProxyForHost("www.video.com", config.Rules)
+	if action.Bandwidth != config.Rules[0].Bandwidth {
+		t.Error("Expected the action to carry the rule bandwidth")
+	}
+
+	clients := config.Bandwidth.FindClientBandwidth("192.168.50.7")
+	if clients == nil || clients.UploadRate != 125000 || clients.DownloadRate != 625000 {
+		t.Errorf("Unexpected client bandwidth %+v", clients)
+	}
+	if config.Bandwidth.FindClientBandwidth("192.168.1.7") != nil {
+		t.Error("Expected no bandwidth for another network")
+	}
+	if upstream := config.Bandwidth.Upstreams["proxy.corp:8080"]; upstream.DownloadRate != 12500000 || !upstream.Shared {
+		t.Errorf("Unexpected upstream bandwidth %+v", upstream)
+	}
+
+	if err := os.WriteFile(configPath, []byte("bandwidth:\n  clients:\n    - networks: [\"10.0.0.0/8\"]\n      upload: fast\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected an invalid rate to fail")
+	}
+}
@@ -2,10 +2,14 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,7 +18,42 @@ const (
 	DEFAULT_HTTPS_PORT = 443
 	DEFAULT_HTTP_PORT  = 80
 	BUFFER_SIZE        = 4096
-	DEFAULT_TIMEOUT     = 900 // seconds
+	DEFAULT_TIMEOUT    = 900 // seconds
+
+	// Limits for buffering a ClientHello that spans several reads
+	MAX_CLIENT_HELLO_SIZE = 65536
+	CLIENT_HELLO_TIMEOUT  = 10 // seconds
+
+	// Time to wait for the client's first bytes on the sniff listener.
+	// Protocols where the server speaks first are routed as raw TCP.
+	SNIFF_TIMEOUT = 2 // seconds
+
+	DEFAULT_UDP_TIMEOUT = 60 // seconds
+
+	// Time given to active connections to finish on shutdown before they are closed
+	DEFAULT_DRAIN_TIMEOUT = 30 // seconds
+
+	DEFAULT_MAX_CONNECTIONS = 1000
+	DEFAULT_QUEUE_TIMEOUT   = 5 // seconds
+)
+
+// Behaviour of a connection limit when it is reached
+const (
+	LIMIT_ACTION_REJECT = "reject" // close the new connection at once
+	LIMIT_ACTION_QUEUE  = "queue"  // wait up to queue_timeout for the limit, then close it
+)
+
+// Where DIRECT connections are opened to, set per rule with connect_to
+const (
+	CONNECT_TO_SNI         = "sni"         // the SNI or Host name, resolved again by the proxy
+	CONNECT_TO_ORIGINAL_IP = "original_ip" // the original destination, as resolved by the client
+	CONNECT_TO_RESOLVE     = "resolve"     // the original destination if the name resolves to it, else the name
+)
+
+// How the firewall hands intercepted TCP connections to the listeners
+const (
+	LISTEN_MODE_REDIRECT = "redirect" // iptables REDIRECT or DNAT, the destination is read with SO_ORIGINAL_DST
+	LISTEN_MODE_TPROXY   = "tproxy"   // iptables TPROXY, the destination is the local address of the connection
 )
 
 type ListenConfig struct {
@@ -22,16 +61,110 @@ type ListenConfig struct {
 	HTTPSPort int    `yaml:"https_port"`
 	HTTPPort  int    `yaml:"http_port"`
 	Timeout   int    `yaml:"timeout"` // Timeout in seconds
+
+	QUICPort   int `yaml:"quic_port"`   // Optional: UDP port for QUIC interception (0 disables it)
+	UDPTimeout int `yaml:"udp_timeout"` // Idle timeout for UDP sessions in seconds
+
+	SniffPort int `yaml:"sniff_port"` // Optional: catch-all port detecting TLS, HTTP or raw TCP (0 disables it)
+
+	DrainTimeout int `yaml:"drain_timeout"` // Seconds to wait for active connections on shutdown
+
+	Mode string `yaml:"mode"` // redirect (default) or tproxy
 }
 
 type Rule struct {
-	Pattern string `yaml:"pattern"`
-	Proxy   string `yaml:"proxy"`
+	Pattern string   `yaml:"pattern"`
+	Proxy   string   `yaml:"proxy"`
+	ALPN    []string `yaml:"alpn"` // Optional: match only if the client offers one of these protocols
+	JA3     []string `yaml:"ja3"`  // Optional: match only these JA3 TLS client fingerprints
+	JA4     []string `yaml:"ja4"`  // Optional: match only these JA4 TLS client fingerprints
+
+	Networks []string `yaml:"networks"` // Optional: match only original destinations in these CIDRs
+	Ports    []int    `yaml:"ports"`    // Optional: match only these original destination ports
+
+	Bandwidth *BandwidthLimit `yaml:"bandwidth"`  // Optional: upload and download limits of matching connections
+	Outbound  *Outbound       `yaml:"outbound"`   // Optional: mark, interface and source address of outgoing connections
+	Resolver  string          `yaml:"resolver"`   // Optional: name of the dns resolver for outgoing connections
+	ConnectTo string          `yaml:"connect_to"` // Optional: sni, original_ip or resolve for DIRECT connections
+
+	hits     *atomic.Uint64 // connections matched since the rule was loaded
+	networks []*net.IPNet   // Networks parsed by LoadConfig
+}
+
+// ECH policies for TLS connections using Encrypted ClientHello
+const (
+	ECH_POLICY_OUTER    = "outer"    // route by the outer (public) server name
+	ECH_POLICY_DROP     = "drop"     // drop the connection so the client retries without ECH
+	ECH_POLICY_UPSTREAM = "upstream" // send the connection to a dedicated upstream proxy
+)
+
+type ECHConfig struct {
+	Policy      string   `yaml:"policy"`       // outer, drop or upstream (default: outer)
+	Upstream    string   `yaml:"upstream"`     // proxy host:port for the upstream policy
+	PublicNames []string `yaml:"public_names"` // apply the policy only to these outer names (regex), required for drop and upstream
+}
+
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // host:port of the metrics endpoint (empty disables it)
+	Path   string `yaml:"path"`   // HTTP path (default: /metrics)
+}
+
+type AdminConfig struct {
+	Listen string `yaml:"listen"` // loopback host:port or unix:/path/to/socket (empty disables it)
+}
+
+type AccessLogConfig struct {
+	Output string `yaml:"output"` // stdout, stderr or a file path (empty disables it)
+	Format string `yaml:"format"` // json or logfmt (default: json)
+
+	// Rotation of a file output, disabled when MaxSize and MaxAge are 0
+	MaxSize    int  `yaml:"max_size"`    // megabytes before the file is rotated
+	MaxAge     int  `yaml:"max_age"`     // hours before the file is rotated
+	MaxBackups int  `yaml:"max_backups"` // rotated files to keep, 0 keeps all
+	Compress   bool `yaml:"compress"`    // gzip rotated files
+}
+
+// AdvancedConfig limits connections on the TCP listeners. The per client
+// limits apply to the source IP and are disabled when 0.
+type AdvancedConfig struct {
+	MaxConnections       int    `yaml:"max_connections"`        // concurrent connections of all clients
+	MaxConnectionsAction string `yaml:"max_connections_action"` // reject or queue (default: reject)
+
+	MaxClientConnections       int    `yaml:"max_client_connections"`        // concurrent connections per client
+	MaxClientConnectionsAction string `yaml:"max_client_connections_action"` // reject or queue (default: reject)
+
+	ClientRate       float64 `yaml:"client_rate"`        // new connections per second per client
+	ClientBurst      int     `yaml:"client_burst"`       // new connections above the rate (default: client_rate rounded up)
+	ClientRateAction string  `yaml:"client_rate_action"` // reject or queue (default: reject)
+
+	QueueTimeout int `yaml:"queue_timeout"` // seconds a queued connection waits (default: 5)
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error (default: info)
+	Format string `yaml:"format"` // text or json (default: text)
+	Output string `yaml:"output"` // stderr, stdout, syslog or a file path (default: stderr)
+
+	AccessLog AccessLogConfig `yaml:"access_log"` // connection records, separate from diagnostic logs
 }
 
 type Config struct {
-	Listen ListenConfig `yaml:"listen"`
-	Rules  []Rule       `yaml:"rules"`
+	Listen  ListenConfig  `yaml:"listen"`
+	Rules   []Rule        `yaml:"rules"`
+	ECH     ECHConfig     `yaml:"ech"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Admin   AdminConfig   `yaml:"admin"`
+	Logging LoggingConfig `yaml:"logging"`
+
+	Advanced  AdvancedConfig  `yaml:"advanced"`
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+	Quotas    QuotaConfig     `yaml:"quotas"`
+	Outbound  OutboundConfig  `yaml:"outbound"`
+	DNS       DNSConfig       `yaml:"dns"`
+	VerifySNI SNIVerifyConfig `yaml:"verify_sni"`
+	FakeIP    FakeIPConfig    `yaml:"fake_ip"`
+
+	Path string `yaml:"-"` // file the configuration was loaded from, used to reload it
 }
 
 var DefaultConfig = Config{
@@ -40,16 +173,57 @@ var DefaultConfig = Config{
 		HTTPSPort: 3130,
 		HTTPPort:  3131,
 		Timeout:   DEFAULT_TIMEOUT,
+
+		UDPTimeout: DEFAULT_UDP_TIMEOUT,
+
+		DrainTimeout: DEFAULT_DRAIN_TIMEOUT,
+
+		Mode: LISTEN_MODE_REDIRECT,
 	},
 	Rules: []Rule{
 		{Pattern: ".*", Proxy: "DIRECT"},
 	},
+	ECH: ECHConfig{
+		Policy: ECH_POLICY_OUTER,
+	},
+	Metrics: MetricsConfig{
+		Path: "/metrics",
+	},
+	Quotas: QuotaConfig{
+		SaveInterval: DEFAULT_QUOTA_SAVE_INTERVAL,
+	},
+	DNS: DNSConfig{
+		Timeout:   DEFAULT_DNS_TIMEOUT,
+		CacheSize: DEFAULT_DNS_CACHE_SIZE,
+	},
+	VerifySNI: SNIVerifyConfig{
+		Policy: SNI_VERIFY_OFF,
+	},
+	FakeIP: FakeIPConfig{
+		Pool: DEFAULT_FAKE_IP_POOL,
+		TTL:  DEFAULT_FAKE_IP_TTL,
+	},
+	Advanced: AdvancedConfig{
+		MaxConnections:             DEFAULT_MAX_CONNECTIONS,
+		MaxConnectionsAction:       LIMIT_ACTION_REJECT,
+		MaxClientConnectionsAction: LIMIT_ACTION_REJECT,
+		ClientRateAction:           LIMIT_ACTION_REJECT,
+		QueueTimeout:               DEFAULT_QUEUE_TIMEOUT,
+	},
+	Logging: LoggingConfig{
+		Level:  "info",
+		Format: "text",
+		Output: "stderr",
+	},
 }
 
 func LoadConfig(configPath string) (*Config, error) {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Printf("Config file %s not found, using default config\n", configPath)
-		return &DefaultConfig, nil
+		slog.Warn("Config file not found, using default config", "path", configPath)
+		config := DefaultConfig
+		config.Path = configPath
+		config.Rules = countHits(config.Rules)
+		return &config, nil
 	}
 
 	data, err := os.ReadFile(configPath)
@@ -61,6 +235,7 @@ func LoadConfig(configPath string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	config.Path = configPath
 
 	// Merge with default config to ensure all required fields exist
 	if config.Listen.Host == "" {
@@ -75,49 +250,426 @@ func LoadConfig(configPath string) (*Config, error) {
 	if config.Listen.Timeout == 0 {
 		config.Listen.Timeout = DefaultConfig.Listen.Timeout
 	}
+	if config.Listen.UDPTimeout == 0 {
+		config.Listen.UDPTimeout = DefaultConfig.Listen.UDPTimeout
+	}
+	if config.Listen.DrainTimeout == 0 {
+		config.Listen.DrainTimeout = DefaultConfig.Listen.DrainTimeout
+	}
+	switch config.Listen.Mode {
+	case "":
+		config.Listen.Mode = DefaultConfig.Listen.Mode
+	case LISTEN_MODE_REDIRECT, LISTEN_MODE_TPROXY:
+	default:
+		return nil, fmt.Errorf("invalid listen mode: %q", config.Listen.Mode)
+	}
 	if len(config.Rules) == 0 {
 		config.Rules = DefaultConfig.Rules
 	}
+	config.Rules = countHits(config.Rules)
+	if config.ECH.Policy == "" {
+		config.ECH.Policy = DefaultConfig.ECH.Policy
+	}
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = DefaultConfig.Metrics.Path
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = DefaultConfig.Logging.Level
+	}
+	if config.Logging.Format == "" {
+		config.Logging.Format = DefaultConfig.Logging.Format
+	}
+	if config.Logging.Output == "" {
+		config.Logging.Output = DefaultConfig.Logging.Output
+	}
+	if err := applyAdvancedDefaults(&config.Advanced); err != nil {
+		return nil, err
+	}
+	if err := parseBandwidth(&config); err != nil {
+		return nil, err
+	}
+	if err := validateOutbound(&config); err != nil {
+		return nil, err
+	}
+	if err := applyDNSDefaults(&config); err != nil {
+		return nil, err
+	}
+	if err := applySNIVerifyDefaults(&config); err != nil {
+		return nil, err
+	}
+	if err := applyFakeIPDefaults(&config); err != nil {
+		return nil, err
+	}
+	for i, rule := range config.Rules {
+		switch rule.ConnectTo {
+		case "", CONNECT_TO_SNI, CONNECT_TO_ORIGINAL_IP, CONNECT_TO_RESOLVE:
+		default:
+			return nil, fmt.Errorf("rule %d: invalid connect_to: %q", i+1, rule.ConnectTo)
+		}
+		networks, err := parseNetworks(rule.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		config.Rules[i].networks = networks
+	}
+	if err := applyQuotaDefaults(&config.Quotas); err != nil {
+		return nil, err
+	}
+
+	switch config.ECH.Policy {
+	case ECH_POLICY_OUTER, ECH_POLICY_DROP:
+	case ECH_POLICY_UPSTREAM:
+		if config.ECH.Upstream == "" {
+			return nil, fmt.Errorf("ech policy %q requires an upstream", config.ECH.Policy)
+		}
+	default:
+		return nil, fmt.Errorf("invalid ech policy: %q", config.ECH.Policy)
+	}
+	// Browsers send a GREASE ECH extension without an ECH configuration,
+	// which cannot be told apart from real ECH
+	if config.ECH.Policy != ECH_POLICY_OUTER && len(config.ECH.PublicNames) == 0 {
+		return nil, fmt.Errorf("ech policy %q requires public_names, \".*\" applies it to all connections including GREASE ECH of browsers", config.ECH.Policy)
+	}
+
+	switch config.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf("invalid log level: %q", config.Logging.Level)
+	}
+	switch config.Logging.Format {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid log format: %q", config.Logging.Format)
+	}
+	switch config.Logging.AccessLog.Format {
+	case "", "json", "logfmt":
+	default:
+		return nil, fmt.Errorf("invalid access log format: %q", config.Logging.AccessLog.Format)
+	}
+	if err := validateAccessLogRotation(config.Logging.AccessLog); err != nil {
+		return nil, err
+	}
+
+	if err := validateAdminListen(config.Admin.Listen); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// applyAdvancedDefaults fills in unset connection limits and validates them
+func applyAdvancedDefaults(cfg *AdvancedConfig) error {
+	if cfg.MaxConnections < 0 || cfg.MaxClientConnections < 0 || cfg.ClientRate < 0 || cfg.ClientBurst < 0 || cfg.QueueTimeout < 0 {
+		return fmt.Errorf("advanced connection limits must not be negative")
+	}
+	if cfg.MaxConnections == 0 {
+		cfg.MaxConnections = DefaultConfig.Advanced.MaxConnections
+	}
+	if cfg.ClientRate > 0 && cfg.ClientBurst == 0 {
+		cfg.ClientBurst = int(math.Ceil(cfg.ClientRate))
+	}
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = DefaultConfig.Advanced.QueueTimeout
+	}
+
+	actions := map[string]*string{
+		"max_connections_action":        &cfg.MaxConnectionsAction,
+		"max_client_connections_action": &cfg.MaxClientConnectionsAction,
+		"client_rate_action":            &cfg.ClientRateAction,
+	}
+	for name, action := range actions {
+		switch *action {
+		case "":
+			*action = LIMIT_ACTION_REJECT
+		case LIMIT_ACTION_REJECT, LIMIT_ACTION_QUEUE:
+		default:
+			return fmt.Errorf("invalid %s: %q", name, *action)
+		}
+	}
+	return nil
+}
+
+// validateAccessLogRotation rejects negative limits and rotation of standard
+// streams
+func validateAccessLogRotation(cfg AccessLogConfig) error {
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.MaxBackups < 0 {
+		return fmt.Errorf("access log max_size, max_age and max_backups must not be negative")
+	}
+	rotated := cfg.MaxSize > 0 || cfg.MaxAge > 0
+	if rotated && (cfg.Output == "" || cfg.Output == "stdout" || cfg.Output == "stderr") {
+		return fmt.Errorf("access log rotation requires a file output")
+	}
+	return nil
+}
+
+// validateAdminListen only accepts unix sockets and loopback addresses, the
+// admin API has no authentication
+func validateAdminListen(listen string) error {
+	if listen == "" || strings.HasPrefix(listen, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin listen address %q: %w", listen, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin listen address %q must be a loopback address or unix socket", listen)
+	}
+	return nil
+}
+
 type ProxyAction struct {
-	Type string // "DIRECT", "PROXY", "DROP"
+	Type string // "DIRECT", "PROXY", "DROP", "REJECT"
 	Host string
 	Port int
+	Rule int // 1-based index of the matching rule, 0 if no rule matched
+
+	Bandwidth *BandwidthLimit // limit of the matching rule, nil for none
+	Outbound  *Outbound       // outbound options of the matching rule, nil for none
+	Resolver  string          // dns resolver of the matching rule, empty for the default
+	ConnectTo string          // connect_to of the matching rule, empty for the default
+
+	hits *atomic.Uint64 // hit counter of the matching rule, nil for none
+}
+
+// CountHit counts a connection for the matching rule
+func (a *ProxyAction) CountHit() {
+	if a.hits != nil {
+		a.hits.Add(1)
+	}
+}
+
+// countHits returns a copy of rules with new hit counters, so that the
+// counts of a loaded configuration start at zero and follow the rules
+// rather than their positions
+func countHits(rules []Rule) []Rule {
+	counted := make([]Rule, len(rules))
+	for i, rule := range rules {
+		rule.hits = new(atomic.Uint64)
+		counted[i] = rule
+	}
+	return counted
+}
+
+// Hits returns the number of connections that matched the rule since its
+// configuration was loaded
+func (r Rule) Hits() uint64 {
+	if r.hits == nil {
+		return 0
+	}
+	return r.hits.Load()
+}
+
+// ConnInfo describes a connection for rule matching. Fields that are not
+// known for a connection are left empty.
+type ConnInfo struct {
+	Host string   // SNI, Host header or original destination IP
+	ALPN []string // ALPN protocols offered in the TLS ClientHello
+	JA3  string   // JA3 fingerprint of the TLS ClientHello
+	JA4  string   // JA4 fingerprint of the TLS ClientHello
+
+	DstIP   string // Original destination IP
+	DstPort int    // Original destination port
+}
+
+// Action returns the action of the rule's proxy setting
+func (r Rule) Action() *ProxyAction {
+	switch r.Proxy {
+	case "DIRECT":
+		return &ProxyAction{Type: "DIRECT"}
+	case "DROP":
+		return &ProxyAction{Type: "DROP"}
+	case "REJECT":
+		return &ProxyAction{Type: "REJECT"}
+	default:
+		// Parse proxy host:port
+		host, port := parseProxyAddress(r.Proxy)
+		return &ProxyAction{
+			Type: "PROXY",
+			Host: host,
+			Port: port,
+		}
+	}
 }
 
 func FindProxyForHost(host string, rules []Rule) (*ProxyAction, error) {
-	for _, rule := range rules {
-		matched, err := regexp.MatchString(rule.Pattern, host)
+	return FindProxyForConn(&ConnInfo{Host: host}, rules)
+}
+
+// FindProxyForConn returns the action of the first rule matching the
+// connection, or DIRECT if no rule matches.
+func FindProxyForConn(info *ConnInfo, rules []Rule) (*ProxyAction, error) {
+	for i, rule := range rules {
+		matched, err := regexp.MatchString(rule.Pattern, info.Host)
 		if err != nil {
-			log.Printf("Invalid regex pattern: %s\n", rule.Pattern)
+			slog.Warn("Invalid regex pattern", "rule", i+1, "pattern", rule.Pattern, "error", err)
 			continue
 		}
 
-		if matched {
-			switch rule.Proxy {
-			case "DIRECT":
-				return &ProxyAction{Type: "DIRECT"}, nil
-			case "DROP":
-				return &ProxyAction{Type: "DROP"}, nil
-			default:
-				// Parse proxy host:port
-				host, port := parseProxyAddress(rule.Proxy)
-				return &ProxyAction{
-					Type: "PROXY",
-					Host: host,
-					Port: port,
-				}, nil
-			}
+		// The first condition that fails is logged at debug level
+		mismatch := ""
+		switch {
+		case !matched:
+			mismatch = "pattern"
+		case len(rule.ALPN) > 0 && !matchesAny(rule.ALPN, info.ALPN):
+			mismatch = "alpn"
+		case len(rule.JA3) > 0 && !matchesAny(rule.JA3, []string{info.JA3}):
+			mismatch = "ja3"
+		case len(rule.JA4) > 0 && !matchesAny(rule.JA4, []string{info.JA4}):
+			mismatch = "ja4"
+		case len(rule.Networks) > 0 && !rule.matchesNetwork(info.DstIP):
+			mismatch = "networks"
+		case len(rule.Ports) > 0 && !matchesPort(rule.Ports, info.DstPort):
+			mismatch = "ports"
 		}
+
+		if mismatch != "" {
+			slog.Debug("Rule does not match", "rule", i+1, "pattern", rule.Pattern, "host", info.Host, "condition", mismatch)
+			continue
+		}
+
+		slog.Debug("Rule matches", "rule", i+1, "pattern", rule.Pattern, "host", info.Host, "proxy", rule.Proxy)
+		action := rule.Action()
+		action.Rule = i + 1
+		action.Bandwidth = rule.Bandwidth
+		action.Outbound = rule.Outbound
+		action.Resolver = rule.Resolver
+		action.ConnectTo = rule.ConnectTo
+		action.hits = rule.hits
+		return action, nil
 	}
 
 	// Fallback to DIRECT if no rules match
+	slog.Debug("No rule matches, using DIRECT", "host", info.Host)
 	return &ProxyAction{Type: "DIRECT"}, nil
 }
 
+// FindECHAction returns the action for a connection using Encrypted
+// ClientHello with the given outer server name. It returns nil if the
+// connection should be routed by the rules using the outer name.
+func FindECHAction(outerName string, ech ECHConfig) *ProxyAction {
+	if len(ech.PublicNames) > 0 {
+		applies := false
+		for _, pattern := range ech.PublicNames {
+			matched, err := regexp.MatchString(pattern, outerName)
+			if err != nil {
+				slog.Warn("Invalid regex pattern", "ech_public_name", pattern, "error", err)
+				continue
+			}
+			if matched {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return nil
+		}
+	}
+
+	switch ech.Policy {
+	case ECH_POLICY_DROP:
+		return &ProxyAction{Type: "DROP"}
+	case ECH_POLICY_UPSTREAM:
+		host, port := parseProxyAddress(ech.Upstream)
+		return &ProxyAction{Type: "PROXY", Host: host, Port: port}
+	default:
+		return nil
+	}
+}
+
+// matchesAny reports whether any of the wanted values is present in offered
+func matchesAny(wanted, offered []string) bool {
+	for _, w := range wanted {
+		for _, o := range offered {
+			if w == o {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesNetwork reports whether ip is in one of the CIDRs. A plain address
+// matches only itself.
+func matchesNetwork(networks []string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			if other := net.ParseIP(n); other != nil && other.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			slog.Warn("Invalid network", "network", n, "error", err)
+			continue
+		}
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses CIDRs and plain addresses, which become networks of
+// a single address
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, n := range networks {
+		if strings.Contains(n, "/") {
+			_, network, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network: %q", n)
+			}
+			parsed = append(parsed, network)
+			continue
+		}
+		ip := net.ParseIP(n)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network: %q", n)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return parsed, nil
+}
+
+// matchesNetwork reports whether ip is in the networks of the rule, parsed
+// when the configuration was loaded
+func (r *Rule) matchesNetwork(ip string) bool {
+	if r.networks == nil {
+		return matchesNetwork(r.Networks, ip)
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range r.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
 func parseProxyAddress(proxy string) (string, int) {
 	// Simple parsing for host:port format
 	// Default to port 3128 if not specified
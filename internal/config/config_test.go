@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -284,3 +286,535 @@ rules:
 		t.Errorf("Expected default timeout %d, got %d", DEFAULT_TIMEOUT, config.Listen.Timeout)
 	}
 }
+
+func TestFindProxyForConn_ALPN(t *testing.T) {
+	rules := []Rule{
+		{Pattern: ".*\\.example\\.com", Proxy: "h2-proxy:8080", ALPN: []string{"h2"}},
+		{Pattern: ".*\\.example\\.com", Proxy: "DROP"},
+		{Pattern: ".*", Proxy: "DIRECT"},
+	}
+
+	tests := []struct {
+		name     string
+		info     ConnInfo
+		expected string
+	}{
+		{"OffersH2", ConnInfo{Host: "www.example.com", ALPN: []string{"h2", "http/1.1"}}, "PROXY"},
+		{"HTTP11Only", ConnInfo{Host: "www.example.com", ALPN: []string{"http/1.1"}}, "DROP"},
+		{"NoALPN", ConnInfo{Host: "www.example.com"}, "DROP"},
+		{"OtherHost", ConnInfo{Host: "example.org", ALPN: []string{"h2"}}, "DIRECT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := FindProxyForConn(&tt.info, rules)
+			if err != nil {
+				t.Fatalf("FindProxyForConn failed: %v", err)
+			}
+			if action.Type != tt.expected {
+				t.Errorf("Expected action type %s, got %s", tt.expected, action.Type)
+			}
+		})
+	}
+}
+
+func TestFindProxyForConn_Fingerprint(t *testing.T) {
+	rules := []Rule{
+		{Pattern: ".*", Proxy: "DROP", JA3: []string{"e7d705a3286e19ea42f587b344ee6865"}},
+		{Pattern: ".*", Proxy: "app-proxy:8080", JA4: []string{"t13d1516h2_8daaf6152771_02713d6af862"}},
+		{Pattern: ".*", Proxy: "DIRECT"},
+	}
+
+	tests := []struct {
+		name     string
+		info     ConnInfo
+		expected string
+	}{
+		{"KnownBot", ConnInfo{Host: "example.com", JA3: "e7d705a3286e19ea42f587b344ee6865"}, "DROP"},
+		{"MobileApp", ConnInfo{Host: "example.com", JA4: "t13d1516h2_8daaf6152771_02713d6af862"}, "PROXY"},
+		{"Browser", ConnInfo{Host: "example.com", JA3: "0123", JA4: "t13d1517h2_0123"}, "DIRECT"},
+		{"PlainHTTP", ConnInfo{Host: "example.com"}, "DIRECT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := FindProxyForConn(&tt.info, rules)
+			if err != nil {
+				t.Fatalf("FindProxyForConn failed: %v", err)
+			}
+			if action.Type != tt.expected {
+				t.Errorf("Expected action type %s, got %s", tt.expected, action.Type)
+			}
+		})
+	}
+}
+
+func TestFindECHAction(t *testing.T) {
+	tests := []struct {
+		name         string
+		ech          ECHConfig
+		outerName    string
+		expectedType string // empty for routing by outer name
+		expectedHost string
+	}{
+		{"Outer", ECHConfig{Policy: ECH_POLICY_OUTER}, "cloudflare-ech.com", "", ""},
+		{"Drop", ECHConfig{Policy: ECH_POLICY_DROP}, "cloudflare-ech.com", "DROP", ""},
+		{"Upstream", ECHConfig{Policy: ECH_POLICY_UPSTREAM, Upstream: "ech-proxy:8080"}, "cloudflare-ech.com", "PROXY", "ech-proxy"},
+		{"PublicNameMatch", ECHConfig{Policy: ECH_POLICY_DROP, PublicNames: []string{"cloudflare-ech\\.com"}}, "cloudflare-ech.com", "DROP", ""},
+		{"PublicNameMismatch", ECHConfig{Policy: ECH_POLICY_DROP, PublicNames: []string{"cloudflare-ech\\.com"}}, "www.example.com", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := FindECHAction(tt.outerName, tt.ech)
+			if tt.expectedType == "" {
+				if action != nil {
+					t.Errorf("Expected routing by outer name, got %s", action.Type)
+				}
+				return
+			}
+			if action == nil {
+				t.Fatalf("Expected action %s, got routing by outer name", tt.expectedType)
+			}
+			if action.Type != tt.expectedType || action.Host != tt.expectedHost {
+				t.Errorf("Expected %s %s, got %s %s", tt.expectedType, tt.expectedHost, action.Type, action.Host)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ECHPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expected    string
+		shouldError bool
+	}{
+		{"Default", "rules: []\n", ECH_POLICY_OUTER, false},
+		{"Drop", "ech:\n  policy: drop\n  public_names: [\"cloudflare-ech\\\\.com\"]\n", ECH_POLICY_DROP, false},
+		{"DropWithoutPublicNames", "ech:\n  policy: drop\n", "", true},
+		{"UpstreamWithoutProxy", "ech:\n  policy: upstream\n  public_names: [\".*\"]\n", "", true},
+		{"UpstreamWithoutPublicNames", "ech:\n  policy: upstream\n  upstream: \"ech-proxy:8080\"\n", "", true},
+		{"Invalid", "ech:\n  policy: block\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create config file: %v", err)
+			}
+
+			config, err := LoadConfig(configPath)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected LoadConfig to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if config.ECH.Policy != tt.expected {
+				t.Errorf("Expected ECH policy %s, got %s", tt.expected, config.ECH.Policy)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ListenMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expected    string
+		shouldError bool
+	}{
+		{"Default", "rules: []\n", LISTEN_MODE_REDIRECT, false},
+		{"TProxy", "listen:\n  mode: tproxy\n", LISTEN_MODE_TPROXY, false},
+		{"Invalid", "listen:\n  mode: dnat\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create config file: %v", err)
+			}
+
+			config, err := LoadConfig(configPath)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected LoadConfig to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if config.Listen.Mode != tt.expected {
+				t.Errorf("Expected listen mode %s, got %s", tt.expected, config.Listen.Mode)
+			}
+		})
+	}
+}
+
+func TestFindProxyForConn_NetworksAndPorts(t *testing.T) {
+	rules := []Rule{
+		{Pattern: ".*", Proxy: "ssh-proxy:3128", Networks: []string{"10.0.0.0/8"}, Ports: []int{22}},
+		{Pattern: ".*", Proxy: "DROP", Networks: []string{"192.0.2.1", "invalid"}},
+		{Pattern: ".*", Proxy: "DROP", Ports: []int{25}},
+		{Pattern: ".*", Proxy: "DIRECT"},
+	}
+
+	tests := []struct {
+		name     string
+		info     ConnInfo
+		expected string
+	}{
+		{"NetworkAndPort", ConnInfo{Host: "10.1.2.3", DstIP: "10.1.2.3", DstPort: 22}, "PROXY"},
+		{"NetworkOtherPort", ConnInfo{Host: "10.1.2.3", DstIP: "10.1.2.3", DstPort: 443}, "DIRECT"},
+		{"SingleAddress", ConnInfo{Host: "example.com", DstIP: "192.0.2.1", DstPort: 443}, "DROP"},
+		{"PortOnly", ConnInfo{Host: "198.51.100.7", DstIP: "198.51.100.7", DstPort: 25}, "DROP"},
+		{"UnknownDestination", ConnInfo{Host: "example.com"}, "DIRECT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := FindProxyForConn(&tt.info, rules)
+			if err != nil {
+				t.Fatalf("FindProxyForConn failed: %v", err)
+			}
+			if action.Type != tt.expected {
+				t.Errorf("Expected action type %s, got %s", tt.expected, action.Type)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_AdminListen(t *testing.T) {
+	tests := []struct {
+		listen  string
+		wantErr bool
+	}{
+		{"127.0.0.1:9090", false},
+		{"localhost:9090", false},
+		{"[::1]:9090", false},
+		{"unix:/run/tproxy/admin.sock", false},
+		{"0.0.0.0:9090", true},
+		{"192.168.1.1:9090", true},
+		{"127.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.listen, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := fmt.Sprintf("admin:\n  listen: %q\n", tt.listen)
+			if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			cfg, err := LoadConfig(configPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error for %s", tt.listen)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.Admin.Listen != tt.listen || cfg.Path != configPath {
+				t.Errorf("Unexpected admin listen %q or path %q", cfg.Admin.Listen, cfg.Path)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_AccessLogRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"file", "output: /var/log/tproxy/access.log\n    max_size: 100\n    max_backups: 7\n    compress: true", false},
+		{"age only", "output: /var/log/tproxy/access.log\n    max_age: 24", false},
+		{"stdout", "output: stdout\n    max_size: 100", true},
+		{"negative", "output: /var/log/tproxy/access.log\n    max_backups: -1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := "logging:\n  access_log:\n    " + tt.content + "\n"
+			if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			_, err := LoadConfig(configPath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Advanced(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected AdvancedConfig
+		wantErr  bool
+	}{
+		{"defaults", "buffer_size: 8192", AdvancedConfig{
+			MaxConnections: 1000, MaxConnectionsAction: "reject", MaxClientConnectionsAction: "reject",
+			ClientRateAction: "reject", QueueTimeout: 5,
+		}, false},
+		{"limits", "max_connections: 50\n  max_connections_action: queue\n  max_client_connections: 10\n  client_rate: 2.5\n  client_rate_action: queue", AdvancedConfig{
+			MaxConnections: 50, MaxConnectionsAction: "queue", MaxClientConnections: 10, MaxClientConnectionsAction: "reject",
+			ClientRate: 2.5, ClientBurst: 3, ClientRateAction: "queue", QueueTimeout: 5,
+		}, false},
+		{"invalid action", "client_rate_action: wait", AdvancedConfig{}, true},
+		{"negative", "max_client_connections: -1", AdvancedConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := "advanced:\n  " + tt.content + "\n"
+			if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			config, err := LoadConfig(configPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && config.Advanced != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, config.Advanced)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Outbound(t *testing.T) {
+	content := `
+outbound:
+  mark: 1
+  interface: eth0
+  upstreams:
+    "proxy.example.com:3128":
+      interface: wg0
+rules:
+  - pattern: ".*\\.example\\.net$"
+    proxy: proxy.example.com:3128
+    outbound:
+      source_address: 192.0.2.10
+  - pattern: ".*"
+    proxy: DIRECT
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	// The rule overrides the upstream, which overrides the defaults
+	got := config.Outbound.FindOutbound("proxy.example.com:3128", config.Rules[0].Outbound)
+	expected := Outbound{Mark: 1, Interface: "wg0", SourceAddress: "192.0.2.10"}
+	if got != expected {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+	if got := config.Outbound.FindOutbound("", config.Rules[1].Outbound); got != (Outbound{Mark: 1, Interface: "eth0"}) {
+		t.Errorf("Expected the defaults for DIRECT, got %+v", got)
+	}
+
+	// Marks use all 32 bits
+	if err := os.WriteFile(configPath, []byte("outbound:\n  mark: 0xffffffff\n"), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	if config, err := LoadConfig(configPath); err != nil || config.Outbound.Mark != 0xffffffff {
+		t.Errorf("Expected the largest mark, got %+v %v", config, err)
+	}
+
+	for _, invalid := range []string{
+		"outbound:\n  source_address: eth0\n",
+		"outbound:\n  mark: -1\n",
+		"outbound:\n  mark: 4294967296\n",
+		"rules:\n  - pattern: .*\n    proxy: DIRECT\n    outbound:\n      source_address: 300.1.1.1\n",
+	} {
+		if err := os.WriteFile(configPath, []byte(invalid), 0644); err != nil {
+			t.Fatalf("Failed to create config file: %v", err)
+		}
+		if _, err := LoadConfig(configPath); err == nil {
+			t.Errorf("Expected LoadConfig to fail for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_DNS(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		shouldError bool
+	}{
+		{"Defaults", "rules: []\n", false},
+		{"Resolvers", "dns:\n  servers: [\"tls://9.9.9.9\"]\n  resolvers:\n    corp:\n      servers: [\"10.0.0.53\"]\nrules:\n  - pattern: corp\n    proxy: DIRECT\n    resolver: corp\n", false},
+		{"UnknownResolver", "rules:\n  - pattern: corp\n    proxy: DIRECT\n    resolver: corp\n", true},
+		{"ResolverWithoutServers", "dns:\n  resolvers:\n    corp: {}\n", true},
+		{"InvalidHost", "dns:\n  hosts:\n    router.lan: [\"router\"]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create config file: %v", err)
+			}
+
+			config, err := LoadConfig(configPath)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected LoadConfig to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if config.DNS.Timeout != DEFAULT_DNS_TIMEOUT || config.DNS.CacheSize != DEFAULT_DNS_CACHE_SIZE {
+				t.Errorf("Expected the dns defaults, got %+v", config.DNS)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ConnectTo(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "rules:\n  - pattern: .*\n    proxy: DIRECT\n    connect_to: original_ip\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	action, _ := FindProxyForHost("example.com", config.Rules)
+	if action.ConnectTo != CONNECT_TO_ORIGINAL_IP {
+		t.Errorf("Expected connect_to original_ip on the action, got %q", action.ConnectTo)
+	}
+
+	if err := os.WriteFile(configPath, []byte("rules:\n  - pattern: .*\n    proxy: DIRECT\n    connect_to: ip\n"), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected LoadConfig to fail for an invalid connect_to")
+	}
+}
+
+func TestLoadConfig_RuleNetworks(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "rules:\n  - pattern: .*\n    proxy: DROP\n    networks: [\"10.0.0.0/8\", \"192.0.2.1\", \"2001:db8::1\"]\n  - pattern: .*\n    proxy: DIRECT\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(config.Rules[0].networks) != 3 {
+		t.Fatalf("Expected 3 parsed networks, got %d", len(config.Rules[0].networks))
+	}
+	for ip, expected := range map[string]string{
+		"10.1.2.3":    "DROP",
+		"192.0.2.1":   "DROP",
+		"192.0.2.2":   "DIRECT",
+		"2001:db8::1": "DROP",
+		"2001:db8::2": "DIRECT",
+	} {
+		action, err := FindProxyForConn(&ConnInfo{Host: "example.com", DstIP: ip}, config.Rules)
+		if err != nil {
+			t.Fatalf("FindProxyForConn failed: %v", err)
+		}
+		if action.Type != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, ip, action.Type)
+		}
+	}
+
+	if err := os.WriteFile(configPath, []byte("rules:\n  - pattern: .*\n    proxy: DIRECT\n  - pattern: .*\n    proxy: DROP\n    networks: [\"10.0.0.0/33\"]\n"), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	_, err = LoadConfig(configPath)
+	if err == nil || !strings.Contains(err.Error(), "rule 2") {
+		t.Errorf("Expected LoadConfig to fail naming rule 2, got %v", err)
+	}
+}
+
+func TestLoadConfig_VerifySNI(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "verify_sni:\n  policy: drop\n  networks: [\"104.16.0.0/13\", \"192.0.2.10\"]\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.VerifySNI.Policy != SNI_VERIFY_DROP {
+		t.Errorf("Expected policy drop, got %q", config.VerifySNI.Policy)
+	}
+	if !config.VerifySNI.Trusts("104.16.1.1") || !config.VerifySNI.Trusts("192.0.2.10") || config.VerifySNI.Trusts("192.0.2.11") {
+		t.Error("Expected only the configured networks to be trusted")
+	}
+
+	if config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || config.VerifySNI.Policy != SNI_VERIFY_OFF {
+		t.Errorf("Expected verification off by default, got %+v %v", config, err)
+	}
+
+	for _, invalid := range []string{
+		"verify_sni:\n  policy: block\n",
+		"verify_sni:\n  policy: log\n  networks: [\"104.16.0.0/33\"]\n",
+		"verify_sni:\n  policy: log\n  resolver: corp\n",
+	} {
+		if err := os.WriteFile(configPath, []byte(invalid), 0644); err != nil {
+			t.Fatalf("Failed to create config file: %v", err)
+		}
+		if _, err := LoadConfig(configPath); err == nil {
+			t.Errorf("Expected LoadConfig to fail for %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfig_FakeIP(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "fake_ip:\n  listen: \"127.0.0.1:5353\"\n  exclude: [\"\\\\.lan$\"]\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create config file: %v", err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.FakeIP.Pool != DEFAULT_FAKE_IP_POOL || config.FakeIP.TTL != DEFAULT_FAKE_IP_TTL {
+		t.Errorf("Expected the default pool and TTL, got %+v", config.FakeIP)
+	}
+	if !config.FakeIP.Excludes("nas.lan") || config.FakeIP.Excludes("example.com") {
+		t.Error("Expected only names matching exclude to be excluded")
+	}
+
+	for _, invalid := range []string{
+		"fake_ip:\n  listen: \"127.0.0.1\"\n",
+		"fake_ip:\n  listen: \"127.0.0.1:53\"\n  pool: \"198.18.0.0\"\n",
+		"fake_ip:\n  listen: \"127.0.0.1:53\"\n  ttl: -1\n",
+		"fake_ip:\n  listen: \"127.0.0.1:53\"\n  exclude: [\"(\"]\n",
+	} {
+		if err := os.WriteFile(configPath, []byte(invalid), 0644); err != nil {
+			t.Fatalf("Failed to create config file: %v", err)
+		}
+		if _, err := LoadConfig(configPath); err == nil {
+			t.Errorf("Expected LoadConfig to fail for %q", invalid)
+		}
+	}
+}
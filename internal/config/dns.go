@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	DEFAULT_DNS_TIMEOUT    = 5 // seconds
+	DEFAULT_DNS_CACHE_SIZE = 4096
+)
+
+// DNSConfig sets how the host names of outgoing connections are resolved.
+// Without servers the system resolver is used.
+type DNSConfig struct {
+	Servers   []string               `yaml:"servers"`    // udp, tcp, tls or https servers of the default resolver, tried in order
+	Timeout   int                    `yaml:"timeout"`    // seconds per server query (default: 5)
+	CacheSize int                    `yaml:"cache_size"` // answers kept (default: 4096, -1 disables the cache)
+	Hosts     map[string][]string    `yaml:"hosts"`      // static addresses by host name, used by all resolvers
+	Resolvers map[string]DNSResolver `yaml:"resolvers"`  // named resolvers selected by rules
+}
+
+type DNSResolver struct {
+	Servers []string `yaml:"servers"`
+}
+
+// applyDNSDefaults fills in the defaults and checks the hosts and the
+// resolvers referenced by rules
+func applyDNSDefaults(config *Config) error {
+	dns := &config.DNS
+	if dns.Timeout == 0 {
+		dns.Timeout = DEFAULT_DNS_TIMEOUT
+	}
+	if dns.CacheSize == 0 {
+		dns.CacheSize = DEFAULT_DNS_CACHE_SIZE
+	}
+	if dns.Timeout < 0 {
+		return fmt.Errorf("invalid dns timeout: %d", dns.Timeout)
+	}
+	for host, addresses := range dns.Hosts {
+		for _, address := range addresses {
+			if net.ParseIP(address) == nil {
+				return fmt.Errorf("invalid address %q for dns host %s", address, host)
+			}
+		}
+	}
+	for name, resolver := range dns.Resolvers {
+		if len(resolver.Servers) == 0 {
+			return fmt.Errorf("dns resolver %s has no servers", name)
+		}
+	}
+	for i, rule := range config.Rules {
+		if _, ok := dns.Resolvers[rule.Resolver]; rule.Resolver != "" && !ok {
+			return fmt.Errorf("rule %d: unknown dns resolver %q", i+1, rule.Resolver)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+)
+
+const (
+	DEFAULT_FAKE_IP_POOL = "198.18.0.0/15" // reserved for benchmarking, RFC 2544
+	DEFAULT_FAKE_IP_TTL  = 1               // seconds
+)
+
+// FakeIPConfig enables a DNS server answering with addresses of a reserved
+// pool. Connections to them are routed by the name that was looked up.
+type FakeIPConfig struct {
+	Listen  string   `yaml:"listen"`  // host:port for UDP and TCP queries (default: disabled)
+	Pool    string   `yaml:"pool"`    // network of the fake addresses (default: 198.18.0.0/15)
+	TTL     int      `yaml:"ttl"`     // seconds clients may cache answers (default: 1)
+	Exclude []string `yaml:"exclude"` // Optional: names answered with their real addresses (regex)
+}
+
+// Excludes reports whether name is answered with its real addresses
+func (f *FakeIPConfig) Excludes(name string) bool {
+	for _, pattern := range f.Exclude {
+		if matched, err := regexp.MatchString(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func applyFakeIPDefaults(config *Config) error {
+	f := &config.FakeIP
+	if f.Pool == "" {
+		f.Pool = DEFAULT_FAKE_IP_POOL
+	}
+	if f.TTL == 0 {
+		f.TTL = DEFAULT_FAKE_IP_TTL
+	}
+	if f.TTL < 0 {
+		return fmt.Errorf("invalid fake_ip ttl: %d", f.TTL)
+	}
+	if _, _, err := net.ParseCIDR(f.Pool); err != nil {
+		return fmt.Errorf("invalid fake_ip pool: %q", f.Pool)
+	}
+	if f.Listen != "" {
+		if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+			return fmt.Errorf("invalid fake_ip listen address: %q", f.Listen)
+		}
+	}
+	for _, pattern := range f.Exclude {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid fake_ip exclude pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
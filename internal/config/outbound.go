@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// Outbound sets up the sockets of connections to servers and upstream
+// proxies, e.g. so the firewall can exclude them from interception
+type Outbound struct {
+	Mark          uint32 `yaml:"mark"`           // SO_MARK fwmark, 0 for none (Linux, needs CAP_NET_ADMIN)
+	Interface     string `yaml:"interface"`      // SO_BINDTODEVICE interface, empty for any (Linux, needs CAP_NET_RAW)
+	SourceAddress string `yaml:"source_address"` // local IP of the connections, empty for the routing default
+}
+
+type OutboundConfig struct {
+	Outbound  `yaml:",inline"`    // defaults for all connections
+	Upstreams map[string]Outbound `yaml:"upstreams"` // keyed by proxy host:port as used in rules
+}
+
+// override returns o with the options set in other replacing its own
+func (o Outbound) override(other *Outbound) Outbound {
+	if other == nil {
+		return o
+	}
+	if other.Mark != 0 {
+		o.Mark = other.Mark
+	}
+	if other.Interface != "" {
+		o.Interface = other.Interface
+	}
+	if other.SourceAddress != "" {
+		o.SourceAddress = other.SourceAddress
+	}
+	return o
+}
+
+// FindOutbound returns the options for a connection: the defaults,
+// overridden by those of the upstream, if any, and then by the rule's
+func (c *OutboundConfig) FindOutbound(upstream string, rule *Outbound) Outbound {
+	result := c.Outbound
+	if options, ok := c.Upstreams[upstream]; ok && upstream != "" {
+		result = result.override(&options)
+	}
+	return result.override(rule)
+}
+
+func (o *Outbound) validate() error {
+	if o.SourceAddress != "" && net.ParseIP(o.SourceAddress) == nil {
+		return fmt.Errorf("invalid source_address: %q", o.SourceAddress)
+	}
+	return nil
+}
+
+// validateOutbound checks the outbound section and the rules' options
+func validateOutbound(config *Config) error {
+	if err := config.Outbound.validate(); err != nil {
+		return fmt.Errorf("outbound: %w", err)
+	}
+	for upstream, options := range config.Outbound.Upstreams {
+		if err := options.validate(); err != nil {
+			return fmt.Errorf("outbound upstream %s: %w", upstream, err)
+		}
+	}
+	for i := range config.Rules {
+		if config.Rules[i].Outbound == nil {
+			continue
+		}
+		if err := config.Rules[i].Outbound.validate(); err != nil {
+			return fmt.Errorf("rule %d outbound: %w", i+1, err)
+		}
+	}
+	return nil
+}
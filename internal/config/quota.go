@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tproxy/internal/quota"
+)
+
+const DEFAULT_QUOTA_SAVE_INTERVAL = 60 // seconds
+
+// QuotaGroup is a byte quota for clients with a source IP in Networks.
+// Bytes relayed in both directions count against it.
+type QuotaGroup struct {
+	Name      string   `yaml:"name"`
+	Networks  []string `yaml:"networks"`
+	PerClient bool     `yaml:"per_client"` // each client IP has its own quota instead of one for the group
+	Period    string   `yaml:"period"`     // daily or monthly (default: daily)
+	Limit     string   `yaml:"limit"`      // bytes per period, e.g. 500m or 10g
+	Action    string   `yaml:"action"`     // DROP, REJECT or proxy host:port once exhausted (default: DROP)
+
+	LimitBytes uint64 `yaml:"-"` // parsed from Limit
+}
+
+type QuotaConfig struct {
+	StateFile    string       `yaml:"state_file"`    // usage is kept across restarts in this file (empty keeps it in memory)
+	SaveInterval int          `yaml:"save_interval"` // seconds between saves of the state file (default: 60)
+	Groups       []QuotaGroup `yaml:"groups"`        // the first group matching the client IP applies
+}
+
+// FindQuotaGroup returns the first group matching ip, nil if none does
+func (q *QuotaConfig) FindQuotaGroup(ip string) *QuotaGroup {
+	for i := range q.Groups {
+		if matchesNetwork(q.Groups[i].Networks, ip) {
+			return &q.Groups[i]
+		}
+	}
+	return nil
+}
+
+// ExceededAction returns the action replacing the rule action once the
+// quota is exhausted
+func (g *QuotaGroup) ExceededAction() *ProxyAction {
+	return Rule{Proxy: g.Action}.Action()
+}
+
+// ParseBytes returns the bytes of a size. The suffixes k, m, g and t, with
+// an optional b, multiply by powers of 1000.
+func ParseBytes(size string) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "b")
+
+	multiplier := 1.0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1e3
+		case 'm':
+			multiplier = 1e6
+		case 'g':
+			multiplier = 1e9
+		case 't':
+			multiplier = 1e12
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value*multiplier < 1 {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// applyQuotaDefaults fills in unset quota settings and validates the groups
+func applyQuotaDefaults(cfg *QuotaConfig) error {
+	if cfg.SaveInterval < 0 {
+		return fmt.Errorf("quotas save_interval must not be negative")
+	}
+	if cfg.SaveInterval == 0 {
+		cfg.SaveInterval = DEFAULT_QUOTA_SAVE_INTERVAL
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		if group.Name == "" {
+			return fmt.Errorf("quota group %d has no name", i+1)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("duplicate quota group %q", group.Name)
+		}
+		names[group.Name] = true
+		if len(group.Networks) == 0 {
+			return fmt.Errorf("quota group %q has no networks", group.Name)
+		}
+
+		switch group.Period {
+		case "":
+			group.Period = quota.PERIOD_DAILY
+		case quota.PERIOD_DAILY, quota.PERIOD_MONTHLY:
+		default:
+			return fmt.Errorf("invalid period of quota group %q: %q", group.Name, group.Period)
+		}
+		if group.Action == "" {
+			group.Action = "DROP"
+		}
+		if action := group.ExceededAction(); action.Type == "PROXY" && (action.Host == "" || action.Port == 0) {
+			return fmt.Errorf("invalid action of quota group %q: %q", group.Name, group.Action)
+		}
+
+		limit, err := ParseBytes(group.Limit)
+		if err != nil {
+			return fmt.Errorf("quota group %q: %w", group.Name, err)
+		}
+		group.LimitBytes = limit
+	}
+	return nil
+}
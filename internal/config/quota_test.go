@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected uint64
+		wantErr  bool
+	}{
+		{"1000", 1000, false},
+		{"500m", 500000000, false},
+		{"10GB", 10000000000, false},
+		{"1.5t", 1500000000000, false},
+		{"2 kb", 2000, false},
+		{"", 0, true},
+		{"lots", 0, true},
+		{"-1g", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBytes(%q) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseBytes(%q) = %d, expected %d", tt.size, got, tt.expected)
+		}
+	}
+}
+
+func TestLoadConfig_Quotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", "  groups:\n    - name: guests\n      networks: [\"192.168.50.0/24\"]\n      per_client: true\n      limit: 2g\n      action: \"slow-proxy:3128\"", false},
+		{"no limit", "  groups:\n    - name: guests\n      networks: [\"192.168.50.0/24\"]", true},
+		{"no name", "  groups:\n    - networks: [\"192.168.50.0/24\"]\n      limit: 2g", true},
+		{"bad period", "  groups:\n    - name: guests\n      networks: [\"192.168.50.0/24\"]\n      limit: 2g\n      period: weekly", true},
+		{"bad action", "  groups:\n    - name: guests\n      networks: [\"192.168.50.0/24\"]\n      limit: 2g\n      action: \":3128\"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte("quotas:\n"+tt.content+"\n"), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			config, err := LoadConfig(configPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			group := config.Quotas.FindQuotaGroup("192.168.50.7")
+			if group == nil || group.LimitBytes != 2000000000 || group.Period != "daily" || config.Quotas.SaveInterval != 60 {
+				t.Fatalf("Unexpected quota config %+v", config.Quotas)
+			}
+			if action := group.ExceededAction(); action.Type != "PROXY" || action.Host != "slow-proxy" || action.Port != 3128 {
+				t.Errorf("Unexpected exceeded action %+v", action)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// What happens to a TLS connection whose SNI does not resolve to its
+// original destination
+const (
+	SNI_VERIFY_OFF      = "off"      // no verification
+	SNI_VERIFY_LOG      = "log"      // log the mismatch and route by the SNI
+	SNI_VERIFY_ROUTE_IP = "route_ip" // route by the original destination IP instead of the SNI
+	SNI_VERIFY_DROP     = "drop"     // drop the connection
+)
+
+// SNIVerifyConfig detects domain fronting: a client sending the SNI of an
+// allowed name to the address of another service
+type SNIVerifyConfig struct {
+	Policy   string   `yaml:"policy"`   // off (default), log, route_ip or drop
+	Networks []string `yaml:"networks"` // Optional: original destinations accepted for any name, e.g. CDN ranges
+	Resolver string   `yaml:"resolver"` // Optional: dns resolver for the check, empty for the default
+}
+
+// Trusts reports whether ip is in the networks accepted for any name
+func (v *SNIVerifyConfig) Trusts(ip string) bool {
+	return matchesNetwork(v.Networks, ip)
+}
+
+func applySNIVerifyDefaults(config *Config) error {
+	v := &config.VerifySNI
+	switch v.Policy {
+	case "":
+		v.Policy = SNI_VERIFY_OFF
+	case SNI_VERIFY_OFF, SNI_VERIFY_LOG, SNI_VERIFY_ROUTE_IP, SNI_VERIFY_DROP:
+	default:
+		return fmt.Errorf("invalid verify_sni policy: %q", v.Policy)
+	}
+	for _, n := range v.Networks {
+		if strings.Contains(n, "/") {
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("invalid verify_sni network: %q", n)
+			}
+		} else if net.ParseIP(n) == nil {
+			return fmt.Errorf("invalid verify_sni network: %q", n)
+		}
+	}
+	if _, ok := config.DNS.Resolvers[v.Resolver]; v.Resolver != "" && !ok {
+		return fmt.Errorf("verify_sni: unknown dns resolver %q", v.Resolver)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MAX_FAKE_IPS bounds the addresses used of large, e.g. IPv6, pools
+const MAX_FAKE_IPS = 1 << 20
+
+// FakeIPPool hands out addresses of a reserved network for host names and
+// maps them back. When all addresses are in use, the least recently used
+// one is given to the new name.
+type FakeIPPool struct {
+	network *net.IPNet
+	size    uint64 // usable addresses, at offsets 1 to size
+
+	mu     sync.Mutex
+	byName map[string]*list.Element
+	byIP   map[uint64]*list.Element
+	lru    *list.List // of *fakeIPEntry, most recently used first
+	next   uint64     // offset of the next unused address
+}
+
+type fakeIPEntry struct {
+	name   string
+	offset uint64
+}
+
+// NewFakeIPPool returns a pool of the addresses of cidr, without the
+// network and broadcast addresses
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake IP pool: %q", cidr)
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		network.IP = ip4
+	}
+	ones, bits := network.Mask.Size()
+	size := uint64(MAX_FAKE_IPS)
+	if hostBits := bits - ones; hostBits < 21 {
+		size = 1<<hostBits - 2
+	}
+	if size < 1 || size > MAX_FAKE_IPS {
+		return nil, fmt.Errorf("fake IP pool %s is too small", cidr)
+	}
+	return &FakeIPPool{
+		network: network,
+		size:    size,
+		byName:  make(map[string]*list.Element),
+		byIP:    make(map[uint64]*list.Element),
+		lru:     list.New(),
+		next:    1,
+	}, nil
+}
+
+// IPv4 reports whether the pool has IPv4 addresses
+func (p *FakeIPPool) IPv4() bool {
+	return len(p.network.IP) == net.IPv4len
+}
+
+// Contains reports whether ip belongs to the pool's network
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+// IP returns the address of name, handing out a new one if it has none
+func (p *FakeIPPool) IP(name string) net.IP {
+	name = canonicalName(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.byName[name]; ok {
+		p.lru.MoveToFront(e)
+		return p.address(e.Value.(*fakeIPEntry).offset)
+	}
+
+	var entry *fakeIPEntry
+	if p.next <= p.size {
+		entry = &fakeIPEntry{name: name, offset: p.next}
+		p.next++
+	} else {
+		// Reuse the least recently used address
+		oldest := p.lru.Back()
+		entry = p.lru.Remove(oldest).(*fakeIPEntry)
+		delete(p.byName, entry.name)
+		delete(p.byIP, entry.offset)
+		entry.name = name
+	}
+	e := p.lru.PushFront(entry)
+	p.byName[name] = e
+	p.byIP[entry.offset] = e
+	return p.address(entry.offset)
+}
+
+// Name returns the host name ip was handed out for
+func (p *FakeIPPool) Name(ip net.IP) (string, bool) {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.byIP[offset]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).name, true
+}
+
+// Len returns the number of names with an address
+func (p *FakeIPPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// address returns the IP at offset from the network address. Offsets
+// stay below MAX_FAKE_IPS, so only the last 8 bytes change.
+func (p *FakeIPPool) address(offset uint64) net.IP {
+	ip := append(net.IP(nil), p.network.IP...)
+	if len(ip) == net.IPv4len {
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(offset))
+	} else {
+		tail := ip[net.IPv6len-8:]
+		binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)+offset)
+	}
+	return ip
+}
+
+func (p *FakeIPPool) offset(ip net.IP) (uint64, bool) {
+	if !p.network.Contains(ip) {
+		return 0, false
+	}
+	var offset uint64
+	if p.IPv4() {
+		offset = uint64(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(p.network.IP))
+	} else {
+		offset = binary.BigEndian.Uint64(ip.To16()[net.IPv6len-8:]) - binary.BigEndian.Uint64(p.network.IP[net.IPv6len-8:])
+	}
+	// Host bits of large IPv6 pools outside the last 8 bytes are not used
+	return offset, offset >= 1 && offset <= p.size && p.address(offset).Equal(ip)
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	pool, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatalf("NewFakeIPPool failed: %v", err)
+	}
+
+	first := pool.IP("Example.com.")
+	if first.String() != "198.18.0.1" {
+		t.Errorf("Expected the first address after the network address, got %s", first)
+	}
+	if ip := pool.IP("example.com"); !ip.Equal(first) {
+		t.Errorf("Expected the same address for the same name, got %s", ip)
+	}
+	if ip := pool.IP("www.example.com"); ip.String() != "198.18.0.2" {
+		t.Errorf("Expected the next address, got %s", ip)
+	}
+
+	if name, ok := pool.Name(net.ParseIP("198.18.0.1")); !ok || name != "example.com" {
+		t.Errorf("Expected example.com, got %q %v", name, ok)
+	}
+	for _, ip := range []string{"198.18.0.3", "198.18.0.0", "192.0.2.1"} {
+		if _, ok := pool.Name(net.ParseIP(ip)); ok {
+			t.Errorf("Expected no name for %s", ip)
+		}
+	}
+	if !pool.Contains(net.ParseIP("198.19.255.255")) || pool.Contains(net.ParseIP("198.20.0.0")) {
+		t.Error("Expected the pool to contain its network only")
+	}
+}
+
+func TestFakeIPPool_ReusesLeastRecentlyUsed(t *testing.T) {
+	// Two usable addresses
+	pool, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatalf("NewFakeIPPool failed: %v", err)
+	}
+	a := pool.IP("a.example.com")
+	b := pool.IP("b.example.com")
+	// A connection to a keeps it in use
+	if _, ok := pool.Name(a); !ok {
+		t.Fatal("Expected a name for the first address")
+	}
+
+	if ip := pool.IP("c.example.com"); !ip.Equal(b) {
+		t.Errorf("Expected the address of b to be reused, got %s", ip)
+	}
+	if name, _ := pool.Name(b); name != "c.example.com" {
+		t.Errorf("Expected the reused address to map to the new name, got %q", name)
+	}
+	if pool.Len() != 2 {
+		t.Errorf("Expected 2 names, got %d", pool.Len())
+	}
+}
+
+func TestFakeIPPool_IPv6(t *testing.T) {
+	pool, err := NewFakeIPPool("fd00:18::/48")
+	if err != nil {
+		t.Fatalf("NewFakeIPPool failed: %v", err)
+	}
+	if pool.IPv4() {
+		t.Error("Expected an IPv6 pool")
+	}
+	ip := pool.IP("example.com")
+	if ip.String() != "fd00:18::1" {
+		t.Errorf("Expected fd00:18::1, got %s", ip)
+	}
+	if name, ok := pool.Name(ip); !ok || name != "example.com" {
+		t.Errorf("Expected example.com, got %q %v", name, ok)
+	}
+	// Same offset, other host bits
+	if _, ok := pool.Name(net.ParseIP("fd00:18:0:1::1")); ok {
+		t.Error("Expected no name for an address outside the used range")
+	}
+
+	for _, cidr := range []string{"198.18.0.0/31", "not-a-network"} {
+		if _, err := NewFakeIPPool(cidr); err == nil {
+			t.Errorf("Expected an error for %s", cidr)
+		}
+	}
+}
+
+func TestFakeIPHandler(t *testing.T) {
+	pool, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatalf("NewFakeIPPool failed: %v", err)
+	}
+	var forwarded []string
+	h := &FakeIPHandler{
+		Pool:    pool,
+		TTL:     1,
+		Exclude: func(name string) bool { return strings.HasSuffix(name, ".lan") },
+		Forward: func(ctx context.Context, query []byte) ([]byte, error) {
+			m, _ := Unpack(query)
+			forwarded = append(forwarded, m.Questions[0].Name)
+			if m.Questions[0].Name == "broken.lan" {
+				return nil, errors.New("no answer")
+			}
+			response := &Message{Header: Header{ID: m.ID, Response: true}, Questions: m.Questions}
+			for i := 0; i < 40; i++ {
+				response.Answers = append(response.Answers, Record{Name: m.Questions[0].Name, Type: TYPE_A, Class: CLASS_INET, TTL: 60, Data: []byte{192, 168, 1, byte(i)}})
+			}
+			return response.Pack()
+		},
+	}
+	answer := func(name string, qtype uint16, udp bool) *Message {
+		t.Helper()
+		query, err := NewQuery(7, name, qtype).Pack()
+		if err != nil {
+			t.Fatalf("Pack failed: %v", err)
+		}
+		m, err := Unpack(h.Answer(context.Background(), query, udp))
+		if err != nil {
+			t.Fatalf("%s: invalid response: %v", name, err)
+		}
+		if m.ID != 7 || !m.Response {
+			t.Fatalf("%s: response does not match the query: %+v", name, m.Header)
+		}
+		return m
+	}
+
+	m := answer("www.example.com", TYPE_A, true)
+	if len(m.Answers) != 1 || net.IP(m.Answers[0].Data).String() != "198.18.0.1" || m.Answers[0].TTL != 1 {
+		t.Errorf("Expected a fake address, got %+v", m.Answers)
+	}
+	// The name exists, without addresses of the other family or hints
+	for _, qtype := range []uint16{TYPE_AAAA, TYPE_HTTPS} {
+		if m := answer("www.example.com", qtype, true); m.RCode != RCODE_SUCCESS || len(m.Answers) != 0 {
+			t.Errorf("Expected an empty answer for type %d, got %+v", qtype, m)
+		}
+	}
+	if len(forwarded) != 0 {
+		t.Errorf("Expected no forwarded query, got %v", forwarded)
+	}
+
+	// Excluded names get their real addresses, over TCP if they do not fit
+	if m := answer("nas.lan", TYPE_A, false); len(m.Answers) != 40 {
+		t.Errorf("Expected the forwarded answer, got %d records", len(m.Answers))
+	}
+	if m := answer("nas.lan", TYPE_A, true); !m.Truncated || len(m.Answers) != 0 {
+		t.Errorf("Expected a truncated answer over UDP, got %+v", m.Header)
+	}
+	if m := answer("broken.lan", TYPE_A, true); m.RCode != RCODE_SERVER_FAILURE {
+		t.Errorf("Expected SERVFAIL for a failed forward, got %d", m.RCode)
+	}
+	if len(forwarded) != 3 {
+		t.Errorf("Expected 3 forwarded queries, got %v", forwarded)
+	}
+
+	// Responses are ignored, garbage gets FORMERR
+	response, _ := (&Message{Header: Header{ID: 1, Response: true}}).Pack()
+	if h.Answer(context.Background(), response, true) != nil {
+		t.Error("Expected no answer to a response")
+	}
+	if m, err := Unpack(h.Answer(context.Background(), []byte{0, 9, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3}, true)); err != nil || m.RCode != RCODE_FORMAT_ERROR {
+		t.Errorf("Expected FORMERR, got %+v %v", m, err)
+	}
+}
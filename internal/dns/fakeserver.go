@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+
+	"tproxy/internal/metrics"
+)
+
+// Record types answered without their addresses for names with a fake IP.
+// Their address hints would let clients bypass the fake IP.
+const (
+	TYPE_SVCB  = 64
+	TYPE_HTTPS = 65
+)
+
+// MIN_UDP_SIZE is the largest answer over UDP to clients without EDNS
+const MIN_UDP_SIZE = 512
+
+// FakeIPHandler answers the queries of clients: address queries with fake
+// IPs from Pool, excluded names and other queries through Forward
+type FakeIPHandler struct {
+	Pool    *FakeIPPool
+	TTL     uint32
+	Exclude func(name string) bool                                  // names answered with their real addresses
+	Forward func(ctx context.Context, query []byte) ([]byte, error) // nil answers SERVFAIL
+}
+
+// Answer returns the response to query, nil if it is not a query. Over
+// UDP, responses longer than the client accepts are truncated.
+func (h *FakeIPHandler) Answer(ctx context.Context, query []byte, udp bool) []byte {
+	m, err := Unpack(query)
+	if err != nil {
+		if len(query) < headerSize || query[2]&0x80 != 0 {
+			return nil
+		}
+		metrics.FakeIPQueries.WithLabelValues("error").Inc()
+		return reply(&Message{Header: Header{ID: binary.BigEndian.Uint16(query), Response: true, RCode: RCODE_FORMAT_ERROR}}, 0)
+	}
+	if m.Response {
+		return nil
+	}
+	response := &Message{
+		Header:    Header{ID: m.ID, Opcode: m.Opcode, Response: true, RecursionDesired: m.RecursionDesired, RecursionAvailable: true},
+		Questions: m.Questions,
+	}
+	maxSize := 0
+	if udp {
+		maxSize = udpSize(m)
+	}
+	if m.Opcode != 0 {
+		response.RCode = RCODE_NOT_IMPLEMENTED
+		metrics.FakeIPQueries.WithLabelValues("error").Inc()
+		return reply(response, maxSize)
+	}
+	if len(m.Questions) != 1 {
+		response.RCode = RCODE_FORMAT_ERROR
+		metrics.FakeIPQueries.WithLabelValues("error").Inc()
+		return reply(response, maxSize)
+	}
+
+	q := m.Questions[0]
+	if q.Class == CLASS_INET && (h.Exclude == nil || !h.Exclude(canonicalName(q.Name))) {
+		switch q.Type {
+		case TYPE_A, TYPE_AAAA:
+			// Names exist without addresses of the other family
+			if (q.Type == TYPE_A) == h.Pool.IPv4() {
+				ip := h.Pool.IP(q.Name)
+				if q.Type == TYPE_A {
+					ip = ip.To4()
+				}
+				response.Answers = []Record{{Name: q.Name, Type: q.Type, Class: CLASS_INET, TTL: h.TTL, Data: ip}}
+			}
+			metrics.FakeIPQueries.WithLabelValues("fake").Inc()
+			return reply(response, maxSize)
+		case TYPE_SVCB, TYPE_HTTPS:
+			metrics.FakeIPQueries.WithLabelValues("fake").Inc()
+			return reply(response, maxSize)
+		}
+	}
+
+	var answer []byte
+	if h.Forward != nil {
+		answer, err = h.Forward(ctx, query)
+	}
+	if err != nil || answer == nil {
+		response.RCode = RCODE_SERVER_FAILURE
+		metrics.FakeIPQueries.WithLabelValues("error").Inc()
+		return reply(response, maxSize)
+	}
+	metrics.FakeIPQueries.WithLabelValues("forward").Inc()
+	if maxSize > 0 && len(answer) > maxSize {
+		// The client repeats the query over TCP
+		response.Truncated = true
+		return reply(response, maxSize)
+	}
+	return answer
+}
+
+// udpSize returns the largest UDP response the client of m accepts, the
+// class of its OPT record
+func udpSize(m *Message) int {
+	for _, record := range m.Additionals {
+		if record.Type == TYPE_OPT && record.Class > MIN_UDP_SIZE {
+			return int(record.Class)
+		}
+	}
+	return MIN_UDP_SIZE
+}
+
+// reply packs response, without its records if it exceeds maxSize
+func reply(response *Message, maxSize int) []byte {
+	b, err := response.Pack()
+	if err == nil && (maxSize == 0 || len(b) <= maxSize) {
+		return b
+	}
+	response.Answers, response.Authorities, response.Additionals = nil, nil, nil
+	response.Truncated = err == nil
+	if err != nil {
+		response.RCode = RCODE_SERVER_FAILURE
+	}
+	if b, err = response.Pack(); err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,255 @@
+// Package dns resolves the host names of outgoing connections through
+// configured DNS servers over UDP, TCP, TLS (DoT) or HTTPS (DoH), with a
+// cache respecting the TTLs of the answers. It also answers the queries of
+// clients with fake IPs that map back to the names.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Record types and class
+const (
+	TYPE_A     = 1
+	TYPE_CNAME = 5
+	TYPE_SOA   = 6
+	TYPE_AAAA  = 28
+	TYPE_OPT   = 41
+
+	CLASS_INET = 1
+)
+
+// Response codes
+const (
+	RCODE_SUCCESS         = 0
+	RCODE_FORMAT_ERROR    = 1
+	RCODE_SERVER_FAILURE  = 2
+	RCODE_NAME_ERROR      = 3 // NXDOMAIN
+	RCODE_NOT_IMPLEMENTED = 4
+	RCODE_REFUSED         = 5
+)
+
+// MAX_MESSAGE_SIZE is the largest message over TCP, TLS and HTTPS
+const MAX_MESSAGE_SIZE = 65535
+
+const headerSize = 12
+
+var errTruncatedMessage = errors.New("dns: truncated message")
+
+// Header is the fixed part of a message
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	RCode              uint8
+}
+
+type Question struct {
+	Name  string // without the trailing dot
+	Type  uint16
+	Class uint16
+}
+
+// Record is a resource record. Data is the raw RDATA; names inside it,
+// e.g. of CNAME records, may be compressed against the whole message.
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []Record
+	Authorities []Record
+	Additionals []Record
+}
+
+// NewQuery returns a recursive query for name
+func NewQuery(id uint16, name string, qtype uint16) *Message {
+	return &Message{
+		Header:    Header{ID: id, RecursionDesired: true},
+		Questions: []Question{{Name: name, Type: qtype, Class: CLASS_INET}},
+	}
+}
+
+// Pack encodes the message without name compression
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerSize, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	flags := uint16(m.Opcode&0x0f)<<11 | uint16(m.RCode&0x0f)
+	for _, f := range []struct {
+		set bool
+		bit uint16
+	}{
+		{m.Response, 1 << 15}, {m.Authoritative, 1 << 10}, {m.Truncated, 1 << 9},
+		{m.RecursionDesired, 1 << 8}, {m.RecursionAvailable, 1 << 7},
+	} {
+		if f.set {
+			flags |= f.bit
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, section := range [][]Record{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range section {
+			if len(r.Data) > 0xffff {
+				return nil, fmt.Errorf("dns: record data of %s too long", r.Name)
+			}
+			if b, err = appendName(b, r.Name); err != nil {
+				return nil, err
+			}
+			b = binary.BigEndian.AppendUint16(b, r.Type)
+			b = binary.BigEndian.AppendUint16(b, r.Class)
+			b = binary.BigEndian.AppendUint32(b, r.TTL)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+			b = append(b, r.Data...)
+		}
+	}
+	if len(b) > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("dns: message too long")
+	}
+	return b, nil
+}
+
+// appendName appends name as a sequence of labels
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("dns: name too long: %q", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("dns: invalid name: %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// Unpack decodes a message
+func Unpack(b []byte) (*Message, error) {
+	if len(b) < headerSize {
+		return nil, errTruncatedMessage
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &Message{Header: Header{
+		ID:                 binary.BigEndian.Uint16(b[0:]),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             uint8(flags>>11) & 0x0f,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		RCode:              uint8(flags & 0x0f),
+	}}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+
+	off := headerSize
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errTruncatedMessage
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for i, section := range []*[]Record{&m.Answers, &m.Authorities, &m.Additionals} {
+		for j := 0; j < counts[i+1]; j++ {
+			name, next, err := readName(b, off)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(b) {
+				return nil, errTruncatedMessage
+			}
+			length := int(binary.BigEndian.Uint16(b[next+8:]))
+			if next+10+length > len(b) {
+				return nil, errTruncatedMessage
+			}
+			*section = append(*section, Record{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(b[next:]),
+				Class: binary.BigEndian.Uint16(b[next+2:]),
+				TTL:   binary.BigEndian.Uint32(b[next+4:]),
+				Data:  b[next+10 : next+10+length],
+			})
+			off = next + 10 + length
+		}
+	}
+	return m, nil
+}
+
+// readName reads the possibly compressed name at off and returns it with
+// the offset after it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errTruncatedMessage
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return "", 0, errTruncatedMessage
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("dns: compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case length > 63:
+			return "", 0, errors.New("dns: invalid label")
+		default:
+			if off+1+length > len(b) {
+				return "", 0, errTruncatedMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestMessage_PackUnpack(t *testing.T) {
+	m := &Message{
+		Header:    Header{ID: 0x1234, Response: true, RecursionDesired: true, RecursionAvailable: true, RCode: RCODE_NAME_ERROR},
+		Questions: []Question{{Name: "example.com", Type: TYPE_AAAA, Class: CLASS_INET}},
+		Answers:   []Record{{Name: "example.com.", Type: TYPE_A, Class: CLASS_INET, TTL: 300, Data: []byte{192, 0, 2, 1}}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	got, err := Unpack(b)
+	if err != nil {
+		t.Fatalf("Unpack failed: %v", err)
+	}
+	if got.Header != m.Header {
+		t.Errorf("Expected header %+v, got %+v", m.Header, got.Header)
+	}
+	if len(got.Questions) != 1 || got.Questions[0] != m.Questions[0] {
+		t.Errorf("Unexpected questions %+v", got.Questions)
+	}
+	if len(got.Answers) != 1 || got.Answers[0].Name != "example.com" || got.Answers[0].TTL != 300 || string(got.Answers[0].Data) != string(m.Answers[0].Data) {
+		t.Errorf("Unexpected answers %+v", got.Answers)
+	}
+}
+
+func TestUnpack_CompressedNames(t *testing.T) {
+	b, err := (&Message{Header: Header{ID: 1, Response: true}, Questions: []Question{{Name: "www.example.com", Type: TYPE_A, Class: CLASS_INET}}}).Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	// One answer whose name points at the question name at offset 12
+	binary.BigEndian.PutUint16(b[6:], 1)
+	b = append(b, 0xc0, 12)
+	b = binary.BigEndian.AppendUint16(b, TYPE_A)
+	b = binary.BigEndian.AppendUint16(b, CLASS_INET)
+	b = binary.BigEndian.AppendUint32(b, 60)
+	b = binary.BigEndian.AppendUint16(b, 4)
+	b = append(b, 198, 51, 100, 7)
+
+	m, err := Unpack(b)
+	if err != nil {
+		t.Fatalf("Unpack failed: %v", err)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Name != "www.example.com" {
+		t.Errorf("Expected the compressed name to be expanded, got %+v", m.Answers)
+	}
+}
+
+func TestUnpack_Invalid(t *testing.T) {
+	valid, err := NewQuery(1, "example.com", TYPE_A).Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	loop := append([]byte(nil), valid[:headerSize]...)
+	loop = append(loop, 0xc0, 12, 0, 1, 0, 1)
+
+	for name, b := range map[string][]byte{
+		"short header":     valid[:5],
+		"truncated":        valid[:len(valid)-3],
+		"compression loop": loop,
+	} {
+		if _, err := Unpack(b); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPack_InvalidName(t *testing.T) {
+	long := make([]byte, 64)
+	for i := range long {
+		long[i] = 'a'
+	}
+	for _, name := range []string{"a..b", string(long) + ".com"} {
+		if _, err := NewQuery(1, name, TYPE_A).Pack(); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"tproxy/internal/metrics"
+)
+
+// Cache limits in seconds. Answers without an SOA record for the negative
+// TTL are cached for NEGATIVE_TTL.
+const (
+	MAX_CACHE_TTL = 24 * 60 * 60
+	NEGATIVE_TTL  = 30
+)
+
+// LOCAL_TTL is the TTL of answers to clients from static hosts and the
+// system resolver
+const LOCAL_TTL = 60
+
+// Options configure a Resolver
+type Options struct {
+	Name      string              // name in metrics and logs, empty for the default resolver
+	Servers   []string            // DNS servers tried in order, none for the system resolver
+	Hosts     map[string][]string // static answers by host name
+	Timeout   time.Duration       // per server query
+	CacheSize int                 // answers kept, 0 disables the cache
+	Dial      DialFunc            // opens the connections to the servers
+}
+
+// Resolver looks up the addresses of host names
+type Resolver struct {
+	name      string
+	upstreams []Upstream
+	hosts     map[string][]net.IP
+	timeout   time.Duration
+	cache     *cache
+}
+
+func New(options Options) (*Resolver, error) {
+	r := &Resolver{
+		name:    options.Name,
+		hosts:   make(map[string][]net.IP),
+		timeout: options.Timeout,
+		cache:   newCache(options.CacheSize),
+	}
+	if r.name == "" {
+		r.name = "default"
+	}
+	for _, server := range options.Servers {
+		upstream, err := ParseUpstream(server, options.Dial)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	for host, addresses := range options.Hosts {
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q for host %s", address, host)
+			}
+			r.hosts[canonicalName(host)] = append(r.hosts[canonicalName(host)], ip)
+		}
+	}
+	return r, nil
+}
+
+// canonicalName lowercases name and removes the trailing dot
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupIP returns the IPv4 and then the IPv6 addresses of host. Static
+// hosts are answered first; without servers the system resolver is used.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := canonicalName(host)
+	if ips, ok := r.hosts[name]; ok {
+		metrics.DNSLookups.WithLabelValues(r.name, "hosts").Inc()
+		return ips, nil
+	}
+	if len(r.upstreams) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		metrics.DNSLookups.WithLabelValues(r.name, lookupResult(err, false)).Inc()
+		return ips, err
+	}
+
+	type answer struct {
+		ips    []net.IP
+		cached bool
+		err    error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []uint16{TYPE_A, TYPE_AAAA} {
+		go func(qtype uint16) {
+			ips, cached, err := r.query(ctx, name, qtype)
+			answers <- answer{ips, cached, err}
+		}(qtype)
+	}
+	a, b := <-answers, <-answers
+
+	var ips []net.IP
+	for _, an := range []answer{a, b} {
+		ips = append(ips, an.ips...)
+	}
+	// IPv4 first, dialing it works on more networks
+	sortIPv4First(ips)
+
+	var err error
+	switch {
+	case len(ips) > 0:
+	case a.err != nil && !isNotFound(a.err):
+		err = a.err
+	case b.err != nil && !isNotFound(b.err):
+		err = b.err
+	default:
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	metrics.DNSLookups.WithLabelValues(r.name, lookupResult(err, a.cached && b.cached)).Inc()
+	return ips, err
+}
+
+func lookupResult(err error, cached bool) string {
+	switch {
+	case isNotFound(err):
+		return "not_found"
+	case err != nil:
+		return "error"
+	case cached:
+		return "cache"
+	default:
+		return "ok"
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func sortIPv4First(ips []net.IP) {
+	i := 0
+	for j, ip := range ips {
+		if ip.To4() != nil {
+			ips[i], ips[j] = ips[j], ips[i]
+			i++
+		}
+	}
+}
+
+// query returns the addresses of one type from the cache or the first
+// server that answers
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, bool, error) {
+	if ips, err, ok := r.cache.get(name, qtype); ok {
+		return ips, true, err
+	}
+
+	var lastErr error
+	for _, upstream := range r.upstreams {
+		ips, ttl, err := r.exchange(ctx, upstream, name, qtype)
+		if err != nil && !isNotFound(err) {
+			lastErr = fmt.Errorf("%s: %w", upstream, err)
+			continue
+		}
+		r.cache.put(name, qtype, ips, err, ttl)
+		return ips, false, err
+	}
+	return nil, false, lastErr
+}
+
+// Exchange answers a query message from a client through the servers in
+// order. Address queries for static hosts, and all address queries without
+// servers, are answered from LookupIP.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	m, err := Unpack(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Questions) != 1 {
+		return nil, errors.New("query without a single question")
+	}
+	q := m.Questions[0]
+	if _, ok := r.hosts[canonicalName(q.Name)]; (ok || len(r.upstreams) == 0) && q.Class == CLASS_INET && (q.Type == TYPE_A || q.Type == TYPE_AAAA) {
+		return r.answerLocally(ctx, m)
+	}
+	if len(r.upstreams) == 0 {
+		return nil, errors.New("no DNS servers for the query type")
+	}
+
+	var lastErr error
+	for _, upstream := range r.upstreams {
+		upstreamCtx := ctx
+		cancel := context.CancelFunc(func() {})
+		if r.timeout > 0 {
+			upstreamCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		}
+		response, err := upstream.Exchange(upstreamCtx, query)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", upstream, err)
+			continue
+		}
+		if len(response) < headerSize || !bytes.Equal(response[:2], query[:2]) {
+			lastErr = fmt.Errorf("%s: answer does not match the query", upstream)
+			continue
+		}
+		if rcode := response[3] & 0x0f; rcode == RCODE_SERVER_FAILURE || rcode == RCODE_REFUSED {
+			lastErr = fmt.Errorf("%s: server answered with rcode %d", upstream, rcode)
+			continue
+		}
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+// answerLocally answers an address query from LookupIP
+func (r *Resolver) answerLocally(ctx context.Context, query *Message) ([]byte, error) {
+	q := query.Questions[0]
+	response := &Message{
+		Header:    Header{ID: query.ID, Response: true, RecursionDesired: query.RecursionDesired, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+	ips, err := r.LookupIP(ctx, q.Name)
+	switch {
+	case isNotFound(err):
+		response.RCode = RCODE_NAME_ERROR
+	case err != nil:
+		return nil, err
+	}
+	for _, ip := range ips {
+		data := []byte(ip.To4())
+		if q.Type == TYPE_AAAA {
+			data = ip.To16()
+			if ip.To4() != nil {
+				continue
+			}
+		}
+		if data != nil {
+			response.Answers = append(response.Answers, Record{Name: q.Name, Type: q.Type, Class: CLASS_INET, TTL: LOCAL_TTL, Data: data})
+		}
+	}
+	return response.Pack()
+}
+
+// exchange sends one query to upstream and returns the answer and its TTL
+func (r *Resolver) exchange(ctx context.Context, upstream Upstream, name string, qtype uint16) ([]net.IP, uint32, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	query, err := NewQuery(binary.BigEndian.Uint16(id[:]), name, qtype).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	data, err := upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := Unpack(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !response.Response || response.ID != binary.BigEndian.Uint16(id[:]) {
+		return nil, 0, errors.New("answer does not match the query")
+	}
+
+	switch response.RCode {
+	case RCODE_SUCCESS:
+	case RCODE_NAME_ERROR:
+		return nil, negativeTTL(response), &net.DNSError{Err: "no such host", Name: name, Server: upstream.String(), IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("server answered with rcode %d", response.RCode)
+	}
+
+	// Recursive servers include the CNAME chain, whose shortest TTL applies
+	var ips []net.IP
+	ttl := uint32(MAX_CACHE_TTL)
+	for _, record := range response.Answers {
+		if record.Class != CLASS_INET {
+			continue
+		}
+		switch {
+		case record.Type == TYPE_A && qtype == TYPE_A && len(record.Data) == net.IPv4len,
+			record.Type == TYPE_AAAA && qtype == TYPE_AAAA && len(record.Data) == net.IPv6len:
+			ips = append(ips, net.IP(append([]byte(nil), record.Data...)))
+		case record.Type != TYPE_CNAME:
+			continue
+		}
+		ttl = min(ttl, record.TTL)
+	}
+	if len(ips) == 0 {
+		// The name exists without addresses of this type
+		return nil, negativeTTL(response), nil
+	}
+	return ips, ttl, nil
+}
+
+// negativeTTL returns how long to cache a missing answer, the TTL of the
+// SOA record in the authority section
+func negativeTTL(m *Message) uint32 {
+	for _, record := range m.Authorities {
+		if record.Type == TYPE_SOA {
+			return min(record.TTL, MAX_CACHE_TTL)
+		}
+	}
+	return NEGATIVE_TTL
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// cache keeps answers until their TTL expires
+type cache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[cacheKey]cacheEntry)}
+}
+
+func (c *cache) get(name string, qtype uint16) ([]net.IP, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey{name, qtype}]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil, false
+	}
+	return entry.ips, entry.err, true
+}
+
+func (c *cache) put(name string, qtype uint16, ips []net.IP, err error, ttl uint32) {
+	if c.size <= 0 || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		// Still full, drop an arbitrary entry
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[cacheKey{name, qtype}] = cacheEntry{ips: ips, err: err, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
@@ -0,0 +1,360 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testZone answers like a recursive server for a few names
+type testZone struct {
+	queries atomic.Int32
+	ttl     uint32
+}
+
+func (z *testZone) answer(query []byte) []byte {
+	z.queries.Add(1)
+	m, err := Unpack(query)
+	if err != nil || len(m.Questions) != 1 {
+		return nil
+	}
+	q := m.Questions[0]
+	response := &Message{Header: Header{ID: m.ID, Response: true, RecursionDesired: true, RecursionAvailable: true}, Questions: m.Questions}
+	switch {
+	case q.Name == "www.example.com" && q.Type == TYPE_A:
+		response.Answers = []Record{
+			{Name: q.Name, Type: TYPE_CNAME, Class: CLASS_INET, TTL: z.ttl + 100, Data: []byte{0}},
+			{Name: "example.com", Type: TYPE_A, Class: CLASS_INET, TTL: z.ttl, Data: []byte{192, 0, 2, 1}},
+		}
+	case q.Name == "www.example.com" && q.Type == TYPE_AAAA:
+		response.Answers = []Record{{Name: q.Name, Type: TYPE_AAAA, Class: CLASS_INET, TTL: z.ttl, Data: net.ParseIP("2001:db8::1")}}
+	case q.Name == "v4only.example.com" && q.Type == TYPE_A:
+		response.Answers = []Record{{Name: q.Name, Type: TYPE_A, Class: CLASS_INET, TTL: z.ttl, Data: []byte{192, 0, 2, 2}}}
+	case q.Name == "v4only.example.com":
+		response.Authorities = []Record{{Name: "example.com", Type: TYPE_SOA, Class: CLASS_INET, TTL: 60}}
+	default:
+		response.RCode = RCODE_NAME_ERROR
+	}
+	b, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// serveUDP answers queries on a local UDP port
+func serveUDP(t *testing.T, address string, answer func([]byte) []byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := answer(buf[:n]); response != nil {
+				_, _ = conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serveStream answers length-prefixed queries on listener
+func serveStream(t *testing.T, listener net.Listener, answer func([]byte) []byte) string {
+	t.Helper()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				response := answer(query)
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func listenTCP(t *testing.T, address string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	return listener
+}
+
+func TestResolver_Servers(t *testing.T) {
+	zone := &testZone{ttl: 300}
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(zone.answer(query))
+	}))
+	defer doh.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	dot := serveStream(t, tls.NewListener(listenTCP(t, "127.0.0.1:0"), &tls.Config{Certificates: doh.TLS.Certificates}), zone.answer)
+
+	for _, server := range []string{
+		serveUDP(t, "127.0.0.1:0", zone.answer),
+		"udp://" + serveUDP(t, "127.0.0.1:0", zone.answer),
+		"tcp://" + serveStream(t, listenTCP(t, "127.0.0.1:0"), zone.answer),
+		"tls://" + dot,
+		doh.URL + "/dns-query",
+	} {
+		t.Run(server, func(t *testing.T) {
+			r, err := New(Options{Servers: []string{server}, Timeout: 5 * time.Second})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			switch u := r.upstreams[0].(type) {
+			case *streamUpstream:
+				if u.tls != nil {
+					u.tls.RootCAs = roots
+				}
+			case *httpsUpstream:
+				u.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+			}
+
+			ips, err := r.LookupIP(context.Background(), "WWW.example.com.")
+			if err != nil {
+				t.Fatalf("LookupIP failed: %v", err)
+			}
+			if len(ips) != 2 || ips[0].String() != "192.0.2.1" || ips[1].String() != "2001:db8::1" {
+				t.Errorf("Expected the IPv4 and then the IPv6 address, got %v", ips)
+			}
+		})
+	}
+}
+
+func TestResolver_Cache(t *testing.T) {
+	zone := &testZone{ttl: 1}
+	r, err := New(Options{Servers: []string{serveUDP(t, "127.0.0.1:0", zone.answer)}, Timeout: 5 * time.Second, CacheSize: 16})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(context.Background(), "www.example.com"); err != nil {
+			t.Fatalf("LookupIP failed: %v", err)
+		}
+	}
+	if n := zone.queries.Load(); n != 2 {
+		t.Errorf("Expected the second lookup from the cache, got %d queries", n)
+	}
+
+	// The CNAME has a longer TTL, the address expires first
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := r.LookupIP(context.Background(), "www.example.com"); err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	if n := zone.queries.Load(); n != 4 {
+		t.Errorf("Expected expired answers to be queried again, got %d queries", n)
+	}
+
+	// Missing names and types are cached too
+	zone.queries.Store(0)
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIP(context.Background(), "missing.example.com")
+		if !isNotFound(err) {
+			t.Fatalf("Expected not found, got %v", err)
+		}
+		ips, err := r.LookupIP(context.Background(), "v4only.example.com")
+		if err != nil || len(ips) != 1 {
+			t.Fatalf("Expected one address, got %v %v", ips, err)
+		}
+	}
+	if n := zone.queries.Load(); n != 4 {
+		t.Errorf("Expected negative answers from the cache, got %d queries", n)
+	}
+}
+
+func TestResolver_Failover(t *testing.T) {
+	zone := &testZone{ttl: 300}
+	failing := serveUDP(t, "127.0.0.1:0", func(query []byte) []byte {
+		m, _ := Unpack(query)
+		b, _ := (&Message{Header: Header{ID: m.ID, Response: true, RCode: RCODE_SERVER_FAILURE}}).Pack()
+		return b
+	})
+	r, err := New(Options{Servers: []string{failing, serveUDP(t, "127.0.0.1:0", zone.answer)}, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ips, err := r.LookupIP(context.Background(), "v4only.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.2" {
+		t.Errorf("Expected the answer of the second server, got %v %v", ips, err)
+	}
+}
+
+func TestResolver_Truncated(t *testing.T) {
+	zone := &testZone{ttl: 300}
+	listener := listenTCP(t, "127.0.0.1:0")
+	address := serveStream(t, listener, zone.answer)
+	serveUDP(t, address, func(query []byte) []byte {
+		m, _ := Unpack(query)
+		b, _ := (&Message{Header: Header{ID: m.ID, Response: true, Truncated: true}, Questions: m.Questions}).Pack()
+		return b
+	})
+	r, err := New(Options{Servers: []string{address}, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ips, err := r.LookupIP(context.Background(), "v4only.example.com")
+	if err != nil || len(ips) != 1 {
+		t.Errorf("Expected the answer over TCP, got %v %v", ips, err)
+	}
+}
+
+func TestResolver_Hosts(t *testing.T) {
+	zone := &testZone{ttl: 300}
+	r, err := New(Options{
+		Servers: []string{serveUDP(t, "127.0.0.1:0", zone.answer)},
+		Hosts:   map[string][]string{"Intranet.example.com": {"10.0.0.5"}},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ips, err := r.LookupIP(context.Background(), "intranet.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.0.0.5" {
+		t.Errorf("Expected the static address, got %v %v", ips, err)
+	}
+	if zone.queries.Load() != 0 {
+		t.Error("Expected no query for a static host")
+	}
+
+	if _, err := New(Options{Hosts: map[string][]string{"bad.example.com": {"not-an-ip"}}}); err == nil {
+		t.Error("Expected an error for an invalid static address")
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"1.1.1.1", "udp://1.1.1.1:53"},
+		{"2606:4700::1111", "udp://[2606:4700::1111]:53"},
+		{"udp://192.0.2.53:5353", "udp://192.0.2.53:5353"},
+		{"tcp://192.0.2.53", "tcp://192.0.2.53:53"},
+		{"tls://dns.example.net", "tls://dns.example.net:853"},
+		{"https://dns.example.net/dns-query", "https://dns.example.net/dns-query"},
+		{"quic://192.0.2.53", ""},
+		{"https://", ""},
+	}
+	for _, tt := range tests {
+		upstream, err := ParseUpstream(tt.address, nil)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.address, err)
+			continue
+		}
+		if upstream.String() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.address, tt.expected, upstream)
+		}
+	}
+}
+
+func TestResolver_Exchange(t *testing.T) {
+	zone := &testZone{ttl: 300}
+	r, err := New(Options{
+		Servers: []string{serveUDP(t, "127.0.0.1:0", zone.answer)},
+		Hosts:   map[string][]string{"nas.example.com": {"10.0.0.5"}},
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	exchange := func(r *Resolver, name string, qtype uint16) (*Message, error) {
+		query, err := NewQuery(42, name, qtype).Pack()
+		if err != nil {
+			t.Fatalf("Pack failed: %v", err)
+		}
+		response, err := r.Exchange(context.Background(), query)
+		if err != nil {
+			return nil, err
+		}
+		return Unpack(response)
+	}
+
+	// Queries go to the servers as they are
+	m, err := exchange(r, "www.example.com", TYPE_A)
+	if err != nil || m.ID != 42 || len(m.Answers) != 2 || m.Answers[0].Type != TYPE_CNAME {
+		t.Errorf("Expected the server's answer with the CNAME, got %+v %v", m, err)
+	}
+	if m, err := exchange(r, "missing.example.com", TYPE_A); err != nil || m.RCode != RCODE_NAME_ERROR {
+		t.Errorf("Expected NXDOMAIN, got %+v %v", m, err)
+	}
+
+	// Static hosts are answered locally
+	zone.queries.Store(0)
+	m, err = exchange(r, "nas.example.com", TYPE_A)
+	if err != nil || len(m.Answers) != 1 || net.IP(m.Answers[0].Data).String() != "10.0.0.5" || m.Answers[0].TTL != LOCAL_TTL {
+		t.Errorf("Expected the static address, got %+v %v", m, err)
+	}
+	if m, err := exchange(r, "nas.example.com", TYPE_AAAA); err != nil || len(m.Answers) != 0 {
+		t.Errorf("Expected no IPv6 address, got %+v %v", m, err)
+	}
+	if zone.queries.Load() != 0 {
+		t.Error("Expected no query for a static host")
+	}
+
+	// Without servers only addresses can be answered
+	local, err := New(Options{Hosts: map[string][]string{"nas.example.com": {"10.0.0.5"}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if m, err := exchange(local, "nas.example.com", TYPE_A); err != nil || len(m.Answers) != 1 {
+		t.Errorf("Expected the static address, got %+v %v", m, err)
+	}
+	if _, err := exchange(local, "example.com", 15); err == nil {
+		t.Error("Expected an error for an MX query without servers")
+	}
+}
@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DialFunc opens the connections to the DNS servers
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Upstream sends queries to a DNS server
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// ParseUpstream returns the upstream for a server address: an IP or
+// host:port for UDP, with the udp://, tcp:// or tls:// (DoT) scheme, or an
+// https:// URL (DoH). Host names of servers are resolved by dial.
+func ParseUpstream(address string, dial DialFunc) (Upstream, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if strings.HasPrefix(address, "https://") {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS server: %q", address)
+		}
+		transport := &http.Transport{DialContext: dial, ForceAttemptHTTP2: true}
+		return &httpsUpstream{url: address, client: &http.Client{Transport: transport}}, nil
+	}
+
+	scheme, hostport, found := strings.Cut(address, "://")
+	if !found {
+		scheme, hostport = "udp", address
+	}
+	port := "53"
+	if scheme == "tls" {
+		port = "853"
+	}
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// No port, an IPv6 address may come without brackets
+		host, p = strings.Trim(hostport, "[]"), port
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid DNS server: %q", address)
+	}
+	hostport = net.JoinHostPort(host, p)
+
+	switch scheme {
+	case "udp":
+		return &udpUpstream{address: hostport, dial: dial}, nil
+	case "tcp":
+		return &streamUpstream{address: hostport, dial: dial}, nil
+	case "tls":
+		return &streamUpstream{address: hostport, dial: dial, tls: &tls.Config{ServerName: host}}, nil
+	default:
+		return nil, fmt.Errorf("invalid DNS server scheme: %q", address)
+	}
+}
+
+// udpUpstream queries a server over UDP and again over TCP if the answer
+// was truncated
+type udpUpstream struct {
+	address string
+	dial    DialFunc
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.address
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dial(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	// Datagrams with another ID are stale or spoofed answers
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < headerSize || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// Truncated, retry over TCP
+			return (&streamUpstream{address: u.address, dial: u.dial}).Exchange(ctx, query)
+		}
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
+
+// streamUpstream queries a server over TCP or, with tls set, over TLS.
+// Every query uses a new connection.
+type streamUpstream struct {
+	address string
+	dial    DialFunc
+	tls     *tls.Config
+}
+
+func (s *streamUpstream) String() string {
+	if s.tls != nil {
+		return "tls://" + s.address
+	}
+	return "tcp://" + s.address
+}
+
+func (s *streamUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := s.dial(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if s.tls != nil {
+		tlsConn := tls.Client(conn, s.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// Messages are prefixed with their length
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// httpsUpstream queries a server with DNS over HTTPS (RFC 8484)
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpsUpstream) String() string {
+	return h.url
+}
+
+func (h *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server %s answered %s", h.url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_MESSAGE_SIZE))
+}
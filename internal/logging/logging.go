@@ -0,0 +1,132 @@
+// Package logging configures the diagnostic logs, written with log/slog, from
+// the logging section of the configuration.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"tproxy/internal/config"
+)
+
+var (
+	mu     sync.Mutex // guards output
+	output io.Closer  // file or syslog connection of the current handler, nil for standard streams
+)
+
+// ParseLevel converts a configured level name to a slog level
+func ParseLevel(level string) (slog.Level, error) {
+	switch level {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level: %q", level)
+	}
+}
+
+// NewHandler returns a handler writing records of at least the configured
+// level to w in the configured format
+func NewHandler(w io.Writer, cfg config.LoggingConfig) (slog.Handler, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	return newHandler(w, cfg.Format, &slog.HandlerOptions{Level: level})
+}
+
+func newHandler(w io.Writer, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %q", format)
+	}
+}
+
+// Setup replaces the default logger according to the configuration. Output
+// written with the log package goes to the same handler. It can be called
+// again on reload, the previous log file or syslog connection is closed.
+func Setup(cfg config.LoggingConfig) error {
+	o, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	o.Use()
+	return nil
+}
+
+// Output is a diagnostic log opened by Open and not yet in use
+type Output struct {
+	handler slog.Handler
+	closer  io.Closer // nil for stderr and stdout
+}
+
+// Open opens the diagnostic log of cfg without using it, so that it can be
+// set up together with other settings that may fail
+func Open(cfg config.LoggingConfig) (*Output, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	var closer io.Closer
+	switch cfg.Output {
+	case "", "stderr":
+		handler, err = newHandler(os.Stderr, cfg.Format, opts)
+	case "stdout":
+		handler, err = newHandler(os.Stdout, cfg.Format, opts)
+	case "syslog":
+		handler, closer, err = newSyslogHandler(cfg.Format, opts)
+	default:
+		var file *os.File
+		if file, err = os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		if handler, err = newHandler(file, cfg.Format, opts); err != nil {
+			_ = file.Close()
+		}
+		closer = file
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Output{handler: handler, closer: closer}, nil
+}
+
+// Close closes an output that was not put in use
+func (o *Output) Close() error {
+	if o.closer == nil {
+		return nil
+	}
+	return o.closer.Close()
+}
+
+// Use makes o the default logger and closes the previous output
+func (o *Output) Use() {
+	// slog.SetDefault also routes the log package, which writes at info level
+	slog.SetDefault(slog.New(o.handler))
+
+	mu.Lock()
+	previous := output
+	output = o.closer
+	mu.Unlock()
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			// The new handler is already in use, nothing else to do
+			_ = err // explicitly ignore the error
+		}
+	}
+}
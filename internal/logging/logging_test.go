@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tproxy/internal/config"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected slog.Level
+		wantErr  bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"info", slog.LevelInfo, false},
+		{"warn", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+		{"INFO", 0, true},
+	}
+
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.level)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) error = %v, wantErr %v", tt.level, err, tt.wantErr)
+			continue
+		}
+		if level != tt.expected {
+			t.Errorf("ParseLevel(%q) = %v, expected %v", tt.level, level, tt.expected)
+		}
+	}
+}
+
+func TestNewHandler_LevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewHandler(&buf, config.LoggingConfig{Level: "warn", Format: "json"})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	logger := slog.New(handler)
+
+	logger.Info("Not written")
+	logger.Warn("Connection failed", "client", "192.168.1.2:40000")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %d: %q", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", lines[0], err)
+	}
+	if record["msg"] != "Connection failed" || record["level"] != "WARN" || record["client"] != "192.168.1.2:40000" {
+		t.Errorf("Unexpected record: %v", record)
+	}
+
+	if _, err := NewHandler(&buf, config.LoggingConfig{Format: "xml"}); err == nil {
+		t.Error("Expected an error for an invalid format")
+	}
+}
+
+func TestSetup_File(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	path := filepath.Join(t.TempDir(), "tproxy.log")
+	if err := Setup(config.LoggingConfig{Level: "debug", Format: "text", Output: path}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	slog.Debug("Rule matches", "rule", 1)
+
+	// Switching back to stderr closes the file
+	if err := Setup(config.LoggingConfig{Output: "stderr"}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if output != nil {
+		t.Error("Expected no output to close for stderr")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if !strings.Contains(string(data), "level=DEBUG") || !strings.Contains(string(data), `msg="Rule matches" rule=1`) {
+		t.Errorf("Unexpected log file content: %q", data)
+	}
+}
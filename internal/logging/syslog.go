@@ -0,0 +1,81 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogHandler formats records with a text or JSON handler and sends them
+// to the local syslog daemon with the matching priority
+type syslogHandler struct {
+	w     *syslog.Writer
+	mu    *sync.Mutex   // guards buf, shared with derived handlers
+	buf   *bytes.Buffer // output of inner
+	inner slog.Handler
+}
+
+func newSyslogHandler(format string, opts *slog.HandlerOptions) (slog.Handler, io.Closer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "tproxy")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// syslog adds its own timestamp
+	opts = &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	buf := &bytes.Buffer{}
+	inner, err := newHandler(buf, format, opts)
+	if err != nil {
+		_ = w.Close()
+		return nil, nil, err
+	}
+	return &syslogHandler{w: w, mu: &sync.Mutex{}, buf: buf, inner: inner}, w, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.buf.String(), "\n")
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{w: h.w, mu: h.mu, buf: h.buf, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{w: h.w, mu: h.mu, buf: h.buf, inner: h.inner.WithGroup(name)}
+}
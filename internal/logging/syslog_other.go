@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// newSyslogHandler is not supported on this platform
+func newSyslogHandler(format string, opts *slog.HandlerOptions) (slog.Handler, io.Closer, error) {
+	return nil, nil, fmt.Errorf("syslog is not supported on this platform")
+}
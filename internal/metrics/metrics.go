@@ -0,0 +1,39 @@
+package metrics
+
+// Default holds the tproxy metrics served on the metrics endpoint
+var Default = NewRegistry()
+
+var (
+	AcceptedConnections = Default.NewCounterVec("tproxy_accepted_connections_total",
+		"Connections accepted per listener (QUIC counts new sessions).", "listener")
+	AcceptErrors = Default.NewCounterVec("tproxy_accept_errors_total",
+		"Errors accepting connections per listener.", "listener")
+	ActiveConnections = Default.NewGauge("tproxy_active_connections",
+		"Connections accepted on the TCP listeners and not yet closed.")
+	ActiveTunnels = Default.NewGauge("tproxy_active_tunnels",
+		"Connections currently relayed to a remote server.")
+	Bytes = Default.NewCounterVec("tproxy_bytes_total",
+		"Bytes relayed; direction in is from clients, out is to clients.", "direction", "action", "upstream")
+	ClientConnectionsLimited = Default.NewCounterVec("tproxy_client_connections_limited_total",
+		"Connections over advanced.max_client_connections by result (rejected or queued).", "result")
+	ClientRateLimited = Default.NewCounterVec("tproxy_client_rate_limited_total",
+		"Connections over advanced.client_rate by result (rejected or queued).", "result")
+	DialDuration = Default.NewHistogramVec("tproxy_dial_duration_seconds",
+		"Time to connect to the remote server, including the upstream CONNECT.", DefaultBuckets, "action", "upstream")
+	DNSLookups = Default.NewCounterVec("tproxy_dns_lookups_total",
+		"Host name lookups per resolver by result (hosts, cache, ok, not_found or error).", "resolver", "result")
+	FakeIPQueries = Default.NewCounterVec("tproxy_fake_ip_queries_total",
+		"Queries to the fake IP DNS server by answer (fake, forward, error or dropped).", "answer")
+	MaxConnectionsLimited = Default.NewCounterVec("tproxy_max_connections_limited_total",
+		"Connections over advanced.max_connections by result (rejected or queued).", "result")
+	QuotaExceeded = Default.NewCounterVec("tproxy_quota_exceeded_total",
+		"Connections of clients over their quota per quota group.", "group")
+	RuleHits = Default.NewCounterVec("tproxy_rule_hits_total",
+		"Connections matched per rule (1-based index, 0 when no rule matched).", "rule", "action")
+	SNIMismatches = Default.NewCounterVec("tproxy_sni_mismatches_total",
+		"TLS connections whose SNI does not resolve to the original destination by verify_sni policy.", "policy")
+	SNIParseFailures = Default.NewCounterVec("tproxy_sni_parse_failures_total",
+		"Connections without a server name in the ClientHello.", "protocol")
+	UpstreamConnectFailures = Default.NewCounterVec("tproxy_upstream_connect_failures_total",
+		"Failed CONNECT requests per upstream by status code (error for network failures).", "upstream", "status")
+)
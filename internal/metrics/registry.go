@@ -0,0 +1,325 @@
+// Package metrics implements the subset of the Prometheus text exposition
+// format used by tproxy: counters, gauges and histograms with labels.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// sampleWriter writes the samples of one metric. labels holds the formatted
+// label pairs of the series, e.g. `listener="https"`, or is empty.
+type sampleWriter interface {
+	writeSamples(w io.Writer, name, labels string) error
+}
+
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all metrics in registration order
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics for Prometheus scrapes
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			// The client went away, nothing left to report
+			_ = err // explicitly ignore the error
+		}
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increases the counter by n. It satisfies proxy.ByteCounter.
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) writeSamples(w io.Writer, name, labels string) error {
+	_, err := fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), c.Value())
+	return err
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+func (g *Gauge) writeSamples(w io.Writer, name, labels string) error {
+	_, err := fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), g.Value())
+	return err
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	buckets []float64 // upper bounds, sorted
+
+	mu     sync.Mutex // guards the fields below
+	counts []uint64   // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) error {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := math.Inf(1)
+		if i < len(h.buckets) {
+			le = h.buckets[i]
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatFloat(le), cumulative); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(sum)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), count)
+	return err
+}
+
+// DefaultBuckets suit latencies in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// single is a metric without labels
+type single struct {
+	name, help, typ string
+	metric          sampleWriter
+}
+
+func (s *single) write(w io.Writer) error {
+	if err := writeHeader(w, s.name, s.help, s.typ); err != nil {
+		return err
+	}
+	return s.metric.writeSamples(w, s.name, "")
+}
+
+// vec is a family of metrics partitioned by label values
+type vec[T sampleWriter] struct {
+	name, help, typ string
+	labels          []string
+	newMetric       func() T
+
+	mu       sync.Mutex
+	children map[string]T
+}
+
+func newVec[T sampleWriter](name, help, typ string, labels []string, newMetric func() T) *vec[T] {
+	return &vec[T]{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		newMetric: newMetric,
+		children:  make(map[string]T),
+	}
+}
+
+// with returns the metric for the label values, creating it on first use
+func (v *vec[T]) with(values []string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	var b strings.Builder
+	for i, value := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(v.labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(value))
+		b.WriteByte('"')
+	}
+	key := b.String()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.children[key]
+	if !ok {
+		m = v.newMetric()
+		v.children[key] = m
+	}
+	return m
+}
+
+func (v *vec[T]) write(w io.Writer) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make(map[string]T, len(v.children))
+	for key, m := range v.children {
+		children[key] = m
+	}
+	v.mu.Unlock()
+	sort.Strings(keys)
+
+	if err := writeHeader(w, v.name, v.help, v.typ); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := children[key].writeSamples(w, v.name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	vec *vec[*Counter]
+}
+
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.vec.with(values)
+}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	vec *vec[*Histogram]
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.vec.with(values)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&single{name: name, help: help, typ: "counter", metric: c})
+	return c
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&single{name: name, help: help, typ: "gauge", metric: g})
+	return g
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })
+	r.register(v)
+	return &CounterVec{vec: v}
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := newVec(name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })
+	r.register(v)
+	return &HistogramVec{vec: v}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) error {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return err
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
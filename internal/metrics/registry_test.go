@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	accepted := r.NewCounterVec("test_accepted_total", "Accepted connections.", "listener")
+	active := r.NewGauge("test_active", "Active tunnels.")
+	plain := r.NewCounter("test_failures_total", "Failures.")
+
+	accepted.WithLabelValues("https").Add(3)
+	accepted.WithLabelValues("http").Inc()
+	accepted.WithLabelValues("https").Inc()
+	active.Inc()
+	active.Inc()
+	active.Dec()
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	expected := `# HELP test_accepted_total Accepted connections.
+# TYPE test_accepted_total counter
+test_accepted_total{listener="http"} 1
+test_accepted_total{listener="https"} 4
+# HELP test_active Active tunnels.
+# TYPE test_active gauge
+test_active 1
+# HELP test_failures_total Failures.
+# TYPE test_failures_total counter
+test_failures_total 0
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+	if plain.Value() != 0 {
+		t.Errorf("Expected untouched counter to be 0, got %d", plain.Value())
+	}
+}
+
+func TestHistogram_Buckets(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("test_dial_seconds", "Dial latency.", []float64{0.1, 1}, "action")
+
+	h.WithLabelValues("direct").Observe(0.05)
+	h.WithLabelValues("direct").Observe(0.1) // Upper bounds are inclusive
+	h.WithLabelValues("direct").Observe(0.5)
+	h.WithLabelValues("direct").Observe(3)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	for _, line := range []string{
+		`test_dial_seconds_bucket{action="direct",le="0.1"} 2`,
+		`test_dial_seconds_bucket{action="direct",le="1"} 3`,
+		`test_dial_seconds_bucket{action="direct",le="+Inf"} 4`,
+		`test_dial_seconds_sum{action="direct"} 3.65`,
+		`test_dial_seconds_count{action="direct"} 4`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected line %q in output:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestCounterVec_LabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	hits := r.NewCounterVec("test_hits_total", "Hits.", "pattern")
+	hits.WithLabelValues(`.*\.example\.com "quoted"`).Inc()
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	if line := `test_hits_total{pattern=".*\\.example\\.com \"quoted\""} 1`; !strings.Contains(buf.String(), line) {
+		t.Errorf("Expected escaped line %q in output:\n%s", line, buf.String())
+	}
+}
+
+func TestCounterVec_WrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a wrong number of label values")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "a", "b").WithLabelValues("only-one")
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "test_total 1\n") {
+		t.Errorf("Unexpected body:\n%s", rec.Body.String())
+	}
+}
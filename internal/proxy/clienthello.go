@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Extension types used by ParseClientHello
+const (
+	extensionTypeSupportedGroups   = 0x000a
+	extensionTypeECPointFormats    = 0x000b
+	extensionTypeSignatureAlgs     = 0x000d
+	extensionTypeALPN              = 0x0010
+	extensionTypeSessionTicket     = 0x0023
+	extensionTypePreSharedKey      = 0x0029
+	extensionTypeSupportedVersions = 0x002b
+	extensionTypeKeyShare          = 0x0033
+	extensionTypeECH               = 0xfe0d
+)
+
+var (
+	// ErrNotClientHello is returned when the data does not start a TLS
+	// handshake with a ClientHello message.
+	ErrNotClientHello = errors.New("not a TLS ClientHello")
+
+	// ErrTruncatedClientHello is returned when the ClientHello ends before
+	// one of its fields is complete.
+	ErrTruncatedClientHello = errors.New("truncated TLS ClientHello")
+)
+
+// ClientHello holds the fields of a TLS ClientHello that are useful for
+// routing, logging and metrics.
+type ClientHello struct {
+	Version           uint16   // legacy_version of the handshake
+	ServerName        string   // host_name from the server_name extension
+	ALPNProtocols     []string // in the client's order of preference
+	SupportedVersions []uint16 // from the supported_versions extension
+	CipherSuites      []uint16 // in the order sent by the client
+	Extensions        []uint16 // extension types in the order sent by the client
+	KeyShareGroups    []uint16 // groups the client sent key shares for
+	HasECH            bool     // encrypted_client_hello extension present
+	OuterServerName   string   // with ECH, the public name the outer ClientHello is sent to
+	QUIC              bool     // carried in QUIC Initial packets rather than TLS records
+	SessionResumption bool     // pre_shared_key or a non-empty session ticket offered
+
+	// Fields used for JA3/JA4 fingerprinting
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+}
+
+// ParseClientHello parses the TLS ClientHello at the start of data, which
+// includes the record layer and may be split across several records. If the
+// ClientHello is truncated, the fields parsed so far are returned together
+// with ErrTruncatedClientHello.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	startPos := findTLSHandshake(data)
+	if startPos == -1 {
+		return nil, ErrNotClientHello
+	}
+
+	data = coalesceRecords(data[startPos:])
+	if len(data) < recordHeaderSize {
+		return nil, ErrTruncatedClientHello
+	}
+	recordLength := int(data[3])<<8 | int(data[4])
+	if recordHeaderSize+recordLength < len(data) {
+		data = data[:recordHeaderSize+recordLength]
+	}
+
+	return parseClientHelloMessage(data[recordHeaderSize:])
+}
+
+// OffersALPN reports whether the client offered the given ALPN protocol.
+func (h *ClientHello) OffersALPN(protocol string) bool {
+	for _, p := range h.ALPNProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxVersion returns the highest TLS version offered by the client, taking
+// the supported_versions extension into account. GREASE values are ignored.
+func (h *ClientHello) MaxVersion() uint16 {
+	if len(h.SupportedVersions) == 0 {
+		return h.Version
+	}
+	var max uint16
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// TLSVersionName returns a human readable name for a TLS protocol version.
+func TLSVersionName(version uint16) string {
+	switch version {
+	case 0x0300:
+		return "SSL3.0"
+	case tlsVersion10:
+		return "TLS1.0"
+	case tlsVersion11:
+		return "TLS1.1"
+	case tlsVersion12:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701)
+// that clients sprinkle into cipher suite, extension and group lists.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// parseClientHelloMessage parses a ClientHello handshake message, starting at
+// the handshake type byte. If the message is truncated, the fields parsed so
+// far are returned together with ErrTruncatedClientHello.
+func parseClientHelloMessage(msg []byte) (*ClientHello, error) {
+	if len(msg) < handshakeHeaderSize || msg[0] != handshakeTypeClientHello {
+		return nil, ErrNotClientHello
+	}
+	length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	truncated := false
+	if len(msg) < handshakeHeaderSize+length {
+		// Parse what is available, the SNI is usually near the start
+		length = len(msg) - handshakeHeaderSize
+		truncated = true
+	}
+	r := helloReader{data: msg[handshakeHeaderSize : handshakeHeaderSize+length]}
+
+	hello := &ClientHello{}
+	hello.Version = r.uint16()
+	r.skip(randomSize)
+	r.skip(int(r.uint8())) // session_id
+
+	cipherSuites := r.vector(2)
+	for cipherSuites.remaining() >= 2 {
+		hello.CipherSuites = append(hello.CipherSuites, cipherSuites.uint16())
+	}
+
+	r.skip(int(r.uint8())) // compression_methods
+	if r.err != nil {
+		return hello, r.err
+	}
+
+	if r.remaining() > 0 {
+		var extensions helloReader
+		if truncated {
+			// Walk the extensions that made it into the truncated message
+			r.skip(2)
+			extensions = helloReader{data: r.data, err: r.err}
+		} else {
+			extensions = r.vector(2)
+		}
+		for extensions.remaining() > 0 && extensions.err == nil {
+			extType := extensions.uint16()
+			body := extensions.vector(2)
+			if extensions.err != nil {
+				break
+			}
+			hello.Extensions = append(hello.Extensions, extType)
+			hello.parseExtension(extType, body)
+		}
+		if extensions.err != nil {
+			return hello, extensions.err
+		}
+	}
+
+	if hello.HasECH {
+		// With ECH the server_name extension carries the client-facing
+		// server's public name, the real name is encrypted
+		hello.OuterServerName = hello.ServerName
+	}
+
+	if truncated {
+		return hello, ErrTruncatedClientHello
+	}
+	return hello, nil
+}
+
+// parseExtension fills in the ClientHello fields carried by one extension.
+// Malformed extension bodies are ignored so one odd extension does not hide
+// the rest of the handshake.
+func (h *ClientHello) parseExtension(extType uint16, body helloReader) {
+	switch extType {
+	case extensionTypeSNI:
+		list := body.vector(2)
+		for list.remaining() > 0 && list.err == nil {
+			nameType := list.uint8()
+			name := list.vector(2)
+			if list.err == nil && nameType == nameTypeHost && h.ServerName == "" {
+				h.ServerName = string(name.data)
+			}
+		}
+	case extensionTypeSupportedGroups:
+		list := body.vector(2)
+		for list.remaining() >= 2 {
+			h.SupportedGroups = append(h.SupportedGroups, list.uint16())
+		}
+	case extensionTypeECPointFormats:
+		list := body.vector(1)
+		for list.remaining() > 0 {
+			h.ECPointFormats = append(h.ECPointFormats, list.uint8())
+		}
+	case extensionTypeSignatureAlgs:
+		list := body.vector(2)
+		for list.remaining() >= 2 {
+			h.SignatureAlgorithms = append(h.SignatureAlgorithms, list.uint16())
+		}
+	case extensionTypeALPN:
+		list := body.vector(2)
+		for list.remaining() > 0 && list.err == nil {
+			protocol := list.vector(1)
+			if list.err == nil {
+				h.ALPNProtocols = append(h.ALPNProtocols, string(protocol.data))
+			}
+		}
+	case extensionTypeSupportedVersions:
+		list := body.vector(1)
+		for list.remaining() >= 2 {
+			h.SupportedVersions = append(h.SupportedVersions, list.uint16())
+		}
+	case extensionTypeKeyShare:
+		list := body.vector(2)
+		for list.remaining() > 0 && list.err == nil {
+			group := list.uint16()
+			list.vector(2) // key_exchange
+			if list.err == nil {
+				h.KeyShareGroups = append(h.KeyShareGroups, group)
+			}
+		}
+	case extensionTypeECH:
+		h.HasECH = true
+	case extensionTypePreSharedKey:
+		h.SessionResumption = true
+	case extensionTypeSessionTicket:
+		if body.remaining() > 0 {
+			h.SessionResumption = true
+		}
+	}
+}
+
+// helloReader is a bounds-checked cursor over ClientHello bytes. After the
+// first out-of-bounds read every further read returns zero values and err is
+// set to ErrTruncatedClientHello.
+type helloReader struct {
+	data []byte
+	err  error
+}
+
+func (r *helloReader) remaining() int {
+	return len(r.data)
+}
+
+func (r *helloReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = ErrTruncatedClientHello
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *helloReader) skip(n int) {
+	r.take(n)
+}
+
+// takeVarint is take for a length read as a QUIC varint, which may not fit
+// in an int on 32-bit platforms
+func (r *helloReader) takeVarint(n uint64) []byte {
+	if n > uint64(len(r.data)) {
+		return r.take(-1)
+	}
+	return r.take(int(n))
+}
+
+func (r *helloReader) uint8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// vector reads a length-prefixed field with a lengthBytes-long prefix and
+// returns a reader over its contents
+func (r *helloReader) vector(lengthBytes int) helloReader {
+	var length int
+	for _, b := range r.take(lengthBytes) {
+		length = length<<8 | int(b)
+	}
+	body := r.take(length)
+	if r.err != nil {
+		return helloReader{err: r.err}
+	}
+	return helloReader{data: body}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// alpnExtension encodes an application_layer_protocol_negotiation extension
+func alpnExtension(protocols ...string) []byte {
+	var list []byte
+	for _, p := range protocols {
+		list = append(list, byte(len(p)))
+		list = append(list, p...)
+	}
+	return extension(extensionTypeALPN, append([]byte{byte(len(list) >> 8), byte(len(list))}, list...))
+}
+
+// supportedVersionsExtension encodes a supported_versions extension
+func supportedVersionsExtension(versions ...uint16) []byte {
+	body := []byte{byte(len(versions) * 2)}
+	for _, v := range versions {
+		body = append(body, byte(v>>8), byte(v))
+	}
+	return extension(extensionTypeSupportedVersions, body)
+}
+
+// keyShareExtension encodes a key_share extension with dummy key material of
+// the given size for each group
+func keyShareExtension(keySize int, groups ...uint16) []byte {
+	var list []byte
+	for _, g := range groups {
+		list = append(list, byte(g>>8), byte(g), byte(keySize>>8), byte(keySize))
+		list = append(list, make([]byte, keySize)...)
+	}
+	return extension(extensionTypeKeyShare, append([]byte{byte(len(list) >> 8), byte(len(list))}, list...))
+}
+
+func TestParseClientHello_Fields(t *testing.T) {
+	msg := buildClientHelloMessage(
+		sniExtension("www.example.com"),
+		alpnExtension("h2", "http/1.1"),
+		supportedVersionsExtension(0x7a7a, 0x0304, 0x0303),
+		keyShareExtension(1216, 0x11ec),
+		extension(extensionTypePreSharedKey, []byte{0x00, 0x00}),
+	)
+	// Split the handshake so the key share spans two records
+	hello, err := ParseClientHello(splitIntoRecords(msg, 600))
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+
+	if hello.ServerName != "www.example.com" {
+		t.Errorf("Expected server name www.example.com, got %q", hello.ServerName)
+	}
+	if !reflect.DeepEqual(hello.ALPNProtocols, []string{"h2", "http/1.1"}) {
+		t.Errorf("Unexpected ALPN protocols %v", hello.ALPNProtocols)
+	}
+	if !hello.OffersALPN("h2") || hello.OffersALPN("h3") {
+		t.Error("OffersALPN does not match the offered protocols")
+	}
+	if !reflect.DeepEqual(hello.SupportedVersions, []uint16{0x7a7a, 0x0304, 0x0303}) {
+		t.Errorf("Unexpected supported versions %v", hello.SupportedVersions)
+	}
+	if hello.MaxVersion() != 0x0304 {
+		t.Errorf("Expected max version TLS1.3, got %s", TLSVersionName(hello.MaxVersion()))
+	}
+	if !reflect.DeepEqual(hello.CipherSuites, []uint16{0x1301}) {
+		t.Errorf("Unexpected cipher suites %v", hello.CipherSuites)
+	}
+	if !reflect.DeepEqual(hello.KeyShareGroups, []uint16{0x11ec}) {
+		t.Errorf("Unexpected key share groups %v", hello.KeyShareGroups)
+	}
+	expectedExtensions := []uint16{extensionTypeSNI, extensionTypeALPN, extensionTypeSupportedVersions, extensionTypeKeyShare, extensionTypePreSharedKey}
+	if !reflect.DeepEqual(hello.Extensions, expectedExtensions) {
+		t.Errorf("Expected extensions %v, got %v", expectedExtensions, hello.Extensions)
+	}
+	if hello.HasECH {
+		t.Error("Expected no ECH")
+	}
+	if !hello.SessionResumption {
+		t.Error("Expected session resumption to be detected from pre_shared_key")
+	}
+}
+
+func TestParseClientHello_ECHAndTickets(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions [][]byte
+		ech        bool
+		resumption bool
+	}{
+		{"EmptyTicket", [][]byte{extension(extensionTypeSessionTicket, nil)}, false, false},
+		{"Ticket", [][]byte{extension(extensionTypeSessionTicket, []byte{1, 2, 3})}, false, true},
+		{"ECH", [][]byte{extension(extensionTypeECH, []byte{0x00, 0x01})}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := ParseClientHello(splitIntoRecords(buildClientHelloMessage(tt.extensions...), 16384))
+			if err != nil {
+				t.Fatalf("ParseClientHello failed: %v", err)
+			}
+			if hello.HasECH != tt.ech {
+				t.Errorf("Expected HasECH %t, got %t", tt.ech, hello.HasECH)
+			}
+			if hello.SessionResumption != tt.resumption {
+				t.Errorf("Expected SessionResumption %t, got %t", tt.resumption, hello.SessionResumption)
+			}
+		})
+	}
+}
+
+func TestParseClientHello_OuterServerName(t *testing.T) {
+	plain, err := ParseClientHello(splitIntoRecords(buildClientHelloMessage(sniExtension("www.example.com")), 16384))
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if plain.OuterServerName != "" {
+		t.Errorf("Expected no outer server name without ECH, got %q", plain.OuterServerName)
+	}
+
+	ech, err := ParseClientHello(splitIntoRecords(buildClientHelloMessage(
+		sniExtension("cloudflare-ech.com"),
+		extension(extensionTypeECH, []byte{0x00, 0x00, 0x01, 0x00, 0x01}),
+	), 16384))
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	if !ech.HasECH || ech.OuterServerName != "cloudflare-ech.com" {
+		t.Errorf("Expected ECH with outer name cloudflare-ech.com, got %t/%q", ech.HasECH, ech.OuterServerName)
+	}
+}
+
+func TestParseClientHello_HexDump(t *testing.T) {
+	packetData, err := loadHexDump("../../tests/sni_play.googleapis.com.hex")
+	if err != nil {
+		t.Skipf("Test file not found: %v", err)
+		return
+	}
+
+	// The capture holds only the first TCP segment of a larger ClientHello
+	hello, err := ParseClientHello(extractTLSPayload(packetData))
+	if !errors.Is(err, ErrTruncatedClientHello) {
+		t.Fatalf("Expected ErrTruncatedClientHello, got %v", err)
+	}
+	if hello.ServerName != "play.googleapis.com" {
+		t.Errorf("Expected server name play.googleapis.com, got %q", hello.ServerName)
+	}
+	if len(hello.CipherSuites) == 0 || len(hello.Extensions) == 0 {
+		t.Error("Expected cipher suites and extensions to be parsed")
+	}
+}
+
+func TestParseClientHello_Errors(t *testing.T) {
+	msg := buildClientHelloMessage(sniExtension("truncated.example.com"))
+	record := splitIntoRecords(msg, 16384)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"Empty", []byte{}, ErrNotClientHello},
+		{"HTTP", []byte("GET / HTTP/1.1\r\n\r\n"), ErrNotClientHello},
+		{"ServerHello", splitIntoRecords(append([]byte{0x02}, msg[1:]...), 16384), ErrNotClientHello},
+		{"Truncated", record[:len(record)-5], ErrTruncatedClientHello},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseClientHello(tt.data)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("Expected 0x%04x to be GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x1301, 0x0304} {
+		if isGREASE(v) {
+			t.Errorf("Expected 0x%04x not to be GREASE", v)
+		}
+	}
+}
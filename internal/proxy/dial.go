@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// HostResolver looks up the addresses of host names for outgoing
+// connections
+type HostResolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// DialOptions set up the sockets of outgoing connections
+type DialOptions struct {
+	Mark          uint32       // SO_MARK fwmark, 0 for none
+	Interface     string       // SO_BINDTODEVICE interface, empty for any
+	SourceAddress string       // local IP, empty for the routing default
+	Resolver      HostResolver // resolves host names, nil for the system resolver
+}
+
+// dialer returns a dialer for network ("tcp" or "udp") applying the socket
+// options
+func (o DialOptions) dialer(network string) (*net.Dialer, error) {
+	dialer := &net.Dialer{}
+	if o.SourceAddress != "" {
+		ip := net.ParseIP(o.SourceAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address: %q", o.SourceAddress)
+		}
+		switch network {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		default:
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if o.Mark != 0 || o.Interface != "" {
+		dialer.Control = o.control
+	}
+	return dialer, nil
+}
+
+// DialContext connects to address with the options. A host name is
+// resolved with Resolver and its addresses are tried in order.
+func (o DialOptions) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer, err := o.dialer(network)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if o.Resolver == nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	ips, err := o.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	lastErr := fmt.Errorf("no addresses for %s", host)
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dial opens a TCP connection to address within timeout seconds
+func (o DialOptions) dial(address string, timeout int) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	return o.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control sets SO_MARK and SO_BINDTODEVICE before the socket connects
+func (o DialOptions) control(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if o.Mark != 0 {
+			// The kernel reads a u32, marks from 2^31 are negative ints
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(int32(o.Mark))); err != nil {
+				sockErr = fmt.Errorf("SO_MARK: %w", err)
+				return
+			}
+		}
+		if o.Interface != "" {
+			if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.Interface); err != nil {
+				sockErr = fmt.Errorf("SO_BINDTODEVICE %s: %w", o.Interface, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
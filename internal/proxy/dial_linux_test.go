@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestConnectDirect_DialOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+
+	conn, err := ConnectDirect("127.0.0.1", addr.Port, 5, DialOptions{Mark: 42, Interface: "lo", SourceAddress: "127.0.0.2"})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("Marking sockets needs CAP_NET_ADMIN: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("ConnectDirect failed: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	remote := <-accepted
+	defer func() {
+		_ = remote.Close()
+	}()
+	if ip := remote.RemoteAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+		t.Errorf("Expected source address 127.0.0.2, got %s", ip)
+	}
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var mark int
+	var markErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		mark, markErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	}); err != nil || markErr != nil {
+		t.Fatalf("Failed to read SO_MARK: %v %v", err, markErr)
+	}
+	if mark != 42 {
+		t.Errorf("Expected mark 42, got %d", mark)
+	}
+
+	if _, err := ConnectDirect("127.0.0.1", addr.Port, 5, DialOptions{Interface: "no-such-interface0"}); err == nil {
+		t.Error("Expected an error for an unknown interface")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control fails, marks and interface binding are only supported on Linux
+func (o DialOptions) control(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("outbound mark and interface are not supported on this platform")
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JA3String returns the JA3 fingerprint input of the ClientHello:
+// version, cipher suites, extensions, supported groups and EC point formats
+// as decimal lists. GREASE values are left out.
+func (h *ClientHello) JA3String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	writeDecimalList(&b, h.CipherSuites)
+	b.WriteByte(',')
+	writeDecimalList(&b, h.Extensions)
+	b.WriteByte(',')
+	writeDecimalList(&b, h.SupportedGroups)
+	b.WriteByte(',')
+	for i, f := range h.ECPointFormats {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(f)))
+	}
+	return b.String()
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, the MD5 hash of
+// JA3String in hex.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, for example
+// t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (h *ClientHello) JA4() string {
+	ciphers, extensions := h.ja4Lists()
+	return h.ja4Prefix() + "_" + ja4Hash(ciphers) + "_" + ja4Hash(extensions)
+}
+
+// JA4Raw returns the unhashed form of the JA4 fingerprint (JA4_r), which is
+// useful when investigating why two fingerprints differ.
+func (h *ClientHello) JA4Raw() string {
+	ciphers, extensions := h.ja4Lists()
+	return h.ja4Prefix() + "_" + ciphers + "_" + extensions
+}
+
+// ja4Prefix builds the readable first part of JA4: transport, TLS version,
+// SNI presence, cipher and extension counts and the first ALPN protocol.
+func (h *ClientHello) ja4Prefix() string {
+	version := "00"
+	switch h.MaxVersion() {
+	case 0x0304:
+		version = "13"
+	case tlsVersion12:
+		version = "12"
+	case tlsVersion11:
+		version = "11"
+	case tlsVersion10:
+		version = "10"
+	case 0x0300:
+		version = "s3"
+	}
+
+	destination := "i"
+	if h.ServerName != "" {
+		destination = "d"
+	}
+
+	alpn := "00"
+	if len(h.ALPNProtocols) > 0 && h.ALPNProtocols[0] != "" {
+		first := h.ALPNProtocols[0]
+		if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+			alpn = string([]byte{first[0], first[len(first)-1]})
+		} else {
+			encoded := hex.EncodeToString([]byte(first))
+			alpn = string([]byte{encoded[0], encoded[len(encoded)-1]})
+		}
+	}
+
+	transport := "t"
+	if h.QUIC {
+		transport = "q"
+	}
+
+	return fmt.Sprintf("%s%s%s%02d%02d%s",
+		transport, version, destination,
+		min(countNonGREASE(h.CipherSuites), 99),
+		min(countNonGREASE(h.Extensions), 99),
+		alpn)
+}
+
+// ja4Lists returns the sorted cipher suite list and the sorted extension list
+// followed by the signature algorithms, as used for the JA4 hashes. SNI and
+// ALPN are left out of the extension list since they are already covered by
+// the prefix.
+func (h *ClientHello) ja4Lists() (string, string) {
+	ciphers := sortedHex(h.CipherSuites, nil)
+	extensions := sortedHex(h.Extensions, func(v uint16) bool {
+		return v == extensionTypeSNI || v == extensionTypeALPN
+	})
+
+	var algorithms []string
+	for _, a := range h.SignatureAlgorithms {
+		if !isGREASE(a) {
+			algorithms = append(algorithms, fmt.Sprintf("%04x", a))
+		}
+	}
+	if len(algorithms) > 0 {
+		extensions += "_" + strings.Join(algorithms, ",")
+	}
+	return ciphers, extensions
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of a JA4 list,
+// or zeros for an empty list
+func ja4Hash(list string) string {
+	if list == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// sortedHex returns the non-GREASE values as sorted, comma separated 4-digit
+// hex numbers, leaving out values for which skip returns true
+func sortedHex(values []uint16, skip func(uint16) bool) string {
+	var out []string
+	for _, v := range values {
+		if isGREASE(v) || (skip != nil && skip(v)) {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%04x", v))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// writeDecimalList writes the non-GREASE values dash-separated in decimal
+func writeDecimalList(b *strings.Builder, values []uint16) {
+	first := true
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+		first = false
+	}
+}
+
+func countNonGREASE(values []uint16) int {
+	n := 0
+	for _, v := range values {
+		if !isGREASE(v) {
+			n++
+		}
+	}
+	return n
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
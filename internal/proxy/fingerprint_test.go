@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// chromeLikeHello returns a ClientHello with GREASE values sprinkled in the
+// way browsers send them
+func chromeLikeHello() *ClientHello {
+	return &ClientHello{
+		Version:             tlsVersion12,
+		ServerName:          "www.example.com",
+		ALPNProtocols:       []string{"h2", "http/1.1"},
+		SupportedVersions:   []uint16{0x3a3a, 0x0304, 0x0303},
+		CipherSuites:        []uint16{0x0a0a, 0x1301, 0x1302, 0xc02b},
+		Extensions:          []uint16{0x1a1a, 0x0000, 0x0010, 0x000a, 0x000b, 0x000d, 0x002b},
+		SupportedGroups:     []uint16{0x2a2a, 0x001d, 0x0017},
+		ECPointFormats:      []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+	}
+}
+
+func TestJA3_KnownFingerprint(t *testing.T) {
+	// Example from the JA3 documentation
+	hello := &ClientHello{
+		Version:         tlsVersion10,
+		CipherSuites:    []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:      []uint16{0, 10, 11},
+		SupportedGroups: []uint16{23, 24, 25},
+		ECPointFormats:  []uint8{0},
+	}
+
+	if s := hello.JA3String(); s != "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0" {
+		t.Errorf("Unexpected JA3 string %q", s)
+	}
+	if fp := hello.JA3(); fp != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("Unexpected JA3 fingerprint %s", fp)
+	}
+}
+
+func TestJA3_IgnoresGREASE(t *testing.T) {
+	expected := "771,4865-4866-49195,0-16-10-11-13-43,29-23,0"
+	if s := chromeLikeHello().JA3String(); s != expected {
+		t.Errorf("Expected JA3 string %q, got %q", expected, s)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	hello := chromeLikeHello()
+
+	expectedRaw := "t13d0306h2_1301,1302,c02b_000a,000b,000d,002b_0403,0804"
+	if raw := hello.JA4Raw(); raw != expectedRaw {
+		t.Errorf("Expected JA4_r %q, got %q", expectedRaw, raw)
+	}
+
+	cipherHash := sha256.Sum256([]byte("1301,1302,c02b"))
+	extensionHash := sha256.Sum256([]byte("000a,000b,000d,002b_0403,0804"))
+	expected := "t13d0306h2_" + hex.EncodeToString(cipherHash[:])[:12] + "_" + hex.EncodeToString(extensionHash[:])[:12]
+	if fp := hello.JA4(); fp != expected {
+		t.Errorf("Expected JA4 %q, got %q", expected, fp)
+	}
+}
+
+func TestJA4_Prefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(h *ClientHello)
+		expected string
+	}{
+		{"NoSNI", func(h *ClientHello) { h.ServerName = "" }, "t13i0306h2"},
+		{"NoALPN", func(h *ClientHello) { h.ALPNProtocols = nil }, "t13d030600"},
+		{"HTTP11", func(h *ClientHello) { h.ALPNProtocols = []string{"http/1.1"} }, "t13d0306h1"},
+		{"NonAlphanumericALPN", func(h *ClientHello) { h.ALPNProtocols = []string{"\xabx\xcd"} }, "t13d0306ad"},
+		{"TLS12", func(h *ClientHello) { h.SupportedVersions = nil }, "t12d0306h2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := chromeLikeHello()
+			tt.modify(hello)
+			if prefix := hello.ja4Prefix(); prefix != tt.expected {
+				t.Errorf("Expected prefix %s, got %s", tt.expected, prefix)
+			}
+		})
+	}
+}
+
+func TestJA4_EmptyLists(t *testing.T) {
+	hello := &ClientHello{Version: tlsVersion12}
+	if fp := hello.JA4(); fp != "t12i000000_000000000000_000000000000" {
+		t.Errorf("Unexpected JA4 for empty ClientHello: %s", fp)
+	}
+}
+
+func TestFingerprint_ParsedClientHello(t *testing.T) {
+	msg := buildClientHelloMessage(
+		sniExtension("www.example.com"),
+		alpnExtension("h2"),
+		extension(extensionTypeSupportedGroups, []byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x17}),
+		extension(extensionTypeECPointFormats, []byte{0x01, 0x00}),
+		extension(extensionTypeSignatureAlgs, []byte{0x00, 0x02, 0x04, 0x03}),
+		supportedVersionsExtension(0x0304),
+	)
+	hello, err := ParseClientHello(splitIntoRecords(msg, 16384))
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+
+	if s := hello.JA3String(); s != "771,4865,0-16-10-11-13-43,29-23,0" {
+		t.Errorf("Unexpected JA3 string %q", s)
+	}
+	if raw := hello.JA4Raw(); raw != "t13d0106h2_1301_000a,000b,000d,002b_0403" {
+		t.Errorf("Unexpected JA4_r %q", raw)
+	}
+}
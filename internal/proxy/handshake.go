@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrClientHelloTooLarge is returned by ReadClientHello when the handshake
+// message does not fit into the configured size limit.
+var ErrClientHelloTooLarge = errors.New("client hello exceeds size limit")
+
+// ReadClientHello reads from conn until a complete TLS handshake message is
+// buffered, the data turns out not to be TLS, maxSize bytes have been read or
+// the timeout expires. The ClientHello may be split across several TCP
+// segments and several TLS records.
+//
+// Everything read from conn is returned so the caller can forward it to the
+// remote side unchanged. On error the data read so far is returned as well,
+// which lets the caller fall back to the original destination.
+func ReadClientHello(conn net.Conn, maxSize int, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer func() {
+			// The caller sets its own deadlines for the tunnel
+			_ = conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	data := make([]byte, 0, 4096)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		data = append(data, buf[:n]...)
+
+		if !needMoreHandshakeData(data) {
+			return data, nil
+		}
+		if len(data) >= maxSize {
+			return data, ErrClientHelloTooLarge
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// needMoreHandshakeData reports whether data is the beginning of a TLS
+// handshake whose first message has not been fully received yet.
+func needMoreHandshakeData(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if data[0] != recordTypeHandshake {
+		return false // Not TLS, nothing to wait for
+	}
+	if len(data) < recordHeaderSize {
+		return true
+	}
+	if data[1] != 0x03 {
+		return false
+	}
+
+	handshake := handshakeFragments(data)
+	if len(handshake) < handshakeHeaderSize {
+		return true
+	}
+	messageLength := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+	return len(handshake) < handshakeHeaderSize+messageLength
+}
+
+// handshakeFragments joins the payloads of the consecutive TLS handshake
+// records at the start of data. A truncated last record contributes the bytes
+// that are available.
+func handshakeFragments(data []byte) []byte {
+	var handshake []byte
+	pos := 0
+	for pos+recordHeaderSize <= len(data) && data[pos] == recordTypeHandshake {
+		recordLength := int(data[pos+3])<<8 | int(data[pos+4])
+		end := pos + recordHeaderSize + recordLength
+		if end > len(data) {
+			end = len(data)
+		}
+		handshake = append(handshake, data[pos+recordHeaderSize:end]...)
+		pos = end
+	}
+	return handshake
+}
+
+// coalesceRecords rewrites a handshake spread over several TLS records into a
+// single record so it can be parsed in one pass. Data that already fits into
+// its first record is returned unchanged.
+func coalesceRecords(data []byte) []byte {
+	if len(data) < recordHeaderSize {
+		return data
+	}
+	next := recordHeaderSize + (int(data[3])<<8 | int(data[4]))
+	if next+recordHeaderSize > len(data) || data[next] != recordTypeHandshake || data[next+1] != 0x03 {
+		return data
+	}
+
+	handshake := handshakeFragments(data)
+	if len(handshake) > 0xffff {
+		handshake = handshake[:0xffff]
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(handshake))
+	copy(record, data[:3])
+	record[3] = byte(len(handshake) >> 8)
+	record[4] = byte(len(handshake))
+	return append(record, handshake...)
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test utility functions
+
+// extension encodes a single ClientHello extension
+func extension(extType uint16, body []byte) []byte {
+	ext := []byte{byte(extType >> 8), byte(extType), byte(len(body) >> 8), byte(len(body))}
+	return append(ext, body...)
+}
+
+// sniExtension encodes a server_name extension with one host_name entry
+func sniExtension(name string) []byte {
+	entry := append([]byte{nameTypeHost, byte(len(name) >> 8), byte(len(name))}, name...)
+	list := append([]byte{byte(len(entry) >> 8), byte(len(entry))}, entry...)
+	return extension(extensionTypeSNI, list)
+}
+
+// paddingExtension encodes a padding extension of the given size, which is
+// handy for producing ClientHellos of realistic post-quantum sizes
+func paddingExtension(size int) []byte {
+	return extension(0x0015, make([]byte, size))
+}
+
+// buildClientHelloMessage builds a ClientHello handshake message (without the
+// record layer) offering TLS_AES_128_GCM_SHA256 and the given extensions
+func buildClientHelloMessage(extensions ...[]byte) []byte {
+	body := []byte{0x03, 0x03}                       // legacy_version
+	body = append(body, make([]byte, randomSize)...) // random
+	body = append(body, 0x00)                        // session_id
+	body = append(body, 0x00, 0x02, 0x13, 0x01)      // cipher_suites
+	body = append(body, 0x01, 0x00)                  // compression_methods
+	exts := bytes.Join(extensions, nil)
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+
+	msg := []byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// splitIntoRecords wraps a handshake message into TLS records carrying at
+// most fragmentSize bytes each
+func splitIntoRecords(msg []byte, fragmentSize int) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := fragmentSize
+		if n > len(msg) {
+			n = len(msg)
+		}
+		out = append(out, recordTypeHandshake, 0x03, 0x01, byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// writeInChunks writes data to conn in chunks of the given size, simulating
+// a ClientHello that arrives in several TCP segments
+func writeInChunks(conn net.Conn, data []byte, chunkSize int) {
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// Test cases
+
+func TestReadClientHello_MultipleSegments(t *testing.T) {
+	hello := splitIntoRecords(buildClientHelloMessage(sniExtension("segmented.example.com"), paddingExtension(1800)), 16384)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	go writeInChunks(client, hello, 500)
+
+	data, err := ReadClientHello(server, 65536, 5*time.Second)
+	if err != nil {
+		t.Fatalf("ReadClientHello failed: %v", err)
+	}
+	if !bytes.Equal(data, hello) {
+		t.Fatalf("Expected %d bytes, got %d", len(hello), len(data))
+	}
+	if sni := ParseSNI(data); sni != "segmented.example.com" {
+		t.Errorf("Expected SNI segmented.example.com, got %q", sni)
+	}
+}
+
+func TestReadClientHello_MultipleRecords(t *testing.T) {
+	// The SNI extension comes after the padding so it lands in a later record
+	hello := splitIntoRecords(buildClientHelloMessage(paddingExtension(1800), sniExtension("records.example.com")), 512)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	go writeInChunks(client, hello, 700)
+
+	data, err := ReadClientHello(server, 65536, 5*time.Second)
+	if err != nil {
+		t.Fatalf("ReadClientHello failed: %v", err)
+	}
+	if !bytes.Equal(data, hello) {
+		t.Fatalf("Expected %d bytes, got %d", len(hello), len(data))
+	}
+	if sni := ParseSNI(data); sni != "records.example.com" {
+		t.Errorf("Expected SNI records.example.com, got %q", sni)
+	}
+}
+
+func TestReadClientHello_NonTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	go writeInChunks(client, request, len(request))
+
+	data, err := ReadClientHello(server, 65536, 5*time.Second)
+	if err != nil {
+		t.Fatalf("ReadClientHello failed: %v", err)
+	}
+	if !bytes.Equal(data, request) {
+		t.Errorf("Expected %q, got %q", request, data)
+	}
+}
+
+func TestReadClientHello_Timeout(t *testing.T) {
+	hello := splitIntoRecords(buildClientHelloMessage(sniExtension("slow.example.com"), paddingExtension(1800)), 16384)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	// Only half of the ClientHello ever arrives
+	go writeInChunks(client, hello[:len(hello)/2], 256)
+
+	data, err := ReadClientHello(server, 65536, 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected ReadClientHello to time out")
+	}
+	if len(data) != len(hello)/2 {
+		t.Errorf("Expected the %d bytes read so far, got %d", len(hello)/2, len(data))
+	}
+}
+
+func TestReadClientHello_SizeLimit(t *testing.T) {
+	hello := splitIntoRecords(buildClientHelloMessage(sniExtension("huge.example.com"), paddingExtension(30000)), 16384)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	go writeInChunks(client, hello, 4096)
+
+	data, err := ReadClientHello(server, 8192, 5*time.Second)
+	if !errors.Is(err, ErrClientHelloTooLarge) {
+		t.Fatalf("Expected ErrClientHelloTooLarge, got %v", err)
+	}
+	if len(data) < 8192 {
+		t.Errorf("Expected at least 8192 bytes, got %d", len(data))
+	}
+}
+
+func TestCoalesceRecords_SingleRecordUnchanged(t *testing.T) {
+	hello := splitIntoRecords(buildClientHelloMessage(sniExtension("single.example.com")), 16384)
+
+	if coalesced := coalesceRecords(hello); !bytes.Equal(coalesced, hello) {
+		t.Error("Expected a single record to be returned unchanged")
+	}
+}
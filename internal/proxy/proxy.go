@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -38,12 +40,18 @@ const (
 )
 
 func ParseHTTPHost(data []byte) (string, int) {
+	return ParseHTTPHostWithDefault(data, 80)
+}
+
+// ParseHTTPHostWithDefault parses the Host header like ParseHTTPHost, using
+// defaultPort when the header has no port
+func ParseHTTPHostWithDefault(data []byte, defaultPort int) (string, int) {
 	reader := bufio.NewReader(bytes.NewReader(data))
 
 	// Read the first line (request line)
 	_, err := reader.ReadString('\n')
 	if err != nil {
-		return "", 80
+		return "", defaultPort
 	}
 
 	// Read headers until we find Host header
@@ -57,7 +65,7 @@ func ParseHTTPHost(data []byte) (string, int) {
 			hostStr := strings.TrimSpace(strings.TrimPrefix(line, "Host: "))
 			parts := strings.Split(hostStr, ":")
 			host := parts[0]
-			port := 80
+			port := defaultPort
 
 			if len(parts) > 1 {
 				if p, err := strconv.Atoi(parts[1]); err == nil {
@@ -68,7 +76,7 @@ func ParseHTTPHost(data []byte) (string, int) {
 		}
 	}
 
-	return "", 80
+	return "", defaultPort
 }
 
 // findTLSHandshake locates the TLS handshake in the data and returns its starting position
@@ -135,8 +143,9 @@ func ParseSNI(data []byte) string {
 		return "" // Not a TLS handshake found
 	}
 
-	// Use data starting from TLS handshake
-	data = data[startPos:]
+	// Use data starting from TLS handshake, joining records if the
+	// ClientHello was split across several of them
+	data = coalesceRecords(data[startPos:])
 
 	// Validate TLS record header
 	if len(data) < 5 || data[0] != recordTypeHandshake {
@@ -256,37 +265,81 @@ func ParseSNI(data []byte) string {
 	return ""
 }
 
-func Pipe(ctx context.Context, src, dst net.Conn, wg *sync.WaitGroup) {
+// ByteCounter accumulates the number of bytes copied by Pipe
+type ByteCounter interface {
+	Add(n uint64)
+}
+
+// Pipe copies from src to dst until either side fails or ctx is done, then
+// closes dst. When src reaches EOF and dst supports it, only writing to dst
+// is shut down (half-close). Every write waits for the buckets and is added to the
+// counters. Between TCP connections on Linux the data is moved with
+// splice(2) without copying it to user space. It returns io.EOF when the
+// peer of src closed the connection, the context error when ctx is done,
+// or the read or write error.
+func Pipe(ctx context.Context, src, dst net.Conn, wg *sync.WaitGroup, buckets []*TokenBucket, counters ...ByteCounter) error {
 	defer wg.Done()
-	defer func() {
-		if err := dst.Close(); err != nil {
-			// Connection close errors are expected and can be safely ignored
-			_ = err // explicitly ignore the error
+
+	err := errSpliceUnsupported
+	srcTCP, srcOK := src.(*net.TCPConn)
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	if srcOK && dstOK {
+		err = spliceConn(ctx, srcTCP, dstTCP, buckets, counters)
+	}
+	if errors.Is(err, errSpliceUnsupported) {
+		err = copyConn(ctx, src, dst, buckets, counters)
+	}
+
+	// After EOF only writing is shut down, so the peer gets the FIN and the
+	// other direction goes on. The caller closes both connections.
+	if errors.Is(err, io.EOF) {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return err
 		}
-	}()
+	}
+	if closeErr := dst.Close(); closeErr != nil {
+		// Connection close errors are expected and can be safely ignored
+		_ = closeErr // explicitly ignore the error
+	}
+	return err
+}
+
+// closeWriter is implemented by connections that can shut down writing
+// alone, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
 
+// copyConn copies from src to dst through a user space buffer
+func copyConn(ctx context.Context, src, dst net.Conn, buckets []*TokenBucket, counters []ByteCounter) error {
 	buf := make([]byte, 4096) // BUFFER_SIZE is now in config package
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		default:
 			n, err := src.Read(buf)
-			if err != nil {
-				return
-			}
 			if n > 0 {
-				_, err = dst.Write(buf[:n])
-				if err != nil {
-					return
+				if waitErr := waitBuckets(ctx, buckets, n); waitErr != nil {
+					return waitErr
+				}
+				written, writeErr := dst.Write(buf[:n])
+				for _, c := range counters {
+					c.Add(uint64(written))
+				}
+				if writeErr != nil {
+					return writeErr
 				}
 			}
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func ConnectDirect(host string, port int, timeout int) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Duration(timeout)*time.Second)
+func ConnectDirect(host string, port int, timeout int, options DialOptions) (net.Conn, error) {
+	conn, err := options.dial(net.JoinHostPort(host, strconv.Itoa(port)), timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -304,8 +357,30 @@ func ConnectDirect(host string, port int, timeout int) (net.Conn, error) {
 	return conn, nil
 }
 
-func ConnectViaProxy(proxyHost string, proxyPort int, targetHost string, targetPort int, clientIP string, timeout int) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(proxyHost, strconv.Itoa(proxyPort)), time.Duration(timeout)*time.Second)
+// ConnectError is returned by ConnectViaProxy when the upstream proxy
+// answers the CONNECT request with a status other than 200
+type ConnectError struct {
+	StatusCode int    // 0 if the status line could not be parsed
+	Status     string // the status line as received
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("proxy connection failed: %s", e.Status)
+}
+
+func newConnectError(statusLine string) *ConnectError {
+	e := &ConnectError{Status: statusLine}
+	// HTTP/1.1 403 Forbidden
+	if fields := strings.Fields(statusLine); len(fields) >= 2 {
+		if code, err := strconv.Atoi(fields[1]); err == nil {
+			e.StatusCode = code
+		}
+	}
+	return e
+}
+
+func ConnectViaProxy(proxyHost string, proxyPort int, targetHost string, targetPort int, clientIP string, timeout int, options DialOptions) (net.Conn, error) {
+	conn, err := options.dial(net.JoinHostPort(proxyHost, strconv.Itoa(proxyPort)), timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -355,7 +430,7 @@ func ConnectViaProxy(proxyHost string, proxyPort int, targetHost string, targetP
 			// Connection close errors are expected and can be safely ignored
 			_ = closeErr // explicitly ignore the error
 		}
-		return nil, fmt.Errorf("proxy connection failed: %s", response)
+		return nil, newConnectError(response)
 	}
 
 	// Read remaining headers until empty line
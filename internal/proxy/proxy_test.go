@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -324,7 +327,7 @@ func TestPipe_BasicDataTransfer(t *testing.T) {
 	wg.Add(1)
 
 	// Start piping from client to server
-	go Pipe(ctx, clientConn, serverConn, &wg)
+	go Pipe(ctx, clientConn, serverConn, &wg, nil)
 
 	// Write data to client
 	testData := []byte("Hello, World!")
@@ -357,6 +360,44 @@ func TestPipe_BasicDataTransfer(t *testing.T) {
 	wg.Wait()
 }
 
+// byteCount is a ByteCounter for tests
+type byteCount struct {
+	n atomic.Uint64
+}
+
+func (c *byteCount) Add(n uint64) {
+	c.n.Add(n)
+}
+
+func TestPipe_CountsBytes(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	remoteConn, remotePeer := net.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	counter := &byteCount{}
+	go Pipe(context.Background(), serverConn, remoteConn, &wg, nil, counter)
+
+	go func() {
+		_, _ = clientConn.Write([]byte("Hello, "))
+		_, _ = clientConn.Write([]byte("World!"))
+		_ = clientConn.Close()
+	}()
+
+	received, err := io.ReadAll(remotePeer)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	wg.Wait()
+
+	if string(received) != "Hello, World!" {
+		t.Errorf("Unexpected data %q", received)
+	}
+	if got := counter.n.Load(); got != uint64(len(received)) {
+		t.Errorf("Expected %d bytes counted, got %d", len(received), got)
+	}
+}
+
 func TestPipe_ContextCancellation(t *testing.T) {
 	clientConn, serverConn := net.Pipe()
 
@@ -365,7 +406,7 @@ func TestPipe_ContextCancellation(t *testing.T) {
 	wg.Add(1)
 
 	// Start piping
-	go Pipe(ctx, clientConn, serverConn, &wg)
+	go Pipe(ctx, clientConn, serverConn, &wg, nil)
 
 	// Cancel context immediately
 	cancel()
@@ -415,7 +456,7 @@ func TestConnectDirect_Success(t *testing.T) {
 	host := "127.0.0.1"
 	port := listener.Addr().(*net.TCPAddr).Port
 
-	conn, err := ConnectDirect(host, port, 30) // 30 second timeout
+	conn, err := ConnectDirect(host, port, 30, DialOptions{}) // 30 second timeout
 	if err != nil {
 		t.Errorf("ConnectDirect failed: %v", err)
 		return
@@ -432,7 +473,7 @@ func TestConnectDirect_Success(t *testing.T) {
 }
 
 func TestConnectDirect_InvalidHost(t *testing.T) {
-	conn, err := ConnectDirect("invalid-host-that-does-not-exist", 9999, 30) // 30 second timeout
+	conn, err := ConnectDirect("invalid-host-that-does-not-exist", 9999, 30, DialOptions{}) // 30 second timeout
 	if err == nil {
 		if err := conn.Close(); err != nil {
 			t.Logf("Connection close error: %v", err)
@@ -503,7 +544,7 @@ func TestConnectViaProxy_Success(t *testing.T) {
 	targetPort := 443
 	clientIP := "192.168.1.1"
 
-	conn, err := ConnectViaProxy(proxyHost, proxyPort, targetHost, targetPort, clientIP, 30) // 30 second timeout
+	conn, err := ConnectViaProxy(proxyHost, proxyPort, targetHost, targetPort, clientIP, 30, DialOptions{}) // 30 second timeout
 	if err != nil {
 		t.Errorf("ConnectViaProxy failed: %v", err)
 		return
@@ -553,17 +594,22 @@ func TestConnectViaProxy_ProxyError(t *testing.T) {
 	proxyHost := "127.0.0.1"
 	proxyPort := proxyListener.Addr().(*net.TCPAddr).Port
 
-	conn, err := ConnectViaProxy(proxyHost, proxyPort, "example.com", 443, "192.168.1.1", 30) // 30 second timeout
+	conn, err := ConnectViaProxy(proxyHost, proxyPort, "example.com", 443, "192.168.1.1", 30, DialOptions{}) // 30 second timeout
 	if err == nil {
 		if err := conn.Close(); err != nil {
 			t.Logf("Connection close error: %v", err)
 		}
 		t.Error("Expected ConnectViaProxy to fail with proxy error")
 	}
+
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || connectErr.StatusCode != 500 {
+		t.Errorf("Expected ConnectError with status 500, got %v", err)
+	}
 }
 
 func TestConnectViaProxy_InvalidProxy(t *testing.T) {
-	conn, err := ConnectViaProxy("invalid-proxy", 9999, "example.com", 443, "192.168.1.1", 30) // 30 second timeout
+	conn, err := ConnectViaProxy("invalid-proxy", 9999, "example.com", 443, "192.168.1.1", 30, DialOptions{}) // 30 second timeout
 	if err == nil {
 		if err := conn.Close(); err != nil {
 			t.Logf("Connection close error: %v", err)
@@ -571,3 +617,9 @@ func TestConnectViaProxy_InvalidProxy(t *testing.T) {
 		t.Error("Expected ConnectViaProxy to fail with invalid proxy")
 	}
 }
+
+func TestDialOptions_InvalidSourceAddress(t *testing.T) {
+	if _, err := (DialOptions{SourceAddress: "not-an-ip"}).DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("Expected an error for an invalid source address")
+	}
+}
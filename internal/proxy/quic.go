@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sort"
+)
+
+// QUIC versions whose Initial packets can be decrypted
+const (
+	QUICVersion1 = 0x00000001
+	QUICVersion2 = 0x6b3343cf
+)
+
+// QUIC frame types found in client Initial packets
+const (
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameACK             = 0x02
+	quicFrameACKECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+var (
+	quicV1InitialSalt = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+	quicV2InitialSalt = []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	}
+)
+
+var (
+	// ErrNotQUICInitial is returned for datagrams that do not start with a
+	// QUIC Initial packet of a supported version.
+	ErrNotQUICInitial = errors.New("not a QUIC Initial packet")
+
+	// ErrQUICDecrypt is returned when an Initial packet fails authentication.
+	ErrQUICDecrypt = errors.New("failed to decrypt QUIC Initial packet")
+)
+
+// QUICCryptoFrame is the content of a CRYPTO frame: a piece of the TLS
+// handshake stream at the given offset.
+type QUICCryptoFrame struct {
+	Offset uint64
+	Data   []byte
+}
+
+// QUICInitial holds the decrypted contents of the client Initial packets at
+// the start of a UDP datagram.
+type QUICInitial struct {
+	Version      uint32
+	DCID         []byte
+	SCID         []byte
+	CryptoFrames []QUICCryptoFrame
+}
+
+// quicInitialKeys holds the client Initial packet protection keys
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// IsQUICInitial reports whether the datagram starts with a long header QUIC
+// Initial packet of a supported version, without decrypting it.
+func IsQUICInitial(datagram []byte) bool {
+	if len(datagram) < 7 || datagram[0]&0xc0 != 0xc0 {
+		return false
+	}
+	version := uint32(datagram[1])<<24 | uint32(datagram[2])<<16 | uint32(datagram[3])<<8 | uint32(datagram[4])
+	packetType := datagram[0] >> 4 & 0x03
+	switch version {
+	case QUICVersion1:
+		return packetType == 0x00
+	case QUICVersion2:
+		return packetType == 0x01
+	default:
+		return false
+	}
+}
+
+// ParseQUICInitial removes header protection from and decrypts the client
+// Initial packets at the start of a UDP datagram. The keys are derived from
+// the Destination Connection ID as described in RFC 9001 and RFC 9369, so no
+// state is needed. Other packets coalesced into the datagram are ignored.
+func ParseQUICInitial(datagram []byte) (*QUICInitial, error) {
+	var initial *QUICInitial
+	for len(datagram) > 0 && IsQUICInitial(datagram) {
+		packet, rest, err := decryptQUICInitial(datagram)
+		if err != nil {
+			if initial != nil {
+				break // Keep the frames of the packets that did decrypt
+			}
+			return nil, err
+		}
+		if initial == nil {
+			initial = packet
+		} else {
+			initial.CryptoFrames = append(initial.CryptoFrames, packet.CryptoFrames...)
+		}
+		datagram = rest
+	}
+	if initial == nil {
+		return nil, ErrNotQUICInitial
+	}
+	return initial, nil
+}
+
+// decryptQUICInitial decrypts the Initial packet at the start of datagram and
+// returns it along with the rest of the datagram.
+func decryptQUICInitial(datagram []byte) (*QUICInitial, []byte, error) {
+	r := helloReader{data: datagram}
+	r.skip(1) // First byte, protected
+	version := uint32(r.uint16())<<16 | uint32(r.uint16())
+	dcid := r.vector(1)
+	scid := r.vector(1)
+	tokenLength := r.varint()
+	r.takeVarint(tokenLength)
+	length := r.varint()
+	if r.err != nil || length > uint64(r.remaining()) || length < 20 {
+		return nil, nil, ErrNotQUICInitial
+	}
+
+	pnOffset := len(datagram) - r.remaining()
+	packetEnd := pnOffset + int(length)
+	packet := make([]byte, packetEnd)
+	copy(packet, datagram[:packetEnd])
+
+	keys, err := newQUICInitialKeys(version, dcid.data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Remove header protection using a sample taken 4 bytes after the start
+	// of the packet number
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	pnLength := int(packet[0]&0x03) + 1
+	var packetNumber uint64
+	for i := 0; i < pnLength; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		packetNumber = packetNumber<<8 | uint64(packet[pnOffset+i])
+	}
+
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(packetNumber >> (8 * i))
+	}
+
+	header := packet[:pnOffset+pnLength]
+	payload, err := keys.aead.Open(nil, nonce, packet[pnOffset+pnLength:], header)
+	if err != nil {
+		return nil, nil, ErrQUICDecrypt
+	}
+
+	initial := &QUICInitial{
+		Version: version,
+		DCID:    append([]byte(nil), dcid.data...),
+		SCID:    append([]byte(nil), scid.data...),
+	}
+	initial.CryptoFrames = parseQUICFrames(payload)
+	return initial, datagram[packetEnd:], nil
+}
+
+// parseQUICFrames returns the CRYPTO frames of a decrypted Initial packet
+// payload. Parsing stops at the first frame type that cannot appear in a
+// client Initial packet.
+func parseQUICFrames(payload []byte) []QUICCryptoFrame {
+	var frames []QUICCryptoFrame
+	r := helloReader{data: payload}
+	for r.remaining() > 0 && r.err == nil {
+		switch frameType := r.varint(); frameType {
+		case quicFramePadding, quicFramePing:
+		case quicFrameACK, quicFrameACKECN:
+			r.varint() // Largest Acknowledged
+			r.varint() // ACK Delay
+			rangeCount := r.varint()
+			r.varint() // First ACK Range
+			for i := uint64(0); i < rangeCount && r.err == nil; i++ {
+				r.varint() // Gap
+				r.varint() // ACK Range Length
+			}
+			if frameType == quicFrameACKECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case quicFrameCrypto:
+			offset := r.varint()
+			data := r.takeVarint(r.varint())
+			if r.err == nil {
+				frames = append(frames, QUICCryptoFrame{Offset: offset, Data: data})
+			}
+		case quicFrameConnectionClose:
+			r.varint() // Error Code
+			r.varint() // Frame Type
+			r.takeVarint(r.varint())
+		default:
+			return frames
+		}
+	}
+	return frames
+}
+
+// newQUICInitialKeys derives the client Initial packet protection keys from
+// the Destination Connection ID chosen by the client.
+func newQUICInitialKeys(version uint32, dcid []byte) (*quicInitialKeys, error) {
+	salt, keyLabel, ivLabel, hpLabel := quicV1InitialSalt, "quic key", "quic iv", "quic hp"
+	switch version {
+	case QUICVersion1:
+	case QUICVersion2:
+		salt, keyLabel, ivLabel, hpLabel = quicV2InitialSalt, "quicv2 key", "quicv2 iv", "quicv2 hp"
+	default:
+		return nil, ErrNotQUICInitial
+	}
+
+	initialSecret := hkdfExtract(salt, dcid)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(clientSecret, keyLabel, 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(clientSecret, hpLabel, 16))
+	if err != nil {
+		return nil, err
+	}
+
+	return &quicInitialKeys{
+		aead: aead,
+		iv:   hkdfExpandLabel(clientSecret, ivLabel, 12),
+		hp:   hp,
+	}, nil
+}
+
+// hkdfExtract implements HKDF-Extract (RFC 5869) with SHA-256
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from TLS 1.3 (RFC 8446) with
+// SHA-256 and an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(fullLabel))}
+	info = append(info, fullLabel...)
+	info = append(info, 0x00)
+
+	var out, block []byte
+	mac := hmac.New(sha256.New, secret)
+	for counter := byte(1); len(out) < length; counter++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// varint reads a QUIC variable-length integer (RFC 9000 section 16)
+func (r *helloReader) varint() uint64 {
+	first := r.take(1)
+	if first == nil {
+		return 0
+	}
+	value := uint64(first[0] & 0x3f)
+	for _, b := range r.take(1<<(first[0]>>6) - 1) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// QUICHelloAssembler reassembles the TLS ClientHello carried in the CRYPTO
+// frames of one or more QUIC Initial packets. Browsers with post-quantum key
+// shares spread the ClientHello over two or more Initial packets.
+type QUICHelloAssembler struct {
+	frames   []QUICCryptoFrame
+	buffered int
+	maxSize  int
+}
+
+// NewQUICHelloAssembler returns an assembler that buffers at most maxSize
+// bytes of CRYPTO data.
+func NewQUICHelloAssembler(maxSize int) *QUICHelloAssembler {
+	return &QUICHelloAssembler{maxSize: maxSize}
+}
+
+// Add buffers the CRYPTO frames of an Initial packet. It returns
+// ErrClientHelloTooLarge once the size limit is exceeded.
+func (a *QUICHelloAssembler) Add(frames []QUICCryptoFrame) error {
+	for _, f := range frames {
+		a.buffered += len(f.Data)
+		if a.buffered > a.maxSize {
+			return ErrClientHelloTooLarge
+		}
+		a.frames = append(a.frames, QUICCryptoFrame{Offset: f.Offset, Data: append([]byte(nil), f.Data...)})
+	}
+	return nil
+}
+
+// ClientHello returns the parsed ClientHello once the CRYPTO stream holds the
+// complete handshake message, or false if more Initial packets are needed.
+// The ClientHello is nil if the complete message could not be parsed.
+func (a *QUICHelloAssembler) ClientHello() (*ClientHello, bool) {
+	sort.SliceStable(a.frames, func(i, j int) bool {
+		return a.frames[i].Offset < a.frames[j].Offset
+	})
+
+	// Join the frames into the contiguous stream starting at offset 0,
+	// ignoring retransmitted and overlapping data
+	var stream []byte
+	for _, f := range a.frames {
+		if f.Offset > uint64(len(stream)) {
+			break
+		}
+		if end := f.Offset + uint64(len(f.Data)); end > uint64(len(stream)) {
+			stream = append(stream, f.Data[uint64(len(stream))-f.Offset:]...)
+		}
+	}
+
+	if len(stream) < handshakeHeaderSize {
+		return nil, false
+	}
+	length := int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])
+	if len(stream) < handshakeHeaderSize+length {
+		return nil, false
+	}
+
+	hello, err := parseClientHelloMessage(stream[:handshakeHeaderSize+length])
+	if err != nil {
+		return nil, true
+	}
+	hello.QUIC = true
+	return hello, true
+}
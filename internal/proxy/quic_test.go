@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Test utility functions
+
+// quicVarint encodes a QUIC variable-length integer using the 2-byte form
+func quicVarint(v int) []byte {
+	return []byte{0x40 | byte(v>>8), byte(v)}
+}
+
+// cryptoFrame encodes a CRYPTO frame
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := append([]byte{quicFrameCrypto}, quicVarint(offset)...)
+	frame = append(frame, quicVarint(len(data))...)
+	return append(frame, data...)
+}
+
+// sealQUICInitial builds a protected client Initial packet carrying the given
+// frames, the inverse of decryptQUICInitial. The payload is padded so the
+// header protection sample is always available.
+func sealQUICInitial(t *testing.T, version uint32, dcid []byte, packetNumber byte, frames ...[]byte) []byte {
+	t.Helper()
+
+	keys, err := newQUICInitialKeys(version, dcid)
+	if err != nil {
+		t.Fatalf("Failed to derive keys: %v", err)
+	}
+
+	var payload []byte
+	for _, f := range frames {
+		payload = append(payload, f...)
+	}
+	for len(payload) < 32 {
+		payload = append(payload, quicFramePadding)
+	}
+
+	packetType := byte(0x00)
+	if version == QUICVersion2 {
+		packetType = 0x01
+	}
+	// One byte packet number
+	header := []byte{0xc0 | packetType<<4, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0x00) // SCID length
+	header = append(header, 0x00) // Token length
+	length := 1 + len(payload) + keys.aead.Overhead()
+	header = append(header, quicVarint(length)...)
+	pnOffset := len(header)
+	header = append(header, packetNumber)
+
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	nonce[len(nonce)-1] ^= packetNumber
+	packet := keys.aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	return packet
+}
+
+// Test cases
+
+func TestQUICInitialKeys_RFC9001(t *testing.T) {
+	// Test vectors from RFC 9001 appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+
+	clientSecret := hkdfExpandLabel(hkdfExtract(quicV1InitialSalt, dcid), "client in", 32)
+	if s := hex.EncodeToString(clientSecret); s != "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea" {
+		t.Errorf("Unexpected client initial secret %s", s)
+	}
+	if key := hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic key", 16)); key != "1f369613dd76d5467730efcbe3b1a22d" {
+		t.Errorf("Unexpected key %s", key)
+	}
+	if iv := hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic iv", 12)); iv != "fa044b2f42a3fd3b46fb255c" {
+		t.Errorf("Unexpected iv %s", iv)
+	}
+	if hp := hex.EncodeToString(hkdfExpandLabel(clientSecret, "quic hp", 16)); hp != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Errorf("Unexpected hp key %s", hp)
+	}
+}
+
+func TestParseQUICInitial_ClientHello(t *testing.T) {
+	versions := map[string]uint32{"QUICv1": QUICVersion1, "QUICv2": QUICVersion2}
+	for name, version := range versions {
+		t.Run(name, func(t *testing.T) {
+			dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+			msg := buildClientHelloMessage(sniExtension("quic.example.com"), alpnExtension("h3"))
+			datagram := sealQUICInitial(t, version, dcid, 0, cryptoFrame(0, msg))
+
+			if !IsQUICInitial(datagram) {
+				t.Fatal("Expected datagram to be recognized as QUIC Initial")
+			}
+			initial, err := ParseQUICInitial(datagram)
+			if err != nil {
+				t.Fatalf("ParseQUICInitial failed: %v", err)
+			}
+			if initial.Version != version || hex.EncodeToString(initial.DCID) != "0102030405060708" {
+				t.Errorf("Unexpected header fields: version 0x%08x, DCID %x", initial.Version, initial.DCID)
+			}
+
+			assembler := NewQUICHelloAssembler(65536)
+			if err := assembler.Add(initial.CryptoFrames); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+			hello, complete := assembler.ClientHello()
+			if !complete || hello == nil {
+				t.Fatal("Expected a complete ClientHello")
+			}
+			if hello.ServerName != "quic.example.com" || !hello.OffersALPN("h3") {
+				t.Errorf("Unexpected ClientHello: sni %q, alpn %v", hello.ServerName, hello.ALPNProtocols)
+			}
+			if !hello.QUIC || hello.JA4()[0] != 'q' {
+				t.Errorf("Expected a QUIC JA4 fingerprint, got %s", hello.JA4())
+			}
+		})
+	}
+}
+
+func TestQUICHelloAssembler_MultiplePackets(t *testing.T) {
+	dcid := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}
+	msg := buildClientHelloMessage(keyShareExtension(1216, 0x11ec), sniExtension("split.example.com"))
+	half := len(msg) / 2
+
+	// The second half arrives first, as a reordered datagram
+	first := sealQUICInitial(t, QUICVersion1, dcid, 1, cryptoFrame(half, msg[half:]))
+	second := sealQUICInitial(t, QUICVersion1, dcid, 0, cryptoFrame(0, msg[:half]))
+
+	assembler := NewQUICHelloAssembler(65536)
+	for i, datagram := range [][]byte{first, second} {
+		initial, err := ParseQUICInitial(datagram)
+		if err != nil {
+			t.Fatalf("ParseQUICInitial failed: %v", err)
+		}
+		if err := assembler.Add(initial.CryptoFrames); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		hello, complete := assembler.ClientHello()
+		if i == 0 {
+			if complete {
+				t.Fatal("Expected the ClientHello to be incomplete after the first packet")
+			}
+			continue
+		}
+		if !complete || hello == nil || hello.ServerName != "split.example.com" {
+			t.Fatalf("Expected ClientHello for split.example.com, got %v", hello)
+		}
+	}
+}
+
+func TestQUICHelloAssembler_SizeLimit(t *testing.T) {
+	assembler := NewQUICHelloAssembler(100)
+	err := assembler.Add([]QUICCryptoFrame{{Offset: 0, Data: make([]byte, 101)}})
+	if !errors.Is(err, ErrClientHelloTooLarge) {
+		t.Errorf("Expected ErrClientHelloTooLarge, got %v", err)
+	}
+}
+
+func TestParseQUICInitial_Errors(t *testing.T) {
+	dcid := []byte{0x01, 0x02, 0x03, 0x04}
+	datagram := sealQUICInitial(t, QUICVersion1, dcid, 0, cryptoFrame(0, []byte("hello")))
+	datagram[len(datagram)-1] ^= 0xff // Break the authentication tag
+
+	if _, err := ParseQUICInitial(datagram); !errors.Is(err, ErrQUICDecrypt) {
+		t.Errorf("Expected ErrQUICDecrypt, got %v", err)
+	}
+	if _, err := ParseQUICInitial([]byte{0x40, 0x01, 0x02, 0x03}); !errors.Is(err, ErrNotQUICInitial) {
+		t.Errorf("Expected ErrNotQUICInitial for a short header packet, got %v", err)
+	}
+}
+
+func TestParseQUICInitial_OversizedLengths(t *testing.T) {
+	// 8-byte varints that wrap to negative ints on 32-bit platforms
+	for _, length := range [][]byte{
+		{0xc0, 0, 0, 0, 0x80, 0, 0, 0},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		datagram := []byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x08, 1, 2, 3, 4, 5, 6, 7, 8, 0x00}
+		datagram = append(datagram, length...) // Token length
+		datagram = append(datagram, make([]byte, 1200)...)
+		if _, err := ParseQUICInitial(datagram); !errors.Is(err, ErrNotQUICInitial) {
+			t.Errorf("Expected ErrNotQUICInitial for token length %x, got %v", length, err)
+		}
+
+		frame := append([]byte{quicFrameCrypto, 0x00}, length...)
+		frame = append(frame, []byte("hello")...)
+		if frames := parseQUICFrames(frame); len(frames) != 0 {
+			t.Errorf("Expected no CRYPTO frame for length %x, got %d", length, len(frames))
+		}
+		datagram = sealQUICInitial(t, QUICVersion1, []byte{1, 2, 3, 4}, 0, frame)
+		if initial, err := ParseQUICInitial(datagram); err == nil && len(initial.CryptoFrames) != 0 {
+			t.Errorf("Expected no CRYPTO frame in the packet for length %x", length)
+		}
+	}
+
+	r := helloReader{data: []byte{1, 2, 3}}
+	if r.take(-1) != nil || r.err == nil {
+		t.Error("Expected a negative length to fail")
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MIN_BUCKET_BURST lets a full bucket pass a read of Pipe at low rates
+const MIN_BUCKET_BURST = 16 * 1024
+
+// TokenBucket limits the bytes per second copied by the pipes sharing it.
+// The burst is one second of traffic.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64 // negative when bytes were sent ahead of the rate
+	last   time.Time
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	burst := float64(rate)
+	if burst < MIN_BUCKET_BURST {
+		burst = MIN_BUCKET_BURST
+	}
+	return &TokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// before sending them
+func (b *TokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// waitBuckets takes n bytes from all buckets and waits for the slowest one
+func waitBuckets(ctx context.Context, buckets []*TokenBucket, n int) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
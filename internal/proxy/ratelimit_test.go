@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	b := NewTokenBucket(100 * 1024)
+
+	// A full bucket passes one second of traffic at once
+	if d := b.reserve(100 * 1024); d != 0 {
+		t.Errorf("Expected no wait within the burst, got %v", d)
+	}
+	d := b.reserve(50 * 1024)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("Expected to wait about 500ms for half a second of traffic, got %v", d)
+	}
+}
+
+func TestTokenBucket_MinimumBurst(t *testing.T) {
+	b := NewTokenBucket(1000)
+	if d := b.reserve(4096); d != 0 {
+		t.Errorf("Expected a read of Pipe to pass a full bucket, got %v", d)
+	}
+}
+
+func TestPipe_SharedBucket(t *testing.T) {
+	const rate = 64 * 1024
+	bucket := NewTokenBucket(rate)
+
+	// Two connections share the bucket: 64K pass at once, the next 32K
+	// take half a second
+	var wg sync.WaitGroup
+	var readers sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		clientConn, serverConn := net.Pipe()
+		remoteConn, remotePeer := net.Pipe()
+		wg.Add(1)
+		go Pipe(context.Background(), serverConn, remoteConn, &wg, []*TokenBucket{bucket})
+
+		go func() {
+			_, _ = clientConn.Write(make([]byte, 48*1024))
+			_ = clientConn.Close()
+		}()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			_, _ = io.Copy(io.Discard, remotePeer)
+		}()
+	}
+	readers.Wait()
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the shared limit to slow the transfer, took %v", elapsed)
+	}
+}
+
+func TestPipe_BucketWaitEndsWithContext(t *testing.T) {
+	bucket := NewTokenBucket(1000)
+	bucket.reserve(MIN_BUCKET_BURST + 10000) // empty for 10 seconds
+
+	clientConn, serverConn := net.Pipe()
+	remoteConn, remotePeer := net.Pipe()
+	defer func() {
+		_ = clientConn.Close()
+		_ = remotePeer.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	result := make(chan error, 1)
+	go func() {
+		result <- Pipe(ctx, serverConn, remoteConn, &wg, []*TokenBucket{bucket})
+	}()
+
+	_, _ = clientConn.Write([]byte("data"))
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pipe kept waiting for the bucket after cancel")
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import "bytes"
+
+// Protocol is the application protocol detected from a client's first bytes
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota // raw TCP, routed by original destination
+	ProtocolTLS
+	ProtocolHTTP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTLS:
+		return "tls"
+	case ProtocolHTTP:
+		return "http"
+	default:
+		return "raw"
+	}
+}
+
+// httpMethods are the request methods recognized as the start of HTTP/1.x
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// DetectProtocol classifies the first bytes sent by a client. Data that is
+// too short to be recognized is reported as ProtocolUnknown.
+func DetectProtocol(data []byte) Protocol {
+	// TLS handshake record, SSL 3.0 to TLS 1.3 record versions
+	if len(data) >= 3 && data[0] == recordTypeHandshake && data[1] == 0x03 && data[2] <= 0x04 {
+		return ProtocolTLS
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, method) {
+			return ProtocolHTTP
+		}
+	}
+	return ProtocolUnknown
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import "testing"
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Protocol
+	}{
+		{"TLSClientHello", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, ProtocolTLS},
+		{"HTTPGet", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), ProtocolHTTP},
+		{"HTTPConnect", []byte("CONNECT example.com:443 HTTP/1.1\r\n"), ProtocolHTTP},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtocolUnknown},
+		{"TLSAlert", []byte{0x15, 0x03, 0x03, 0x00, 0x02}, ProtocolUnknown},
+		{"LowercaseMethod", []byte("get / HTTP/1.1\r\n"), ProtocolUnknown},
+		{"Short", []byte{0x16}, ProtocolUnknown},
+		{"Empty", nil, ProtocolUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectProtocol(tt.data); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
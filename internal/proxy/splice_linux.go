@@ -0,0 +1,106 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Flags of splice(2), not defined by the syscall package
+const (
+	SPLICE_F_MOVE     = 0x1
+	SPLICE_F_NONBLOCK = 0x2
+)
+
+// SPLICE_CHUNK is the most data moved by one splice call, the default
+// capacity of a pipe
+const SPLICE_CHUNK = 64 * 1024
+
+// errSpliceUnsupported makes Pipe fall back to copying through user space
+var errSpliceUnsupported = errors.New("splice not supported")
+
+// spliceConn moves data from src to dst through a pipe with splice(2). Each
+// call takes what the socket has, like a Read, so counters and buckets are
+// updated as data arrives. Deadlines of the connections apply.
+func spliceConn(ctx context.Context, src, dst *net.TCPConn, buckets []*TokenBucket, counters []ByteCounter) error {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return errSpliceUnsupported
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return errSpliceUnsupported
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return errSpliceUnsupported
+	}
+	defer func() {
+		_ = syscall.Close(p[0])
+		_ = syscall.Close(p[1])
+	}()
+
+	moved := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Socket to pipe, waiting in the poller until data arrives
+		var n int64
+		var spliceErr error
+		if err := srcRaw.Read(func(fd uintptr) bool {
+			// Splice returns an int on 32-bit platforms
+			spliced, err := syscall.Splice(int(fd), nil, p[1], nil, SPLICE_CHUNK, SPLICE_F_MOVE|SPLICE_F_NONBLOCK)
+			n, spliceErr = int64(spliced), err
+			return spliceErr != syscall.EAGAIN
+		}); err != nil {
+			return err
+		}
+		if spliceErr != nil {
+			if !moved && (spliceErr == syscall.EINVAL || spliceErr == syscall.ENOSYS) {
+				return errSpliceUnsupported
+			}
+			return spliceError(src, spliceErr)
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		moved = true
+
+		if err := waitBuckets(ctx, buckets, int(n)); err != nil {
+			return err
+		}
+
+		// Pipe to socket until the pipe is empty
+		for n > 0 {
+			var written int64
+			if err := dstRaw.Write(func(fd uintptr) bool {
+				spliced, err := syscall.Splice(p[0], nil, int(fd), nil, int(n), SPLICE_F_MOVE|SPLICE_F_NONBLOCK)
+				written, spliceErr = int64(spliced), err
+				return spliceErr != syscall.EAGAIN
+			}); err != nil {
+				return err
+			}
+			if spliceErr != nil {
+				return spliceError(dst, spliceErr)
+			}
+			n -= written
+			for _, c := range counters {
+				c.Add(uint64(written))
+			}
+		}
+	}
+}
+
+// spliceError returns a splice failure like the net package returns a
+// failed Read or Write
+func spliceError(conn *net.TCPConn, err error) error {
+	return &net.OpError{Op: "splice", Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: os.NewSyscallError("splice", err)}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errSpliceUnsupported makes Pipe fall back to copying through user space
+var errSpliceUnsupported = errors.New("splice not supported")
+
+// spliceConn is only implemented on Linux
+func spliceConn(ctx context.Context, src, dst *net.TCPConn, buckets []*TokenBucket, counters []ByteCounter) error {
+	return errSpliceUnsupported
+}
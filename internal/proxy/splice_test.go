@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatalf("Dial failed: %v", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		tb.Fatal("Accept failed")
+	}
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// plainConn hides the *net.TCPConn so that Pipe copies through user space
+type plainConn struct {
+	net.Conn
+}
+
+func TestPipe_TCPCountsBytes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{"Splice", func(c net.Conn) net.Conn { return c }},
+		{"Copy", func(c net.Conn) net.Conn { return plainConn{c} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, proxySide := tcpPair(t)
+			remote, server := tcpPair(t)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			counter := &byteCount{}
+			result := make(chan error, 1)
+			go func() {
+				result <- Pipe(context.Background(), tt.wrap(proxySide), tt.wrap(remote), &wg, nil, counter)
+			}()
+
+			const size = 1 << 20
+			go func() {
+				_, _ = client.Write(make([]byte, size))
+				_ = client.Close()
+			}()
+			received, err := io.Copy(io.Discard, server)
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			wg.Wait()
+
+			if received != size || counter.n.Load() != size {
+				t.Errorf("Expected %d bytes received and counted, got %d and %d", size, received, counter.n.Load())
+			}
+			if err := <-result; !errors.Is(err, io.EOF) {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPipe_HalfClose(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wrap func(*net.TCPConn) net.Conn
+	}{
+		{"Splice", func(c *net.TCPConn) net.Conn { return c }},
+		{"Copy", func(c *net.TCPConn) net.Conn { return struct{ *net.TCPConn }{c} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, proxySide := tcpPair(t)
+			remote, server := tcpPair(t)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			result := make(chan error, 1)
+			go func() {
+				result <- Pipe(context.Background(), tt.wrap(proxySide), tt.wrap(remote), &wg, nil)
+			}()
+
+			// Send a request and shut down writing like nc -N
+			if _, err := client.Write([]byte("request")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := client.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite failed: %v", err)
+			}
+			request, err := io.ReadAll(server)
+			if err != nil || string(request) != "request" {
+				t.Fatalf("Expected the request and EOF, got %q, %v", request, err)
+			}
+			wg.Wait()
+			if err := <-result; !errors.Is(err, io.EOF) {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+
+			// The response still travels the other way
+			if _, err := server.Write([]byte("response")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			response := make([]byte, len("response"))
+			if _, err := io.ReadFull(remote, response); err != nil {
+				t.Fatalf("Expected the remote connection to stay open: %v", err)
+			}
+			if _, err := proxySide.Write(response); err != nil {
+				t.Fatalf("Expected the client connection to stay open: %v", err)
+			}
+			if _, err := io.ReadFull(client, response); err != nil || string(response) != "response" {
+				t.Errorf("Expected the response, got %q, %v", response, err)
+			}
+		})
+	}
+}
+
+func TestPipe_TCPDeadline(t *testing.T) {
+	_, proxySide := tcpPair(t)
+	remote, _ := tcpPair(t)
+	if err := proxySide.SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("SetDeadline failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	result := make(chan error, 1)
+	go func() {
+		result <- Pipe(context.Background(), proxySide, remote, &wg, nil)
+	}()
+
+	select {
+	case err := <-result:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pipe ignored the deadline")
+	}
+}
+
+func benchmarkPipe(b *testing.B, wrap func(net.Conn) net.Conn) {
+	client, proxySide := tcpPair(b)
+	remote, server := tcpPair(b)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		_ = Pipe(context.Background(), wrap(proxySide), wrap(remote), &wg, nil, &byteCount{})
+	}()
+
+	const chunk = 128 * 1024
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, server)
+		done <- n
+	}()
+
+	buf := make([]byte, chunk)
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+	}
+	_ = client.Close()
+	if n := <-done; n != int64(b.N)*chunk {
+		b.Fatalf("Expected %d bytes, got %d", int64(b.N)*chunk, n)
+	}
+	b.StopTimer()
+	wg.Wait()
+}
+
+func BenchmarkPipe_Splice(b *testing.B) {
+	benchmarkPipe(b, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkPipe_Copy(b *testing.B) {
+	benchmarkPipe(b, func(c net.Conn) net.Conn { return plainConn{c} })
+}
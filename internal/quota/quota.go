@@ -0,0 +1,285 @@
+// Package quota accounts the bytes relayed per quota and period and keeps
+// the usage in a state file across restarts.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota periods
+const (
+	PERIOD_DAILY   = "daily"
+	PERIOD_MONTHLY = "monthly"
+)
+
+// STATE_VERSION is written to the state file to detect incompatible formats
+const STATE_VERSION = 1
+
+// PeriodKey returns the period t falls into, e.g. 2026-10-18 for daily
+// quotas and 2026-10 for monthly ones. Periods start at local midnight.
+func PeriodKey(period string, t time.Time) string {
+	if period == PERIOD_MONTHLY {
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// Counter is the usage of a quota in the current period. It satisfies
+// proxy.ByteCounter.
+type Counter struct {
+	bytes atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	c.bytes.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.bytes.Load()
+}
+
+// Usage is the state of one quota
+type Usage struct {
+	Group  string `json:"group"`
+	Client string `json:"client,omitempty"` // empty for a quota shared by the group
+	Period string `json:"period"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+type key struct {
+	group, client string
+}
+
+type entry struct {
+	period  string
+	counter *Counter
+}
+
+type stateFile struct {
+	Version int     `json:"version"`
+	Usage   []Usage `json:"usage"`
+}
+
+// Store holds the counters of all quotas
+type Store struct {
+	path string // empty keeps the usage in memory only
+
+	mu      sync.Mutex
+	entries map[key]*entry
+}
+
+// Open loads the usage saved in path. A missing file starts with no usage.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[key]*entry)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid quota state %s: %w", path, err)
+	}
+	if state.Version != STATE_VERSION {
+		return nil, fmt.Errorf("unsupported quota state version %d in %s", state.Version, path)
+	}
+	for _, u := range state.Usage {
+		e := &entry{period: u.Period, counter: &Counter{}}
+		e.counter.Add(u.Bytes)
+		s.entries[key{u.Group, u.Client}] = e
+	}
+	return s, nil
+}
+
+// Path returns the state file, empty if the usage is not saved
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Counter returns the counter of a quota in period. The counter starts
+// again at 0 when the period changes; connections holding it keep
+// counting into the new period.
+func (s *Store) Counter(group, client, period string) *Counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[key{group, client}]
+	if e == nil {
+		e = &entry{period: period, counter: &Counter{}}
+		s.entries[key{group, client}] = e
+	}
+	if e.period != period {
+		e.period = period
+		e.counter.bytes.Store(0)
+	}
+	return e.counter
+}
+
+// Usage returns the usage of all quotas sorted by group and client
+func (s *Store) Usage() []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Usage, 0, len(s.entries))
+	for k, e := range s.entries {
+		result = append(result, Usage{Group: k.group, Client: k.client, Period: e.period, Bytes: e.counter.Value()})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Group != result[j].Group {
+			return result[i].Group < result[j].Group
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// Reset sets the usage of a group to 0, only for client if it is not
+// empty. It returns the number of quotas reset.
+func (s *Store) Reset(group, client string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reset := 0
+	for k, e := range s.entries {
+		if k.group == group && (client == "" || k.client == client) {
+			e.counter.bytes.Store(0)
+			reset++
+		}
+	}
+	return reset
+}
+
+// Save writes the usage to the state file. The file is replaced atomically
+// so a crash leaves the previous state.
+func (s *Store) Save() error {
+	_, err := s.SaveSnapshot()
+	return err
+}
+
+// SaveSnapshot saves the usage like Save and returns the saved usage, the
+// base of Handoff
+func (s *Store) SaveSnapshot() ([]Usage, error) {
+	usage := s.Usage()
+	if s.path == "" {
+		return usage, nil
+	}
+	return usage, writeState(s.path, usage)
+}
+
+// Handoff writes the usage added since base to a handoff file next to the
+// state file, for the process that took over the state file after base
+// was saved. That process adds it with LoadHandoffs.
+func (s *Store) Handoff(base []Usage) error {
+	if s.path == "" {
+		return nil
+	}
+	saved := make(map[key]Usage, len(base))
+	for _, u := range base {
+		saved[key{u.Group, u.Client}] = u
+	}
+	var added []Usage
+	for _, u := range s.Usage() {
+		// A reset or a new period starts from 0 again
+		if b, ok := saved[key{u.Group, u.Client}]; ok && b.Period == u.Period && b.Bytes <= u.Bytes {
+			u.Bytes -= b.Bytes
+		}
+		if u.Bytes > 0 {
+			added = append(added, u)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	return writeState(s.path+".handoff."+strconv.Itoa(os.Getpid()), added)
+}
+
+// LoadHandoffs adds the usage of the handoff files to the store and removes
+// the files. Usage of a period older than the current one is ignored.
+func (s *Store) LoadHandoffs() error {
+	if s.path == "" {
+		return nil
+	}
+	files, err := filepath.Glob(s.path + ".handoff.*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := strconv.Atoi(strings.TrimPrefix(file, s.path+".handoff.")); err != nil {
+			// Temporary file of a handoff being written
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var state stateFile
+		if err := json.Unmarshal(data, &state); err != nil || state.Version != STATE_VERSION {
+			return fmt.Errorf("invalid quota handoff %s", file)
+		}
+		s.add(state.Usage)
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds usage to the counters of the same period
+func (s *Store) add(usage []Usage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range usage {
+		e := s.entries[key{u.Group, u.Client}]
+		switch {
+		case e == nil:
+			e = &entry{period: u.Period, counter: &Counter{}}
+			s.entries[key{u.Group, u.Client}] = e
+		case e.period < u.Period:
+			// Period keys of the same kind sort by time
+			e.period = u.Period
+			e.counter.bytes.Store(0)
+		case e.period > u.Period:
+			continue
+		}
+		e.counter.Add(u.Bytes)
+	}
+}
+
+// writeState replaces path atomically with usage
+func writeState(path string, usage []Usage) error {
+	data, err := json.MarshalIndent(stateFile{Version: STATE_VERSION, Usage: usage}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,148 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeriodKey(t *testing.T) {
+	now := time.Date(2026, 10, 18, 23, 59, 0, 0, time.Local)
+	if got := PeriodKey(PERIOD_DAILY, now); got != "2026-10-18" {
+		t.Errorf("Expected 2026-10-18, got %s", got)
+	}
+	if got := PeriodKey(PERIOD_MONTHLY, now); got != "2026-10" {
+		t.Errorf("Expected 2026-10, got %s", got)
+	}
+}
+
+func TestStore_CounterPeriod(t *testing.T) {
+	s, err := Open("")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	c := s.Counter("guests", "192.168.50.7", "2026-10-18")
+	c.Add(100)
+	if same := s.Counter("guests", "192.168.50.7", "2026-10-18"); same != c || same.Value() != 100 {
+		t.Error("Expected the same counter within a period")
+	}
+	if other := s.Counter("guests", "192.168.50.8", "2026-10-18"); other.Value() != 0 {
+		t.Error("Expected another client to have its own counter")
+	}
+
+	// A new period starts at 0, connections holding the counter keep counting
+	next := s.Counter("guests", "192.168.50.7", "2026-10-19")
+	if next != c || next.Value() != 0 {
+		t.Errorf("Expected the counter to be reset for a new period, got %d", next.Value())
+	}
+}
+
+func TestStore_SaveAndOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open of a missing file failed: %v", err)
+	}
+	s.Counter("guests", "192.168.50.7", "2026-10-18").Add(1500)
+	s.Counter("office", "", "2026-10").Add(7)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	restored, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	usage := restored.Usage()
+	expected := []Usage{
+		{Group: "guests", Client: "192.168.50.7", Period: "2026-10-18", Bytes: 1500},
+		{Group: "office", Period: "2026-10", Bytes: 7},
+	}
+	if len(usage) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, usage)
+	}
+	for i := range expected {
+		if usage[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], usage[i])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Expected an unknown state version to fail")
+	}
+}
+
+func TestStore_Reset(t *testing.T) {
+	s, _ := Open("")
+	s.Counter("guests", "192.168.50.7", "2026-10-18").Add(10)
+	s.Counter("guests", "192.168.50.8", "2026-10-18").Add(20)
+	s.Counter("office", "", "2026-10-18").Add(30)
+
+	if n := s.Reset("guests", "192.168.50.7"); n != 1 {
+		t.Errorf("Expected 1 quota reset, got %d", n)
+	}
+	if v := s.Counter("guests", "192.168.50.8", "2026-10-18").Value(); v != 20 {
+		t.Errorf("Expected other clients to keep their usage, got %d", v)
+	}
+	if n := s.Reset("guests", ""); n != 2 {
+		t.Errorf("Expected the whole group to be reset, got %d", n)
+	}
+	if v := s.Counter("office", "", "2026-10-18").Value(); v != 30 {
+		t.Errorf("Expected other groups to keep their usage, got %d", v)
+	}
+}
+
+func TestStore_Handoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	old, _ := Open(path)
+	old.Counter("guests", "192.168.50.7", "2026-10-18").Add(100)
+	old.Counter("office", "", "2026-10-17").Add(40)
+	base, err := old.SaveSnapshot()
+	if err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	// The new process continues from the saved usage while the old one
+	// drains its connections
+	current, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	current.Counter("guests", "192.168.50.7", "2026-10-18").Add(10)
+	current.Counter("office", "", "2026-10-18").Add(5)
+
+	old.Counter("guests", "192.168.50.7", "2026-10-18").Add(50)
+	old.Counter("guests", "192.168.50.8", "2026-10-18").Add(30)
+	old.Counter("office", "", "2026-10-17").Add(7)
+	if err := old.Handoff(base); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	// A handoff still being written is left alone
+	tmp := path + ".handoff.1.tmp2"
+	if err := os.WriteFile(tmp, []byte("{"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := current.LoadHandoffs(); err != nil {
+		t.Fatalf("LoadHandoffs failed: %v", err)
+	}
+	if v := current.Counter("guests", "192.168.50.7", "2026-10-18").Value(); v != 160 {
+		t.Errorf("Expected the drained usage to be added, got %d", v)
+	}
+	if v := current.Counter("guests", "192.168.50.8", "2026-10-18").Value(); v != 30 {
+		t.Errorf("Expected the usage of a new client, got %d", v)
+	}
+	if v := current.Counter("office", "", "2026-10-18").Value(); v != 5 {
+		t.Errorf("Expected usage of an older period to be ignored, got %d", v)
+	}
+
+	files, _ := filepath.Glob(path + ".handoff.*")
+	if len(files) != 1 || files[0] != tmp {
+		t.Errorf("Expected the handoff to be removed, got %v", files)
+	}
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tproxy/internal/accesslog"
+	"tproxy/internal/config"
+	"tproxy/internal/logging"
+	"tproxy/internal/proxy"
+	"tproxy/internal/quota"
+)
+
+// reloadConfig reads the configuration file again and uses it for new
+// connections. Listener addresses are only applied on restart.
+func reloadConfig() (*config.Config, error) {
+	old := currentConfig.Load()
+	if old == nil {
+		return nil, fmt.Errorf("no configuration loaded")
+	}
+	notifySystemd("RELOADING=1")
+	defer notifySystemd("READY=1")
+
+	cfg, err := config.LoadConfig(old.Path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Listen != old.Listen || cfg.Metrics != old.Metrics || cfg.Admin != old.Admin {
+		slog.Warn("Listener settings changed, restart to apply them", "path", cfg.Path)
+	}
+	if cfg.Quotas.StateFile != old.Quotas.StateFile || cfg.Quotas.SaveInterval != old.Quotas.SaveInterval {
+		slog.Warn("Quota state settings changed, restart to apply them", "path", cfg.Path)
+	}
+	if cfg.FakeIP.Listen != old.FakeIP.Listen {
+		slog.Warn("Fake IP listener changed, restart to apply it", "path", cfg.Path)
+	}
+
+	// Everything that can fail is set up first, so a failed reload keeps
+	// the previous configuration as a whole
+	set, err := newResolverSet(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fakeIPState, err := newFakeIPState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var logOutput *logging.Output
+	if cfg.Logging.Level != old.Logging.Level || cfg.Logging.Format != old.Logging.Format || cfg.Logging.Output != old.Logging.Output {
+		if logOutput, err = logging.Open(cfg.Logging); err != nil {
+			return nil, err
+		}
+	}
+	accessLogChanged := cfg.Logging.AccessLog != old.Logging.AccessLog
+	var newAccessLog *accesslog.Logger
+	if accessLogChanged {
+		if newAccessLog, err = newAccessLogger(cfg.Logging.AccessLog); err != nil {
+			if logOutput != nil {
+				_ = logOutput.Close()
+			}
+			return nil, err
+		}
+	}
+
+	resolvers.Store(set)
+	fakeIPs.Store(fakeIPState)
+	if logOutput != nil {
+		logOutput.Use()
+	}
+	if accessLogChanged {
+		useAccessLog(newAccessLog)
+	}
+	currentConfig.Store(cfg)
+	slog.Info("Configuration reloaded", "path", cfg.Path, "rules", len(cfg.Rules))
+	return cfg, nil
+}
+
+// openAccessLog opens the configured access log and closes the previous one
+func openAccessLog(cfg config.AccessLogConfig) error {
+	logger, err := newAccessLogger(cfg)
+	if err != nil {
+		return err
+	}
+	useAccessLog(logger)
+	return nil
+}
+
+// newAccessLogger opens the configured access log, nil if it is disabled
+func newAccessLogger(cfg config.AccessLogConfig) (*accesslog.Logger, error) {
+	if cfg.Output == "" {
+		return nil, nil
+	}
+	rotate := accesslog.RotateOptions{
+		MaxSize:    int64(cfg.MaxSize) << 20,
+		MaxAge:     time.Duration(cfg.MaxAge) * time.Hour,
+		MaxBackups: cfg.MaxBackups,
+		Compress:   cfg.Compress,
+	}
+	return accesslog.Open(cfg.Output, cfg.Format, rotate)
+}
+
+// useAccessLog writes the access log records to logger, nil to none, and
+// closes the previous one
+func useAccessLog(logger *accesslog.Logger) {
+	if old := accessLog.Swap(logger); old != nil {
+		if err := old.Close(); err != nil {
+			// Log file close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
+		}
+	}
+}
+
+// reopenLogs opens the access log and the diagnostic log file again
+func reopenLogs() {
+	if logger := accessLog.Load(); logger != nil {
+		if err := logger.Reopen(); err != nil {
+			slog.Error("Failed to reopen access log", "error", err)
+		}
+	}
+	if cfg := currentConfig.Load(); cfg != nil {
+		if err := logging.Setup(cfg.Logging); err != nil {
+			slog.Error("Failed to reopen log", "error", err)
+		}
+	}
+	slog.Info("Log files reopened")
+}
+
+// listenAdmin opens the admin listener, a unix socket for "unix:/path"
+// addresses and TCP otherwise
+func listenAdmin(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove a socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		if closeErr := listener.Close(); closeErr != nil {
+			// Listener close errors are expected and can be safely ignored
+			_ = closeErr // explicitly ignore the error
+		}
+		return nil, err
+	}
+	return listener, nil
+}
+
+// newAdminHandler returns the JSON admin API:
+//
+//	GET    /connections       active connections
+//	DELETE /connections/{id}  close a connection
+//	GET    /rules             loaded rules with hit counts
+//	POST   /reload            reload the configuration file
+//	GET    /upstreams         upstream health, ?probe=1 also dials each upstream
+//	GET    /quotas            quota usage in the current period
+//	DELETE /quotas/{group}    reset the usage of a group, ?client=ip of one client
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", handleAdminConnections)
+	mux.HandleFunc("/connections/", handleAdminConnection)
+	mux.HandleFunc("/rules", handleAdminRules)
+	mux.HandleFunc("/reload", handleAdminReload)
+	mux.HandleFunc("/upstreams", handleAdminUpstreams)
+	mux.HandleFunc("/quotas", handleAdminQuotas)
+	mux.HandleFunc("/quotas/", handleAdminQuota)
+	return mux
+}
+
+type connectionJSON struct {
+	ID         uint64    `json:"id"`
+	Client     string    `json:"client"`
+	Host       string    `json:"host"`
+	Target     string    `json:"target"`
+	OriginalIP string    `json:"original_ip"`
+	Action     string    `json:"action"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Rule       int       `json:"rule"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+func handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	conns := connections.list()
+	result := make([]connectionJSON, 0, len(conns))
+	for _, c := range conns {
+		result = append(result, connectionJSON{
+			ID:         c.ID,
+			Client:     c.Client,
+			Host:       c.Host,
+			Target:     c.Target,
+			OriginalIP: c.OrigDst,
+			Action:     c.Action,
+			Upstream:   c.Upstream,
+			Rule:       c.Rule,
+			BytesIn:    c.BytesIn.Load(),
+			BytesOut:   c.BytesOut.Load(),
+			Started:    c.Started,
+			AgeSeconds: time.Since(c.Started).Seconds(),
+		})
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func handleAdminConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use DELETE to close a connection")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	if !connections.kill(id, accesslog.REASON_KILLED) {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("connection %d not found", id))
+		return
+	}
+	slog.Info("Connection closed through the admin API", "id", id)
+	writeAdminJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+type ruleJSON struct {
+	Index   int    `json:"index"`
+	Pattern string `json:"pattern"`
+	Proxy   string `json:"proxy"`
+	Hits    uint64 `json:"hits"`
+}
+
+func handleAdminRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	cfg := currentConfig.Load()
+	result := make([]ruleJSON, 0, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		result = append(result, ruleJSON{
+			Index:   i + 1,
+			Pattern: rule.Pattern,
+			Proxy:   rule.Proxy,
+			Hits:    rule.Hits(),
+		})
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	cfg, err := reloadConfig()
+	if err != nil {
+		slog.Error("Reload failed", "error", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"path": cfg.Path, "rules": len(cfg.Rules)})
+}
+
+type upstreamJSON struct {
+	Upstream string `json:"upstream"`
+	Used     bool   `json:"used"`
+	upstreamHealth
+	Probe *probeJSON `json:"probe,omitempty"`
+}
+
+type probeJSON struct {
+	OK     bool    `json:"ok"`
+	Millis float64 `json:"ms,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+func handleAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	cfg := currentConfig.Load()
+	probe := r.URL.Query().Get("probe") != ""
+	result := []upstreamJSON{}
+	for _, upstream := range configuredUpstreams(cfg) {
+		health, used := upstreams.get(upstream)
+		u := upstreamJSON{Upstream: upstream, Used: used, upstreamHealth: health}
+		if probe {
+			u.Probe = probeUpstream(upstream, cfg.Listen.Timeout, outboundOptions(cfg, upstream, nil))
+		}
+		result = append(result, u)
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// configuredUpstreams lists the upstream proxies of the rules, the quota
+// groups and the ECH policy in configuration order
+func configuredUpstreams(cfg *config.Config) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(action *config.ProxyAction) {
+		if action.Type != "PROXY" {
+			return
+		}
+		upstream := net.JoinHostPort(action.Host, strconv.Itoa(action.Port))
+		if !seen[upstream] {
+			seen[upstream] = true
+			result = append(result, upstream)
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+		add(rule.Action())
+	}
+	for i := range cfg.Quotas.Groups {
+		add(cfg.Quotas.Groups[i].ExceededAction())
+	}
+	if cfg.ECH.Policy == config.ECH_POLICY_UPSTREAM {
+		add(config.Rule{Proxy: cfg.ECH.Upstream}.Action())
+	}
+	return result
+}
+
+type quotaJSON struct {
+	Group     string `json:"group"`
+	Client    string `json:"client,omitempty"`
+	Period    string `json:"period"`
+	Bytes     uint64 `json:"bytes"`
+	Limit     uint64 `json:"limit"`
+	Exhausted bool   `json:"exhausted"`
+}
+
+func handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	cfg := currentConfig.Load()
+	result := []quotaJSON{}
+	if store := quotaStore.Load(); store != nil {
+		groups := make(map[string]*config.QuotaGroup)
+		for i := range cfg.Quotas.Groups {
+			groups[cfg.Quotas.Groups[i].Name] = &cfg.Quotas.Groups[i]
+		}
+		for _, usage := range store.Usage() {
+			group := groups[usage.Group]
+			if group == nil {
+				continue // removed from the configuration
+			}
+			// Usage of a past period starts again with the next connection
+			period := quota.PeriodKey(group.Period, time.Now())
+			if usage.Period != period {
+				usage.Period, usage.Bytes = period, 0
+			}
+			result = append(result, quotaJSON{
+				Group:     usage.Group,
+				Client:    usage.Client,
+				Period:    usage.Period,
+				Bytes:     usage.Bytes,
+				Limit:     group.LimitBytes,
+				Exhausted: usage.Bytes >= group.LimitBytes,
+			})
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func handleAdminQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "use DELETE to reset a quota")
+		return
+	}
+
+	group := strings.TrimPrefix(r.URL.Path, "/quotas/")
+	client := r.URL.Query().Get("client")
+	store := quotaStore.Load()
+	if store == nil || group == "" {
+		writeAdminError(w, http.StatusNotFound, "quota not found")
+		return
+	}
+	reset := store.Reset(group, client)
+	if reset == 0 {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("no usage of quota group %q", group))
+		return
+	}
+	slog.Info("Quota reset through the admin API", "group", group, "client", client)
+	saveQuotas()
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"group": group, "reset": reset})
+}
+
+// probeUpstream checks that a TCP connection to the upstream can be opened
+func probeUpstream(upstream string, timeout int, options proxy.DialOptions) *probeJSON {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(min(timeout, 5))*time.Second)
+	defer cancel()
+	conn, err := options.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return &probeJSON{Error: err.Error()}
+	}
+	if closeErr := conn.Close(); closeErr != nil {
+		// Connection close errors are expected and can be safely ignored
+		_ = closeErr // explicitly ignore the error
+	}
+	return &probeJSON{OK: true, Millis: float64(time.Since(start).Microseconds()) / 1000}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		// The client went away, nothing left to report
+		_ = err // explicitly ignore the error
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
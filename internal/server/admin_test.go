@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tproxy/internal/accesslog"
+	"tproxy/internal/config"
+)
+
+// adminRequest sends a request to the admin API and decodes the JSON reply
+func adminRequest(t *testing.T, method, path string, result interface{}) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if result != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+			t.Fatalf("Invalid JSON from %s %s: %v\n%s", method, path, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+func TestAdmin_ListAndKillConnection(t *testing.T) {
+	killed := make(chan struct{})
+	conn := connections.add(&activeConn{
+		Client: "192.168.1.2:40000",
+		Host:   "example.com",
+		Target: "example.com:443",
+		Action: "direct",
+		Rule:   1,
+		kill:   func() { close(killed) },
+	})
+	defer connections.remove(conn.ID)
+	conn.BytesIn.Add(100)
+	conn.BytesOut.Add(2000)
+
+	var list []connectionJSON
+	if code := adminRequest(t, http.MethodGet, "/connections", &list); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	var found *connectionJSON
+	for i := range list {
+		if list[i].ID == conn.ID {
+			found = &list[i]
+		}
+	}
+	if found == nil {
+		t.Fatalf("Connection %d not listed in %v", conn.ID, list)
+	}
+	if found.Host != "example.com" || found.BytesIn != 100 || found.BytesOut != 2000 || found.Action != "direct" {
+		t.Errorf("Unexpected connection %+v", *found)
+	}
+
+	path := fmt.Sprintf("/connections/%d", conn.ID)
+	if code := adminRequest(t, http.MethodDelete, path, nil); code != http.StatusOK {
+		t.Fatalf("Expected 200 closing the connection, got %d", code)
+	}
+	select {
+	case <-killed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+	if conn.killedBy() != accesslog.REASON_KILLED {
+		t.Error("Expected the connection to be marked as killed")
+	}
+
+	if code := adminRequest(t, http.MethodDelete, "/connections/999999999", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown connection, got %d", code)
+	}
+	if code := adminRequest(t, http.MethodDelete, "/connections/abc", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid id, got %d", code)
+	}
+}
+
+func TestAdmin_RulesAndReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	writeConfig("rules:\n  - pattern: \"admin-test\\\\.example\"\n    proxy: \"DROP\"\n")
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	previous := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previous)
+
+	var rules []ruleJSON
+	if code := adminRequest(t, http.MethodGet, "/rules", &rules); code != http.StatusOK || len(rules) != 1 {
+		t.Fatalf("Unexpected rules response %d: %v", code, rules)
+	}
+	if rules[0].Index != 1 || rules[0].Proxy != "DROP" || rules[0].Hits != 0 {
+		t.Errorf("Unexpected rule %+v", rules[0])
+	}
+
+	// A connection matching the rule counts as a hit
+	action, err := config.FindProxyForHost("admin-test.example", cfg.Rules)
+	if err != nil {
+		t.Fatalf("FindProxyForHost failed: %v", err)
+	}
+	proxyConnection("admin-test.example", 443, "192.0.2.1", 443, "192.168.1.2:40200", newMockConn(), action, nil, 30)
+	if code := adminRequest(t, http.MethodGet, "/rules", &rules); code != http.StatusOK || len(rules) != 1 || rules[0].Hits != 1 {
+		t.Errorf("Expected one hit, got %d %+v", code, rules)
+	}
+
+	writeConfig("rules:\n  - pattern: \".*\"\n    proxy: \"DIRECT\"\n  - pattern: \".*\"\n    proxy: \"DROP\"\n")
+	if code := adminRequest(t, http.MethodGet, "/reload", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET /reload, got %d", code)
+	}
+	if code := adminRequest(t, http.MethodPost, "/reload", nil); code != http.StatusOK {
+		t.Fatalf("Expected 200 for reload, got %d", code)
+	}
+	if n := len(currentConfig.Load().Rules); n != 2 {
+		t.Errorf("Expected 2 rules after reload, got %d", n)
+	}
+	// The counts of the reloaded rules start at zero
+	if code := adminRequest(t, http.MethodGet, "/rules", &rules); code != http.StatusOK || len(rules) != 2 || rules[0].Hits != 0 || rules[1].Hits != 0 {
+		t.Errorf("Expected no hits after reload, got %d %+v", code, rules)
+	}
+
+	// A broken file keeps the current configuration
+	writeConfig("rules: [")
+	if code := adminRequest(t, http.MethodPost, "/reload", nil); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an invalid config, got %d", code)
+	}
+	if n := len(currentConfig.Load().Rules); n != 2 {
+		t.Errorf("Expected the previous config to stay active, got %d rules", n)
+	}
+}
+
+func TestAdmin_Upstreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	upstream := listener.Addr().String()
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules: []config.Rule{
+			{Pattern: "a", Proxy: upstream},
+			{Pattern: "b", Proxy: "DIRECT"},
+			{Pattern: "c", Proxy: upstream},
+		},
+	}
+	previous := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previous)
+
+	upstreams.record(upstream, 20*time.Millisecond, nil)
+	upstreams.record(upstream, 0, fmt.Errorf("proxy connection failed: HTTP/1.1 502 Bad Gateway"))
+
+	var result []upstreamJSON
+	if code := adminRequest(t, http.MethodGet, "/upstreams?probe=1", &result); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(result) != 1 {
+		t.Fatalf("Expected the upstream to be listed once, got %v", result)
+	}
+	u := result[0]
+	if u.Upstream != upstream || !u.Used || u.Successes != 1 || u.ConsecutiveFailures != 1 || u.LastError == "" {
+		t.Errorf("Unexpected upstream health %+v", u)
+	}
+	if u.Probe == nil || !u.Probe.OK {
+		t.Errorf("Expected a successful probe, got %+v", u.Probe)
+	}
+}
+
+func TestReloadConfig_FailedReloadKeepsEverything(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("rules: []\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	previousConfig := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previousConfig)
+	useFakeIPs(t, cfg)
+	set := resolvers.Load()
+
+	// New DNS servers with an access log that cannot be opened
+	content := "dns:\n  servers: [\"udp://192.0.2.53:53\"]\n" +
+		"logging:\n  access_log:\n    output: \"" + filepath.Join(dir, "missing", "access.log") + "\"\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := reloadConfig(); err == nil {
+		t.Fatal("Expected the reload to fail")
+	}
+	if currentConfig.Load() != cfg {
+		t.Error("Expected the previous configuration to stay active")
+	}
+	if resolvers.Load() != set {
+		t.Error("Expected the previous resolvers to stay active")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"tproxy/internal/config"
+	"tproxy/internal/proxy"
+)
+
+var bandwidth = newBandwidthBuckets()
+
+// bandwidthBuckets holds the token buckets of the bandwidth limits. A
+// bucket is shared by the connections of a client, or of all clients for
+// shared limits, and removed when its last connection ends.
+type bandwidthBuckets struct {
+	mu      sync.Mutex
+	buckets map[bucketKey]*sharedBucket
+}
+
+// bucketKey identifies a bucket. The rate is part of the key, so a reload
+// with a new rate starts new buckets.
+type bucketKey struct {
+	rule     *config.BandwidthLimit // limit of a loaded rule, nil for other scopes
+	scope    string                 // client networks or upstream of other limits
+	owner    string                 // client IP, or "all" for shared limits
+	download bool
+	rate     int64
+}
+
+type sharedBucket struct {
+	bucket *proxy.TokenBucket
+	refs   int
+}
+
+func newBandwidthBuckets() *bandwidthBuckets {
+	return &bandwidthBuckets{buckets: make(map[bucketKey]*sharedBucket)}
+}
+
+// acquire returns the upload and download buckets of a connection from the
+// limits of its rule, its client network and its upstream. The returned
+// function releases them when the connection ends.
+func (b *bandwidthBuckets) acquire(cfg *config.Config, action *config.ProxyAction, clientIP, upstream string) ([]*proxy.TokenBucket, []*proxy.TokenBucket, func()) {
+	type scopedLimit struct {
+		rule  *config.BandwidthLimit
+		scope string
+		limit *config.BandwidthLimit
+	}
+	var limits []scopedLimit
+	if action.Bandwidth != nil {
+		// Each loaded rule has its own limit, so connections of another
+		// rule at the same position after a reload get other buckets
+		limits = append(limits, scopedLimit{action.Bandwidth, "", action.Bandwidth})
+	}
+	if cfg != nil {
+		if clients := cfg.Bandwidth.FindClientBandwidth(clientIP); clients != nil {
+			limits = append(limits, scopedLimit{nil, "clients " + strings.Join(clients.Networks, ","), &clients.BandwidthLimit})
+		}
+		if limit, ok := cfg.Bandwidth.Upstreams[upstream]; ok && upstream != "" {
+			limits = append(limits, scopedLimit{nil, "upstream " + upstream, &limit})
+		}
+	}
+	if len(limits) == 0 {
+		return nil, nil, func() {}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var upload, download []*proxy.TokenBucket
+	var keys []bucketKey
+	for _, l := range limits {
+		owner := clientIP
+		if l.limit.Shared {
+			owner = "all"
+		}
+		if l.limit.UploadRate > 0 {
+			key := bucketKey{rule: l.rule, scope: l.scope, owner: owner, rate: l.limit.UploadRate}
+			upload = append(upload, b.get(key))
+			keys = append(keys, key)
+		}
+		if l.limit.DownloadRate > 0 {
+			key := bucketKey{rule: l.rule, scope: l.scope, owner: owner, download: true, rate: l.limit.DownloadRate}
+			download = append(download, b.get(key))
+			keys = append(keys, key)
+		}
+	}
+
+	return upload, download, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, key := range keys {
+			shared := b.buckets[key]
+			shared.refs--
+			if shared.refs == 0 {
+				delete(b.buckets, key)
+			}
+		}
+	}
+}
+
+// get returns the bucket for key, creating it with the rate of the key.
+// b.mu must be held.
+func (b *bandwidthBuckets) get(key bucketKey) *proxy.TokenBucket {
+	shared := b.buckets[key]
+	if shared == nil {
+		shared = &sharedBucket{bucket: proxy.NewTokenBucket(key.rate)}
+		b.buckets[key] = shared
+	}
+	shared.refs++
+	return shared.bucket
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"testing"
+
+	"tproxy/internal/config"
+)
+
+func TestBandwidthBuckets_Sharing(t *testing.T) {
+	b := newBandwidthBuckets()
+	cfg := &config.Config{Bandwidth: config.BandwidthConfig{
+		Clients: []config.ClientBandwidth{{
+			Networks:       []string{"192.168.50.0/24"},
+			BandwidthLimit: config.BandwidthLimit{UploadRate: 1000, DownloadRate: 2000},
+		}},
+		Upstreams: map[string]config.BandwidthLimit{
+			"proxy.corp:8080": {DownloadRate: 10000, Shared: true},
+		},
+	}}
+	action := &config.ProxyAction{Type: "PROXY", Rule: 1}
+
+	upload1, download1, release1 := b.acquire(cfg, action, "192.168.50.7", "proxy.corp:8080")
+	upload2, download2, release2 := b.acquire(cfg, action, "192.168.50.7", "proxy.corp:8080")
+	upload3, download3, release3 := b.acquire(cfg, action, "192.168.50.8", "proxy.corp:8080")
+
+	if len(upload1) != 1 || len(download1) != 2 {
+		t.Fatalf("Expected 1 upload and 2 download buckets, got %d and %d", len(upload1), len(download1))
+	}
+	// Connections of a client share its buckets
+	if upload1[0] != upload2[0] || download1[0] != download2[0] {
+		t.Error("Expected the connections of a client to share buckets")
+	}
+	// Other clients get their own, except for shared limits
+	if upload1[0] == upload3[0] || download1[0] == download3[0] {
+		t.Error("Expected another client to get its own buckets")
+	}
+	if download1[1] != download3[1] {
+		t.Error("Expected a shared limit to use one bucket for all clients")
+	}
+
+	release1()
+	release2()
+	release3()
+	if len(b.buckets) != 0 {
+		t.Errorf("Expected buckets to be removed with their connections, %d left", len(b.buckets))
+	}
+
+	// Without limits no buckets are used
+	upload, download, release := b.acquire(cfg, &config.ProxyAction{Type: "DIRECT"}, "10.0.0.1", "")
+	release()
+	if upload != nil || download != nil {
+		t.Error("Expected no buckets without a matching limit")
+	}
+}
+
+func TestBandwidthBuckets_RuleLimit(t *testing.T) {
+	b := newBandwidthBuckets()
+	limit := &config.BandwidthLimit{DownloadRate: 5000}
+	action := &config.ProxyAction{Type: "DIRECT", Rule: 2, Bandwidth: limit}
+
+	// Works without a loaded configuration
+	upload, download, release := b.acquire(nil, action, "10.0.0.1", "")
+	defer release()
+	if len(upload) != 0 || len(download) != 1 {
+		t.Errorf("Expected one download bucket for the rule, got %d and %d", len(upload), len(download))
+	}
+}
+
+func TestBandwidthBuckets_RuleReload(t *testing.T) {
+	b := newBandwidthBuckets()
+	limit := &config.BandwidthLimit{DownloadRate: 5000, Shared: true}
+	_, first, release := b.acquire(nil, &config.ProxyAction{Type: "DIRECT", Rule: 1, Bandwidth: limit}, "10.0.0.1", "")
+	defer release()
+	_, same, release := b.acquire(nil, &config.ProxyAction{Type: "DIRECT", Rule: 1, Bandwidth: limit}, "10.0.0.2", "")
+	defer release()
+	if first[0] != same[0] {
+		t.Error("Expected connections of the same rule to share the bucket")
+	}
+
+	// Another rule moved to the same position by a reload, with the same rate
+	other := &config.BandwidthLimit{DownloadRate: 5000, Shared: true}
+	_, moved, release := b.acquire(nil, &config.ProxyAction{Type: "DIRECT", Rule: 1, Bandwidth: other}, "10.0.0.1", "")
+	defer release()
+	if moved[0] == first[0] {
+		t.Error("Expected another rule at the same position to get its own bucket")
+	}
+}
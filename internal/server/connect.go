@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/proxy"
+)
+
+// lookupTimeout bounds the lookup of connect_to: resolve
+const lookupTimeout = 5 * time.Second
+
+// connectTarget returns the host and port a DIRECT connection is opened
+// to for the rule's connect_to mode: the target name and port, or the
+// original destination IP and port, which is empty if it is unknown
+func connectTarget(mode, host string, port int, originalIP string, originalPort int, resolver proxy.HostResolver, logger *slog.Logger) (string, int) {
+	if originalIP == "" || host == originalIP {
+		return host, port
+	}
+	switch mode {
+	case config.CONNECT_TO_ORIGINAL_IP:
+		return originalIP, originalPort
+	case config.CONNECT_TO_RESOLVE:
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		resolves, err := resolvesTo(ctx, resolver, host, originalIP)
+		if err != nil {
+			logger.Debug("Lookup of the target failed", "target", host, "error", err)
+		}
+		if resolves {
+			return originalIP, originalPort
+		}
+	}
+	return host, port
+}
+
+// resolvesTo reports whether host has ip among its addresses, looked up
+// with resolver or, if it is nil, the system resolver
+func resolvesTo(ctx context.Context, resolver proxy.HostResolver, host, ip string) (bool, error) {
+	var ips []net.IP
+	var err error
+	if resolver != nil {
+		ips, err = resolver.LookupIP(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return false, err
+	}
+	want := net.ParseIP(ip)
+	for _, candidate := range ips {
+		if candidate.Equal(want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"tproxy/internal/config"
+)
+
+// staticHostResolver answers lookups from a map
+type staticHostResolver map[string][]net.IP
+
+func (r staticHostResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func TestConnectTarget(t *testing.T) {
+	resolver := staticHostResolver{
+		"cdn.example.com":   {net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.20")},
+		"other.example.com": {net.ParseIP("198.51.100.1")},
+	}
+	tests := []struct {
+		name       string
+		mode       string
+		host       string
+		originalIP string
+		expected   string
+	}{
+		{"Default", "", "cdn.example.com", "192.0.2.20", "cdn.example.com:443"},
+		{"SNI", config.CONNECT_TO_SNI, "cdn.example.com", "192.0.2.20", "cdn.example.com:443"},
+		{"OriginalIP", config.CONNECT_TO_ORIGINAL_IP, "cdn.example.com", "192.0.2.20", "192.0.2.20:8443"},
+		{"OriginalIPUnknown", config.CONNECT_TO_ORIGINAL_IP, "cdn.example.com", "", "cdn.example.com:443"},
+		{"ResolveMatches", config.CONNECT_TO_RESOLVE, "cdn.example.com", "192.0.2.20", "192.0.2.20:8443"},
+		{"ResolveDiffers", config.CONNECT_TO_RESOLVE, "other.example.com", "192.0.2.20", "other.example.com:443"},
+		{"ResolveFails", config.CONNECT_TO_RESOLVE, "missing.example.com", "192.0.2.20", "missing.example.com:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port := connectTarget(tt.mode, tt.host, 443, tt.originalIP, 8443, resolver, slog.Default())
+			if got := net.JoinHostPort(host, strconv.Itoa(port)); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyConnection_ConnectToOriginalIP(t *testing.T) {
+	echo := startEchoServer(t)
+	rules := []config.Rule{{Pattern: ".*", Proxy: "DIRECT", ConnectTo: config.CONNECT_TO_ORIGINAL_IP}}
+	action, _ := config.FindProxyForHost("unresolvable.invalid", rules)
+
+	// The name is only used for routing, the connection goes to the
+	// original destination
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go func() {
+		proxyConnection("unresolvable.invalid", 443, "127.0.0.1", echo.Port, "192.168.1.2:40000", server, action, []byte("hello"), 5)
+		_ = server.Close()
+	}()
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	reply := make([]byte, len("hello"))
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected the echo from the original destination: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connBytes counts the bytes relayed in one direction of a connection. It
+// satisfies proxy.ByteCounter.
+type connBytes struct {
+	n atomic.Uint64
+}
+
+func (b *connBytes) Add(n uint64) {
+	b.n.Add(n)
+}
+
+func (b *connBytes) Load() uint64 {
+	return b.n.Load()
+}
+
+// activeConn is a relayed connection known to the registry
+type activeConn struct {
+	ID       uint64
+	Client   string
+	Host     string // SNI, Host header or original destination IP
+	Target   string // host:port requested from the remote side
+	OrigDst  string // original destination IP
+	Action   string
+	Upstream string
+	Rule     int
+	TLS      tlsFingerprint // empty without a TLS ClientHello
+	Started  time.Time
+
+	BytesIn  connBytes // from the client
+	BytesOut connBytes // to the client
+
+	kill       func()       // closes both sides of the connection
+	killReason atomic.Value // close reason, set when closed through the registry
+}
+
+// killedBy returns the close reason given to the registry, empty if the
+// connection was not closed through it
+func (c *activeConn) killedBy() string {
+	reason, _ := c.killReason.Load().(string)
+	return reason
+}
+
+// connRegistry tracks the connections relayed by proxyConnection
+type connRegistry struct {
+	nextID atomic.Uint64
+
+	mu    sync.Mutex // guards conns
+	conns map[uint64]*activeConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*activeConn)}
+}
+
+// newID returns a connection ID, unique for the lifetime of the process
+func (r *connRegistry) newID() uint64 {
+	return r.nextID.Add(1)
+}
+
+// add registers the connection, assigning an ID if it has none
+func (r *connRegistry) add(c *activeConn) *activeConn {
+	if c.ID == 0 {
+		c.ID = r.newID()
+	}
+	if c.Started.IsZero() {
+		c.Started = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.ID] = c
+	return c
+}
+
+func (r *connRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// list returns the registered connections ordered by ID
+func (r *connRegistry) list() []*activeConn {
+	r.mu.Lock()
+	conns := make([]*activeConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// kill closes the connection with the given ID and reports whether it
+// existed. reason is written to the access log.
+func (r *connRegistry) kill(id uint64, reason string) bool {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	c.killReason.Store(reason)
+	c.kill()
+	return true
+}
+
+// killAll closes all registered connections and returns how many there were
+func (r *connRegistry) killAll(reason string) int {
+	conns := r.list()
+	for _, c := range conns {
+		c.killReason.Store(reason)
+		c.kill()
+	}
+	return len(conns)
+}
+
+// upstreamHealth is what was last seen when connecting through an upstream
+type upstreamHealth struct {
+	Successes           uint64     `json:"successes"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures uint64     `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastDialMillis      float64    `json:"last_dial_ms,omitempty"`
+}
+
+// upstreamTracker records the outcome of CONNECT requests per upstream
+type upstreamTracker struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamHealth
+}
+
+func newUpstreamTracker() *upstreamTracker {
+	return &upstreamTracker{upstreams: make(map[string]*upstreamHealth)}
+}
+
+func (t *upstreamTracker) record(upstream string, dial time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.upstreams[upstream]
+	if !ok {
+		h = &upstreamHealth{}
+		t.upstreams[upstream] = h
+	}
+	now := time.Now()
+	if err != nil {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastFailure = &now
+		h.LastError = err.Error()
+		return
+	}
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.LastSuccess = &now
+	h.LastDialMillis = float64(dial.Microseconds()) / 1000
+}
+
+// get returns a copy of the health of an upstream and whether it was used
+func (t *upstreamTracker) get(upstream string) (upstreamHealth, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.upstreams[upstream]
+	if !ok {
+		return upstreamHealth{}, false
+	}
+	return *h, true
+}
+
+// clientTracker follows accepted client connections until their handler
+// returns, including those that are not relayed yet, so that shutdown can
+// wait for them and close what is left
+type clientTracker struct {
+	wg sync.WaitGroup
+
+	mu    sync.Mutex // guards conns
+	conns map[net.Conn]struct{}
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// track registers an accepted connection. done must be called when its
+// handler returns.
+func (t *clientTracker) track(conn net.Conn) (done func()) {
+	t.wg.Add(1)
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		t.wg.Done()
+	}
+}
+
+func (t *clientTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// wait waits up to timeout for all handlers to return and reports whether
+// they did
+func (t *clientTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// closeAll closes the client side of all tracked connections
+func (t *clientTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		if err := conn.Close(); err != nil {
+			// The handler may have closed it already
+			_ = err // explicitly ignore the error
+		}
+	}
+}
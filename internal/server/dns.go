@@ -0,0 +1,86 @@
+package server
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/dns"
+	"tproxy/internal/proxy"
+)
+
+// resolverSet holds the resolvers of outgoing connections by name, "" for
+// the default one
+type resolverSet struct {
+	dns      config.DNSConfig
+	outbound config.Outbound
+	byName   map[string]*dns.Resolver
+}
+
+// resolvers is nil until the first configuration was applied
+var resolvers atomic.Pointer[resolverSet]
+
+// applyDNSConfig builds the resolvers of cfg. They are kept, with their
+// caches, if the dns section and the outbound defaults did not change.
+func applyDNSConfig(cfg *config.Config) error {
+	set, err := newResolverSet(cfg)
+	if err != nil {
+		return err
+	}
+	resolvers.Store(set)
+	return nil
+}
+
+// newResolverSet returns the resolvers of cfg, the current ones if the
+// dns section and the outbound defaults did not change
+func newResolverSet(cfg *config.Config) (*resolverSet, error) {
+	if old := resolvers.Load(); old != nil && reflect.DeepEqual(old.dns, cfg.DNS) && old.outbound == cfg.Outbound.Outbound {
+		return old, nil
+	}
+
+	// Queries to the servers leave like other outgoing connections, with
+	// server host names resolved by the system
+	outbound := cfg.Outbound.Outbound
+	dial := proxy.DialOptions{Mark: outbound.Mark, Interface: outbound.Interface, SourceAddress: outbound.SourceAddress}.DialContext
+
+	options := func(name string, servers []string) dns.Options {
+		return dns.Options{
+			Name:      name,
+			Servers:   servers,
+			Hosts:     cfg.DNS.Hosts,
+			Timeout:   time.Duration(cfg.DNS.Timeout) * time.Second,
+			CacheSize: max(cfg.DNS.CacheSize, 0),
+			Dial:      dial,
+		}
+	}
+	set := &resolverSet{dns: cfg.DNS, outbound: outbound, byName: make(map[string]*dns.Resolver)}
+	var err error
+	if len(cfg.DNS.Servers) > 0 || len(cfg.DNS.Hosts) > 0 {
+		if set.byName[""], err = dns.New(options("", cfg.DNS.Servers)); err != nil {
+			return nil, err
+		}
+	}
+	for name, resolver := range cfg.DNS.Resolvers {
+		if set.byName[name], err = dns.New(options(name, resolver.Servers)); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// hostResolver returns the resolver for a rule, nil to dial with the
+// system resolver
+func hostResolver(name string) proxy.HostResolver {
+	set := resolvers.Load()
+	if set == nil {
+		return nil
+	}
+	if r, ok := set.byName[name]; ok {
+		return r
+	}
+	if r, ok := set.byName[""]; ok {
+		return r
+	}
+	return nil
+}
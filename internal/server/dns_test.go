@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tproxy/internal/accesslog"
+	"tproxy/internal/config"
+)
+
+func TestProxyConnection_DNSHosts(t *testing.T) {
+	echo := startEchoServer(t)
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules: []config.Rule{
+			{Pattern: "^intranet\\.test$", Proxy: "DIRECT", Resolver: "corp"},
+			{Pattern: ".*", Proxy: "DIRECT"},
+		},
+		DNS: config.DNSConfig{
+			Hosts: map[string][]string{"echo.test": {"127.0.0.1"}},
+			// Answers nothing, so lookups through it fail
+			Resolvers: map[string]config.DNSResolver{"corp": {Servers: []string{"127.0.0.1:1"}}},
+			Timeout:   1,
+		},
+	}
+	previousConfig := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previousConfig)
+	previousResolvers := resolvers.Load()
+	defer resolvers.Store(previousResolvers)
+	if err := applyDNSConfig(cfg); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+
+	// Static hosts are known to every resolver
+	for _, host := range []string{"echo.test", "intranet.test"} {
+		action, _ := config.FindProxyForHost(host, cfg.Rules)
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			proxyConnection("echo.test", echo.Port, "", echo.Port, "192.168.1.2:40000", server, action, []byte("hello"), 5)
+			_ = server.Close()
+			close(done)
+		}()
+
+		if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("Failed to set deadline: %v", err)
+		}
+		reply := make([]byte, len("hello"))
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("%s: expected the echo through the static address: %v", host, err)
+		}
+		_ = client.Close()
+		<-done
+	}
+
+	// Other names go to the rule's resolver
+	buf := captureAccessLog(t)
+	action, _ := config.FindProxyForHost("intranet.test", cfg.Rules)
+	proxyConnection("intranet.test", echo.Port, "", echo.Port, "192.168.1.3:40000", newMockConn(), action, nil, 5)
+	records := buf.records(t, "192.168.1.3:40000")
+	if len(records) != 1 || records[0].CloseReason != accesslog.REASON_DIAL_ERROR {
+		t.Errorf("Expected the lookup through the rule's resolver to fail, got %+v", records)
+	}
+}
+
+func TestApplyDNSConfig_KeepsResolvers(t *testing.T) {
+	previous := resolvers.Load()
+	defer resolvers.Store(previous)
+
+	cfg := &config.Config{DNS: config.DNSConfig{Servers: []string{"192.0.2.53"}, Timeout: 5}}
+	if err := applyDNSConfig(cfg); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+	first := hostResolver("")
+	if first == nil {
+		t.Fatal("Expected a default resolver")
+	}
+
+	// An unchanged dns section keeps the resolvers and their caches
+	same := *cfg
+	if err := applyDNSConfig(&same); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+	if hostResolver("") != first {
+		t.Error("Expected the resolver to be kept")
+	}
+
+	if err := applyDNSConfig(&config.Config{}); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+	if hostResolver("") != nil {
+		t.Error("Expected the system resolver without a dns section")
+	}
+	if err := applyDNSConfig(&config.Config{DNS: config.DNSConfig{Servers: []string{"quic://192.0.2.53"}}}); err == nil {
+		t.Error("Expected an error for an invalid server")
+	}
+}
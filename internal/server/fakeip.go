@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/dns"
+	"tproxy/internal/metrics"
+)
+
+// dnsIdleTimeout closes TCP connections of DNS clients without queries
+const dnsIdleTimeout = 10 * time.Second
+
+// maxDNSQueries is the most UDP queries answered at once, further ones are
+// dropped and retried by their clients
+const maxDNSQueries = 128
+
+// errUnknownFakeIP is returned for a fake IP without a host name, e.g. one
+// handed out before a restart
+var errUnknownFakeIP = errors.New("fake IP was not handed out")
+
+// fakeIPState is the pool of the fake IP DNS server and how it answers
+type fakeIPState struct {
+	config  config.FakeIPConfig
+	handler *dns.FakeIPHandler
+}
+
+// fakeIPs is nil without fake_ip.listen
+var fakeIPs atomic.Pointer[fakeIPState]
+
+// applyFakeIPConfig sets up the fake IP pool of cfg. The names of the
+// handed out addresses are kept if the pool did not change.
+func applyFakeIPConfig(cfg *config.Config) error {
+	state, err := newFakeIPState(cfg)
+	if err != nil {
+		return err
+	}
+	fakeIPs.Store(state)
+	return nil
+}
+
+// newFakeIPState returns the fake IP pool of cfg, nil without
+// fake_ip.listen
+func newFakeIPState(cfg *config.Config) (*fakeIPState, error) {
+	fakeIP := cfg.FakeIP
+	if fakeIP.Listen == "" {
+		return nil, nil
+	}
+
+	var pool *dns.FakeIPPool
+	if old := fakeIPs.Load(); old != nil && old.config.Pool == fakeIP.Pool {
+		pool = old.handler.Pool
+	} else {
+		var err error
+		if pool, err = dns.NewFakeIPPool(fakeIP.Pool); err != nil {
+			return nil, err
+		}
+	}
+	return &fakeIPState{
+		config: fakeIP,
+		handler: &dns.FakeIPHandler{
+			Pool:    pool,
+			TTL:     uint32(fakeIP.TTL),
+			Exclude: fakeIP.Excludes,
+			Forward: forwardQuery,
+		},
+	}, nil
+}
+
+// systemResolver answers forwarded queries without a dns section
+var systemResolver, _ = dns.New(dns.Options{})
+
+// forwardQuery answers queries for real addresses with the default resolver
+func forwardQuery(ctx context.Context, query []byte) ([]byte, error) {
+	if set := resolvers.Load(); set != nil {
+		if r, ok := set.byName[""]; ok {
+			return r.Exchange(ctx, query)
+		}
+	}
+	return systemResolver.Exchange(ctx, query)
+}
+
+// fakeIPHost returns the host name the fake IP ip was handed out for, ip
+// itself if it is not a fake IP
+func fakeIPHost(ip string) (string, error) {
+	state := fakeIPs.Load()
+	if state == nil {
+		return ip, nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !state.handler.Pool.Contains(parsed) {
+		return ip, nil
+	}
+	if name, ok := state.handler.Pool.Name(parsed); ok {
+		return name, nil
+	}
+	return "", errUnknownFakeIP
+}
+
+// answerDNS returns the response of the fake IP server to query
+func answerDNS(query []byte, udp bool) []byte {
+	state := fakeIPs.Load()
+	if state == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	return state.handler.Answer(ctx, query, udp)
+}
+
+// serveDNS answers queries on conn until it is closed or paused
+func serveDNS(conn *net.UDPConn) {
+	queries := make(chan struct{}, maxDNSQueries)
+	buf := make([]byte, dns.MAX_MESSAGE_SIZE)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			slog.Error("DNS read error", "error", err)
+			continue
+		}
+		select {
+		case queries <- struct{}{}:
+		default:
+			slog.Debug("DNS query dropped, too many queries", "client", client.String())
+			metrics.FakeIPQueries.WithLabelValues("dropped").Inc()
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			response := answerDNS(query, true)
+			<-queries
+			if response != nil {
+				if _, err := conn.WriteToUDP(response, client); err != nil {
+					slog.Debug("DNS write error", "client", client.String(), "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// serveDNSTCP answers length-prefixed queries on the connections of
+// listener until it is closed or paused
+func serveDNSTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			slog.Error("Accept error", "listener", "dns-tcp", "error", err)
+			continue
+		}
+		go handleDNSClient(conn)
+	}
+}
+
+func handleDNSClient(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			// Connection close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
+		}
+	}()
+
+	var length [2]byte
+	for {
+		if err := conn.SetDeadline(time.Now().Add(dnsIdleTimeout)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := answerDNS(query, false)
+		if response == nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/dns"
+	"tproxy/internal/metrics"
+)
+
+// useFakeIPs applies the fake_ip and dns sections of cfg for the test
+func useFakeIPs(t *testing.T, cfg *config.Config) {
+	t.Helper()
+	previousFakeIPs := fakeIPs.Load()
+	previousResolvers := resolvers.Load()
+	t.Cleanup(func() {
+		fakeIPs.Store(previousFakeIPs)
+		resolvers.Store(previousResolvers)
+	})
+	if err := applyDNSConfig(cfg); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+	if err := applyFakeIPConfig(cfg); err != nil {
+		t.Fatalf("applyFakeIPConfig failed: %v", err)
+	}
+}
+
+// lookupFake queries the address of name over UDP or TCP
+func lookupFake(t *testing.T, network, address, name string) net.IP {
+	t.Helper()
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+
+	query, err := dns.NewQuery(1, name, dns.TYPE_A).Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	response := make([]byte, dns.MAX_MESSAGE_SIZE)
+	var n int
+	if network == "tcp" {
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		n, err = io.ReadFull(conn, response[:binary.BigEndian.Uint16(length[:])])
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		n, err = conn.Read(response)
+	}
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	m, err := dns.Unpack(response[:n])
+	if err != nil || len(m.Answers) != 1 {
+		t.Fatalf("Expected one address, got %+v %v", m, err)
+	}
+	return net.IP(m.Answers[0].Data)
+}
+
+func TestFakeIPServer(t *testing.T) {
+	useFakeIPs(t, &config.Config{FakeIP: config.FakeIPConfig{Listen: "127.0.0.1:0", Pool: "198.18.0.0/15", TTL: 1}})
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = udpConn.Close()
+	}()
+	go serveDNS(udpConn)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go serveDNSTCP(listener)
+
+	ip := lookupFake(t, "udp", udpConn.LocalAddr().String(), "www.example.com")
+	if ip.String() != "198.18.0.1" {
+		t.Errorf("Expected a fake IP, got %s", ip)
+	}
+	if tcpIP := lookupFake(t, "tcp", listener.Addr().String(), "www.example.com"); !tcpIP.Equal(ip) {
+		t.Errorf("Expected the same fake IP over TCP, got %s", tcpIP)
+	}
+	if host, err := fakeIPHost(ip.String()); err != nil || host != "www.example.com" {
+		t.Errorf("Expected www.example.com, got %q %v", host, err)
+	}
+	if host, err := fakeIPHost("192.0.2.1"); err != nil || host != "192.0.2.1" {
+		t.Errorf("Expected other addresses to be kept, got %q %v", host, err)
+	}
+	if _, err := fakeIPHost("198.18.0.99"); err != errUnknownFakeIP {
+		t.Errorf("Expected an unknown fake IP, got %v", err)
+	}
+}
+
+func TestFakeIPServer_BoundsQueries(t *testing.T) {
+	// A DNS server that never answers holds the forwarded queries
+	blackhole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create UDP listener: %v", err)
+	}
+	defer func() {
+		_ = blackhole.Close()
+	}()
+	useFakeIPs(t, &config.Config{
+		DNS:    config.DNSConfig{Servers: []string{"udp://" + blackhole.LocalAddr().String()}, Timeout: 2},
+		FakeIP: config.FakeIPConfig{Listen: "127.0.0.1:0", Pool: "198.18.0.0/15", TTL: 1, Exclude: []string{`\.lan$`}},
+	})
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = udpConn.Close()
+	}()
+	go serveDNS(udpConn)
+
+	client, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	dropped := metrics.FakeIPQueries.WithLabelValues("dropped")
+	before := dropped.Value()
+	for i := 0; i <= maxDNSQueries; i++ {
+		query, err := dns.NewQuery(uint16(i), fmt.Sprintf("host%d.lan", i), dns.TYPE_A).Pack()
+		if err != nil {
+			t.Fatalf("Pack failed: %v", err)
+		}
+		if _, err := client.Write(query); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for dropped.Value() == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dropped.Value() - before; got != 1 {
+		t.Errorf("Expected the query over the limit to be dropped, got %d dropped", got)
+	}
+
+	// Queries are answered again once the forwarded ones time out
+	if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	response := make([]byte, dns.MAX_MESSAGE_SIZE)
+	for i := 0; i < maxDNSQueries; i++ {
+		if _, err := client.Read(response); err != nil {
+			t.Fatalf("Expected an answer to each forwarded query: %v", err)
+		}
+	}
+	if ip := lookupFake(t, "udp", udpConn.LocalAddr().String(), "www.example.com"); ip.String() != "198.18.0.1" {
+		t.Errorf("Expected a fake IP, got %s", ip)
+	}
+}
+
+func TestHandleSniffClient_FakeIP(t *testing.T) {
+	echo := startEchoServer(t)
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules: []config.Rule{
+			{Pattern: "^echo\\.test$", Proxy: "DIRECT"},
+			{Pattern: ".*", Proxy: "DROP"},
+		},
+		DNS:    config.DNSConfig{Hosts: map[string][]string{"echo.test": {"127.0.0.1"}}},
+		FakeIP: config.FakeIPConfig{Listen: "127.0.0.1:0", Pool: "198.18.0.0/15", TTL: 1},
+	}
+	previousConfig := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previousConfig)
+	useFakeIPs(t, cfg)
+	ip := fakeIPs.Load().handler.Pool.IP("echo.test")
+
+	// The rule for the name matches and the connection goes to its address
+	useResolver(t, staticResolver{ip: ip.String(), port: echo.Port})
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go handleSniffClient(server, cfg)
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := client.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected the connection to the recovered name to echo: %v", err)
+	}
+
+	// Fake IPs that were not handed out cannot be routed
+	useResolver(t, staticResolver{ip: "198.18.0.99", port: echo.Port})
+	client, server = net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go handleSniffClient(server, cfg)
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
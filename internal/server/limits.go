@@ -0,0 +1,218 @@
+package server
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+)
+
+// clientSweepInterval is how often clients without connections are forgotten
+const clientSweepInterval = time.Minute
+
+var limiter = newConnLimiter()
+
+// connLimiter enforces the connection limits of the advanced section on the
+// TCP listeners. Limits are read from the configuration of each connection,
+// so a reload applies to new connections.
+type connLimiter struct {
+	mu        sync.Mutex
+	active    int
+	clients   map[string]*clientLimit
+	released  chan struct{} // closed and replaced when a connection ends
+	lastSweep time.Time
+}
+
+// clientLimit holds the connections and the token bucket of one source IP
+type clientLimit struct {
+	active  int
+	waiting int       // connections in acquireClient, the entry must stay
+	tokens  float64   // new connections allowed now, negative while queued ones wait
+	updated time.Time // when tokens was last refilled
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		clients:   make(map[string]*clientLimit),
+		released:  make(chan struct{}),
+		lastSweep: time.Now(),
+	}
+}
+
+// acquire takes a slot of max_connections, 0 disables the limit. With the
+// queue action it waits up to queue_timeout for a connection to end.
+func (l *connLimiter) acquire(cfg config.AdvancedConfig) bool {
+	deadline := time.Now().Add(time.Duration(cfg.QueueTimeout) * time.Second)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queued := false
+	for cfg.MaxConnections > 0 && l.active >= cfg.MaxConnections {
+		if cfg.MaxConnectionsAction != config.LIMIT_ACTION_QUEUE || !l.wait(deadline) {
+			metrics.MaxConnectionsLimited.WithLabelValues("rejected").Inc()
+			return false
+		}
+		queued = true
+	}
+	if queued {
+		metrics.MaxConnectionsLimited.WithLabelValues("queued").Inc()
+	}
+	l.active++
+	metrics.ActiveConnections.Set(int64(l.active))
+	return true
+}
+
+// release returns a slot taken by acquire
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	metrics.ActiveConnections.Set(int64(l.active))
+	l.broadcast()
+}
+
+// acquireClient applies client_rate and max_client_connections to a new
+// connection from ip. It returns a function releasing the connection, or
+// the name of the limit the connection is rejected by.
+func (l *connLimiter) acquireClient(cfg config.AdvancedConfig, ip string) (func(), string) {
+	if cfg.ClientRate <= 0 && cfg.MaxClientConnections <= 0 {
+		return func() {}, ""
+	}
+	queueTimeout := time.Duration(cfg.QueueTimeout) * time.Second
+	deadline := time.Now().Add(queueTimeout)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(cfg)
+
+	client := l.clients[ip]
+	if client == nil {
+		client = &clientLimit{tokens: float64(cfg.ClientBurst), updated: time.Now()}
+		l.clients[ip] = client
+	}
+	client.waiting++
+	defer func() {
+		client.waiting--
+	}()
+
+	if cfg.ClientRate > 0 {
+		client.refill(cfg)
+		if client.tokens < 1 {
+			delay := time.Duration((1 - client.tokens) / cfg.ClientRate * float64(time.Second))
+			if cfg.ClientRateAction != config.LIMIT_ACTION_QUEUE || delay > queueTimeout {
+				metrics.ClientRateLimited.WithLabelValues("rejected").Inc()
+				return nil, "client_rate"
+			}
+			// The token is reserved, later connections wait behind this one
+			client.tokens--
+			metrics.ClientRateLimited.WithLabelValues("queued").Inc()
+			l.mu.Unlock()
+			time.Sleep(delay)
+			l.mu.Lock()
+		} else {
+			client.tokens--
+		}
+	}
+
+	queued := false
+	for cfg.MaxClientConnections > 0 && client.active >= cfg.MaxClientConnections {
+		if cfg.MaxClientConnectionsAction != config.LIMIT_ACTION_QUEUE || !l.wait(deadline) {
+			metrics.ClientConnectionsLimited.WithLabelValues("rejected").Inc()
+			return nil, "max_client_connections"
+		}
+		queued = true
+	}
+	if queued {
+		metrics.ClientConnectionsLimited.WithLabelValues("queued").Inc()
+	}
+
+	client.active++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		client.active--
+		l.broadcast()
+	}, ""
+}
+
+// wait unlocks l until a connection ends or deadline passes. It returns
+// false at the deadline.
+func (l *connLimiter) wait(deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+	released := l.released
+	l.mu.Unlock()
+	defer l.mu.Lock()
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// broadcast wakes the connections waiting for a limit
+func (l *connLimiter) broadcast() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// sweep forgets clients without connections whose bucket is full again
+func (l *connLimiter) sweep(cfg config.AdvancedConfig) {
+	if time.Since(l.lastSweep) < clientSweepInterval {
+		return
+	}
+	l.lastSweep = time.Now()
+	for ip, client := range l.clients {
+		if client.active > 0 || client.waiting > 0 {
+			continue
+		}
+		client.refill(cfg)
+		if cfg.ClientRate <= 0 || client.tokens >= float64(cfg.ClientBurst) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill, up to client_burst
+func (c *clientLimit) refill(cfg config.AdvancedConfig) {
+	now := time.Now()
+	c.tokens = math.Min(float64(cfg.ClientBurst), c.tokens+now.Sub(c.updated).Seconds()*cfg.ClientRate)
+	c.updated = now
+}
+
+// rejectConn closes a connection over a limit. TCP connections are reset so
+// that no socket stays in TIME_WAIT.
+func rejectConn(conn net.Conn, listener, limit string) {
+	slog.Debug("Connection limit reached", "listener", listener, "client", conn.RemoteAddr().String(), "limit", limit)
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	if err := conn.Close(); err != nil {
+		// The client is not served, there is nothing to report
+		_ = err // explicitly ignore the error
+	}
+}
+
+// remoteIP returns the source IP of a connection
+func remoteIP(conn net.Conn) string {
+	return hostIP(conn.RemoteAddr().String())
+}
+
+// hostIP returns the IP of a host:port address, or the address itself
+func hostIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
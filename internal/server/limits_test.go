@@ -0,0 +1,103 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"tproxy/internal/config"
+)
+
+func TestConnLimiter_MaxConnections(t *testing.T) {
+	l := newConnLimiter()
+	cfg := config.AdvancedConfig{MaxConnections: 2, MaxConnectionsAction: config.LIMIT_ACTION_REJECT, QueueTimeout: 1}
+
+	if !l.acquire(cfg) || !l.acquire(cfg) {
+		t.Fatal("Expected connections up to the limit to be accepted")
+	}
+	if l.acquire(cfg) {
+		t.Fatal("Expected a connection over the limit to be rejected")
+	}
+
+	// Queued connections get the slot of the next connection that ends
+	cfg.MaxConnectionsAction = config.LIMIT_ACTION_QUEUE
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.release()
+	}()
+	start := time.Now()
+	if !l.acquire(cfg) {
+		t.Fatal("Expected a queued connection to be accepted after a release")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Expected the queued connection to wait for the release")
+	}
+
+	// Nothing ends within queue_timeout
+	start = time.Now()
+	if l.acquire(cfg) {
+		t.Fatal("Expected a queued connection to be rejected after queue_timeout")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected to wait for queue_timeout, waited %v", elapsed)
+	}
+}
+
+func TestConnLimiter_ClientConnections(t *testing.T) {
+	l := newConnLimiter()
+	cfg := config.AdvancedConfig{MaxClientConnections: 1, MaxClientConnectionsAction: config.LIMIT_ACTION_REJECT, QueueTimeout: 1}
+
+	release, limit := l.acquireClient(cfg, "192.168.1.2")
+	if limit != "" {
+		t.Fatalf("Expected the first connection to be accepted, got %q", limit)
+	}
+	if _, limit := l.acquireClient(cfg, "192.168.1.2"); limit != "max_client_connections" {
+		t.Errorf("Expected max_client_connections, got %q", limit)
+	}
+	other, limit := l.acquireClient(cfg, "192.168.1.3")
+	if limit != "" {
+		t.Fatalf("Expected another client to be accepted, got %q", limit)
+	}
+	other()
+
+	cfg.MaxClientConnectionsAction = config.LIMIT_ACTION_QUEUE
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	queued, limit := l.acquireClient(cfg, "192.168.1.2")
+	if limit != "" {
+		t.Fatalf("Expected a queued connection to be accepted after a release, got %q", limit)
+	}
+	queued()
+}
+
+func TestConnLimiter_ClientRate(t *testing.T) {
+	l := newConnLimiter()
+	cfg := config.AdvancedConfig{ClientRate: 1, ClientBurst: 2, ClientRateAction: config.LIMIT_ACTION_REJECT, QueueTimeout: 1}
+
+	for i := 0; i < 2; i++ {
+		release, limit := l.acquireClient(cfg, "192.168.1.2")
+		if limit != "" {
+			t.Fatalf("Expected connection %d within the burst to be accepted, got %q", i+1, limit)
+		}
+		release()
+	}
+	if _, limit := l.acquireClient(cfg, "192.168.1.2"); limit != "client_rate" {
+		t.Errorf("Expected client_rate, got %q", limit)
+	}
+
+	// A token is earned every 50ms, the connection waits for it
+	l = newConnLimiter()
+	cfg = config.AdvancedConfig{ClientRate: 20, ClientBurst: 1, ClientRateAction: config.LIMIT_ACTION_QUEUE, QueueTimeout: 1}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, limit := l.acquireClient(cfg, "192.168.1.2")
+		if limit != "" {
+			t.Fatalf("Expected queued connection %d to be accepted, got %q", i+1, limit)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected connections to be spread by the rate, took %v", elapsed)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"tproxy/internal/config"
+)
+
+// OriginalDstResolver returns the address a client connected to before the
+// firewall handed the connection to a listener
+type OriginalDstResolver interface {
+	OriginalDst(conn net.Conn) (string, int, error)
+}
+
+// RedirectResolver reads the destination that iptables REDIRECT or DNAT
+// rewrote from conntrack with SO_ORIGINAL_DST (Linux only)
+type RedirectResolver struct{}
+
+// TProxyResolver returns the local address of the connection. With TPROXY
+// the listener accepts connections on their original destination.
+type TProxyResolver struct{}
+
+func (TProxyResolver) OriginalDst(conn net.Conn) (string, int, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", 0, fmt.Errorf("not a TCP connection")
+	}
+	return addr.IP.String(), addr.Port, nil
+}
+
+// newOriginalDstResolver returns the resolver for a listen mode
+func newOriginalDstResolver(mode string) OriginalDstResolver {
+	if mode == config.LISTEN_MODE_TPROXY {
+		return TProxyResolver{}
+	}
+	return RedirectResolver{}
+}
+
+// dstResolver is set by StartServers from the listen mode
+var dstResolver atomic.Pointer[OriginalDstResolver]
+
+func setOriginalDstResolver(r OriginalDstResolver) {
+	dstResolver.Store(&r)
+}
+
+// getOriginalDst returns the original destination with the configured
+// resolver, SO_ORIGINAL_DST if none was set. For a fake IP it returns the
+// host name the address was handed out for.
+func getOriginalDst(conn net.Conn) (string, int, error) {
+	var resolver OriginalDstResolver = RedirectResolver{}
+	if r := dstResolver.Load(); r != nil {
+		resolver = *r
+	}
+	ip, port, err := resolver.OriginalDst(conn)
+	if err != nil {
+		return "", 0, err
+	}
+	host, err := fakeIPHost(ip)
+	return host, port, err
+}
+
+// listenTCP opens a TCP listener, transparent for TPROXY
+func listenTCP(address, mode string) (net.Listener, error) {
+	if mode == config.LISTEN_MODE_TPROXY {
+		return listenTransparentTCP(address)
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and
+// linux/netfilter_ipv6/ip6_tables.h, IPV6_TRANSPARENT from linux/in6.h
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+	IPV6_TRANSPARENT     = 75
+)
+
+func (RedirectResolver) OriginalDst(conn net.Conn) (string, int, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", 0, fmt.Errorf("not a TCP connection")
+	}
+
+	// Read the socket option without File(), which would switch the socket
+	// to blocking mode so that closing it waits for pending reads
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", 0, err
+	}
+
+	level, option := syscall.IPPROTO_IP, SO_ORIGINAL_DST
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST
+	}
+
+	// Large enough for sockaddr_in and sockaddr_in6
+	var addr [28]byte
+	addrLen := uint32(len(addr))
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT,
+			fd,
+			uintptr(level),
+			uintptr(option),
+			uintptr(unsafe.Pointer(&addr[0])),
+			uintptr(unsafe.Pointer(&addrLen)),
+			0,
+		)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if errno != 0 {
+		return "", 0, fmt.Errorf("getsockopt failed: %v", errno)
+	}
+
+	// sockaddr_in: family, port, 4 byte address; sockaddr_in6: family,
+	// port, flow info, 16 byte address. The port is in network byte order.
+	port := int(binary.BigEndian.Uint16(addr[2:4]))
+	if level == syscall.IPPROTO_IPV6 {
+		return net.IP(addr[8:24]).String(), port, nil
+	}
+	return net.IP(addr[4:8]).String(), port, nil
+}
+
+// listenTransparentTCP opens a TCP listener with IP_TRANSPARENT so TPROXY
+// can hand it connections to any address. It needs CAP_NET_ADMIN.
+func listenTransparentTCP(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				level, option := syscall.SOL_IP, syscall.IP_TRANSPARENT
+				if network == "tcp6" {
+					level, option = syscall.SOL_IPV6, IPV6_TRANSPARENT
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), level, option, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("IP_TRANSPARENT: %w", sockErr)
+			}
+			return nil
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// OriginalDst is not supported on this platform
+func (RedirectResolver) OriginalDst(conn net.Conn) (string, int, error) {
+	return "", 0, fmt.Errorf("SO_ORIGINAL_DST is not supported on this platform")
+}
+
+// listenTransparentTCP is not supported on this platform.
+func listenTransparentTCP(address string) (net.Listener, error) {
+	return nil, fmt.Errorf("transparent TCP sockets are not supported on this platform")
+}
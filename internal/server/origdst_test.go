@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tproxy/internal/config"
+)
+
+// staticResolver returns a fixed original destination so the handlers can
+// be tested without iptables and root
+type staticResolver struct {
+	ip   string
+	port int
+	err  error
+}
+
+func (r staticResolver) OriginalDst(conn net.Conn) (string, int, error) {
+	return r.ip, r.port, r.err
+}
+
+// useResolver sets the resolver for the test and restores the previous one
+func useResolver(t *testing.T, r OriginalDstResolver) {
+	t.Helper()
+	previous := dstResolver.Load()
+	setOriginalDstResolver(r)
+	t.Cleanup(func() {
+		dstResolver.Store(previous)
+	})
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestNewOriginalDstResolver(t *testing.T) {
+	if _, ok := newOriginalDstResolver(config.LISTEN_MODE_TPROXY).(TProxyResolver); !ok {
+		t.Error("Expected the TPROXY resolver for tproxy mode")
+	}
+	if _, ok := newOriginalDstResolver(config.LISTEN_MODE_REDIRECT).(RedirectResolver); !ok {
+		t.Error("Expected the REDIRECT resolver for redirect mode")
+	}
+}
+
+func TestTProxyResolver(t *testing.T) {
+	_, server := tcpPair(t)
+
+	ip, port, err := TProxyResolver{}.OriginalDst(server)
+	if err != nil {
+		t.Fatalf("OriginalDst failed: %v", err)
+	}
+	local := server.LocalAddr().(*net.TCPAddr)
+	if ip != local.IP.String() || port != local.Port {
+		t.Errorf("Expected %s, got %s:%d", local, ip, port)
+	}
+
+	pipe, _ := net.Pipe()
+	defer func() {
+		_ = pipe.Close()
+	}()
+	if _, _, err := (TProxyResolver{}).OriginalDst(pipe); err == nil {
+		t.Error("Expected an error for a non-TCP connection")
+	}
+}
+
+func TestRedirectResolver_NotRedirected(t *testing.T) {
+	_, server := tcpPair(t)
+
+	// Without a REDIRECT rule conntrack has no original destination
+	if _, _, err := (RedirectResolver{}).OriginalDst(server); err == nil {
+		t.Error("Expected an error for a connection that was not redirected")
+	}
+}
+
+func TestHandleSniffClient_OriginalDst(t *testing.T) {
+	echo := startEchoServer(t)
+	useResolver(t, staticResolver{ip: "127.0.0.1", port: echo.Port})
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules:  []config.Rule{{Pattern: "127\\.0\\.0\\.1", Proxy: "DIRECT", Ports: []int{echo.Port}}},
+	}
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go handleSniffClient(server, cfg)
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := client.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected the original destination to echo: %v", err)
+	}
+	if string(reply) != "SSH-2.0-test\r\n" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestHandleSniffClient_UnknownDst(t *testing.T) {
+	useResolver(t, staticResolver{err: errors.New("no original destination")})
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go handleSniffClient(server, &config.Config{Listen: config.ListenConfig{Timeout: 5}})
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+	"tproxy/internal/proxy"
+)
+
+// QUIC session states
+const (
+	quicPending  = iota // waiting for the complete ClientHello
+	quicRouting         // the rules are applied and the remote server is dialed
+	quicDropped         // datagrams are discarded, the client falls back to TCP
+	quicRelaying        // datagrams are relayed to the remote server
+)
+
+// maxPendingDatagrams limits how many datagrams are buffered per session
+// while the ClientHello is incomplete or the session is routed
+const maxPendingDatagrams = 16
+
+// quicSession tracks one client address, NAT style. Datagrams from the
+// client are buffered until the ClientHello is complete and the session is
+// routed in its own goroutine, then dropped or relayed according to the
+// rules.
+type quicSession struct {
+	client   *net.UDPAddr
+	origDst  *net.UDPAddr // nil if the original destination is unknown
+	lastSeen atomic.Int64 // unix nanoseconds of the last datagram in either direction
+
+	mu        sync.Mutex // guards the fields below
+	assembler *proxy.QUICHelloAssembler
+	pending   [][]byte
+	state     int
+	remote    *net.UDPConn
+}
+
+func (s *quicSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *quicSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastSeen.Load()))
+}
+
+// quicServer intercepts QUIC on a UDP listener and applies the routing rules
+// to the SNI of the ClientHello in the Initial packets.
+type quicServer struct {
+	conn     *net.UDPConn
+	config   func() *config.Config // configuration for new sessions
+	timeout  time.Duration
+	mu       sync.Mutex // guards sessions
+	sessions map[string]*quicSession
+}
+
+// newQUICServer returns a server for conn that routes new sessions with the
+// configuration returned by cfg
+func newQUICServer(conn *net.UDPConn, cfg func() *config.Config) *quicServer {
+	timeout := cfg().Listen.UDPTimeout
+	if timeout <= 0 {
+		timeout = config.DEFAULT_UDP_TIMEOUT
+	}
+	return &quicServer{
+		conn:     conn,
+		config:   cfg,
+		timeout:  time.Duration(timeout) * time.Second,
+		sessions: make(map[string]*quicSession),
+	}
+}
+
+// serve reads datagrams until the listener is closed or paused
+func (q *quicServer) serve() {
+	done := make(chan struct{})
+	defer close(done)
+	go q.expireSessions(done)
+
+	buf := make([]byte, 65535)
+	oob := make([]byte, 256)
+	for {
+		n, client, origDst, err := readUDP(q.conn, buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			slog.Error("QUIC read error", "error", err)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		q.handleDatagram(datagram, client, origDst)
+	}
+}
+
+func (q *quicServer) handleDatagram(datagram []byte, client, origDst *net.UDPAddr) {
+	key := client.String()
+
+	q.mu.Lock()
+	session, ok := q.sessions[key]
+	if !ok {
+		if !proxy.IsQUICInitial(datagram) {
+			// Not the start of a QUIC connection, e.g. a session that expired
+			q.mu.Unlock()
+			return
+		}
+		// Sessions are limited like connections, each client address taking
+		// one until it expires. The client retries or falls back to TCP.
+		if max := q.config().Advanced.MaxConnections; max > 0 && len(q.sessions) >= max {
+			q.mu.Unlock()
+			metrics.MaxConnectionsLimited.WithLabelValues("rejected").Inc()
+			slog.Debug("Connection limit reached", "listener", "quic", "client", client.String(), "limit", "max_connections")
+			return
+		}
+		session = &quicSession{
+			client:    client,
+			origDst:   origDst,
+			assembler: proxy.NewQUICHelloAssembler(config.MAX_CLIENT_HELLO_SIZE),
+		}
+		q.sessions[key] = session
+		metrics.AcceptedConnections.WithLabelValues("quic").Inc()
+	}
+	q.mu.Unlock()
+
+	session.touch()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	switch session.state {
+	case quicDropped:
+	case quicRelaying:
+		if _, err := session.remote.Write(datagram); err != nil {
+			slog.Warn("QUIC relay failed", "client", session.client.String(), "remote", session.remote.RemoteAddr().String(), "error", err)
+		}
+	case quicRouting:
+		// Sent once the remote server is dialed, the client retransmits
+		// what does not fit
+		if len(session.pending) < maxPendingDatagrams {
+			session.pending = append(session.pending, datagram)
+		}
+	default:
+		if hello, complete := q.collectClientHello(session, datagram); complete {
+			// Lookups and dialing must not hold up the datagrams of other
+			// sessions
+			session.state = quicRouting
+			go q.routeSession(session, hello)
+		}
+	}
+}
+
+// collectClientHello buffers a datagram of a pending session and reports
+// whether a routing decision can be made. session.mu must be held.
+func (q *quicServer) collectClientHello(session *quicSession, datagram []byte) (*proxy.ClientHello, bool) {
+	session.pending = append(session.pending, datagram)
+
+	initial, err := proxy.ParseQUICInitial(datagram)
+	if err != nil {
+		// Keep the datagram for relaying, it may be a coalesced 0-RTT packet
+		slog.Debug("QUIC Initial parse error", "client", session.client.String(), "error", err)
+		return nil, len(session.pending) >= maxPendingDatagrams
+	}
+	if err := session.assembler.Add(initial.CryptoFrames); err != nil {
+		slog.Info("Invalid QUIC ClientHello", "client", session.client.String(), "error", err)
+		return nil, true
+	}
+
+	hello, complete := session.assembler.ClientHello()
+	if !complete && len(session.pending) >= maxPendingDatagrams {
+		slog.Info("QUIC ClientHello incomplete", "client", session.client.String(), "datagrams", len(session.pending))
+		return nil, true
+	}
+	return hello, complete
+}
+
+// routeSession applies the rules to a session whose ClientHello is complete
+// or could not be assembled. session.mu must not be held.
+func (q *quicServer) routeSession(session *quicSession, hello *proxy.ClientHello) {
+	originalIP := ""
+	originalPort := config.DEFAULT_HTTPS_PORT
+	if session.origDst != nil {
+		originalIP = session.origDst.IP.String()
+		originalPort = session.origDst.Port
+	}
+	logger := connLogger(session.client.String(), originalIP, originalPort).With("protocol", "quic")
+	// A fake IP stands for the host name it was handed out for
+	host, err := fakeIPHost(originalIP)
+	if err != nil {
+		q.dropSession(session, logger, err.Error())
+		return
+	}
+	originalIP = host
+
+	info := clientHelloInfo(hello, logger)
+	if info.Host == "" {
+		logger.Info("SNI not found")
+		metrics.SNIParseFailures.WithLabelValues("quic").Inc()
+		if originalIP == "" {
+			q.dropSession(session, logger, "no SNI or original destination")
+			return
+		}
+		info.Host = originalIP
+	}
+
+	// A client may send an allowed name to the address of another service
+	cfg := q.config()
+	switch verifySNI(&cfg.VerifySNI, info.Host, originalIP, logger) {
+	case config.SNI_VERIFY_ROUTE_IP:
+		info.Host = originalIP
+	case config.SNI_VERIFY_DROP:
+		q.dropSession(session, logger, "SNI does not resolve to the original destination")
+		return
+	}
+
+	info.DstIP = originalIP
+	info.DstPort = originalPort
+
+	proxyAction, err := findProxyForClientHello(cfg, hello, info, logger)
+	if err != nil {
+		q.dropSession(session, logger, err.Error())
+		return
+	}
+	proxyAction.CountHit()
+	metrics.RuleHits.WithLabelValues(strconv.Itoa(proxyAction.Rule), strings.ToLower(proxyAction.Type)).Inc()
+
+	switch proxyAction.Type {
+	case "DROP", "REJECT":
+		q.dropSession(session, logger, "Drop for "+info.Host)
+	case "PROXY":
+		// HTTP CONNECT cannot carry UDP, dropping makes the client retry
+		// over TCP where the upstream proxy is used
+		q.dropSession(session, logger, fmt.Sprintf("TCP fallback for %s via %s:%d", info.Host, proxyAction.Host, proxyAction.Port))
+	default:
+		q.relaySession(session, info.Host, originalIP, originalPort, proxyAction.ConnectTo, outboundOptions(cfg, "", proxyAction), logger)
+	}
+}
+
+func (q *quicServer) dropSession(session *quicSession, logger *slog.Logger, reason string) {
+	logger.Info("Dropping QUIC", "reason", reason)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.state = quicDropped
+	session.pending = nil
+}
+
+// relaySession connects to the remote server and starts relaying. Unless
+// the rule's connect_to says otherwise, the original destination IP is
+// preferred over resolving the SNI so the client's own DNS answer is
+// honoured. originalIP is empty if the original destination is unknown.
+func (q *quicServer) relaySession(session *quicSession, host, originalIP string, port int, connectTo string, options proxy.DialOptions, logger *slog.Logger) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	if originalIP != "" {
+		if connectTo == "" {
+			connectTo = config.CONNECT_TO_ORIGINAL_IP
+		}
+		dialHost, dialPort := connectTarget(connectTo, host, port, originalIP, port, options.Resolver, logger)
+		target = net.JoinHostPort(dialHost, strconv.Itoa(dialPort))
+	}
+	logger.Info("Direct QUIC relay", "host", host, "target", target)
+
+	remote, err := options.DialContext(context.Background(), "udp", target)
+	if err != nil {
+		q.dropSession(session, logger, err.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.state != quicRouting {
+		// Removed on shutdown while dialing
+		if err := remote.Close(); err != nil {
+			// Connection close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
+		}
+		return
+	}
+	session.remote = remote.(*net.UDPConn)
+	session.state = quicRelaying
+
+	// With TPROXY replies must come from the original destination. After
+	// REDIRECT the listener's replies are translated back by conntrack.
+	reply := func(b []byte) error {
+		_, err := q.conn.WriteToUDP(b, session.client)
+		return err
+	}
+	var replyConn *net.UDPConn
+	if session.origDst != nil {
+		if replyConn, err = listenTransparentUDP(session.origDst); err == nil {
+			reply = func(b []byte) error {
+				_, err := replyConn.WriteToUDP(b, session.client)
+				return err
+			}
+		} else {
+			logger.Warn("Replying from the listener address", "error", err)
+			replyConn = nil
+		}
+	}
+
+	q.flushPending(session, logger)
+	go func() {
+		q.relayReplies(session, reply)
+		if replyConn != nil {
+			if err := replyConn.Close(); err != nil {
+				// Connection close errors are expected and can be safely ignored
+				_ = err // explicitly ignore the error
+			}
+		}
+	}()
+}
+
+// flushPending sends the datagrams buffered while the ClientHello was
+// incomplete and the session was routed. session.mu must be held.
+func (q *quicServer) flushPending(session *quicSession, logger *slog.Logger) {
+	for _, datagram := range session.pending {
+		if _, err := session.remote.Write(datagram); err != nil {
+			logger.Warn("QUIC relay failed", "error", err)
+			break
+		}
+	}
+	session.pending = nil
+}
+
+// relayReplies copies datagrams from the remote server back to the client
+// until the session has been idle for the UDP timeout
+func (q *quicServer) relayReplies(session *quicSession, reply func([]byte) error) {
+	defer q.removeSession(session)
+
+	buf := make([]byte, 65535)
+	for {
+		if err := session.remote.SetReadDeadline(time.Now().Add(q.timeout)); err != nil {
+			return
+		}
+		n, err := session.remote.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && session.idle() < q.timeout {
+				continue // The client is still sending
+			}
+			return
+		}
+		session.touch()
+		if err := reply(buf[:n]); err != nil {
+			slog.Warn("QUIC reply failed", "client", session.client.String(), "error", err)
+		}
+	}
+}
+
+func (q *quicServer) removeSession(session *quicSession) {
+	q.mu.Lock()
+	key := session.client.String()
+	if q.sessions[key] == session {
+		delete(q.sessions, key)
+	}
+	q.mu.Unlock()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.state = quicDropped
+	if session.remote != nil {
+		if err := session.remote.Close(); err != nil {
+			// Connection close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
+		}
+	}
+}
+
+// expireSessions forgets dropped and stalled pending sessions. Relaying
+// sessions are removed by their reply goroutine, routed ones once routing
+// ends.
+func (q *quicServer) expireSessions(done <-chan struct{}) {
+	ticker := time.NewTicker(q.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		q.mu.Lock()
+		for key, session := range q.sessions {
+			session.mu.Lock()
+			if (session.state == quicPending || session.state == quicDropped) && session.idle() > q.timeout {
+				delete(q.sessions, key)
+			}
+			session.mu.Unlock()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// closeSessions closes the connections to the remote servers, which ends
+// the relaying sessions
+func (q *quicServer) closeSessions() {
+	q.mu.Lock()
+	sessions := make([]*quicSession, 0, len(q.sessions))
+	for _, session := range q.sessions {
+		sessions = append(sessions, session)
+	}
+	q.mu.Unlock()
+
+	for _, session := range sessions {
+		q.removeSession(session)
+	}
+}
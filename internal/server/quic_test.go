@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+)
+
+// undecryptableInitial returns a datagram with a valid QUIC v1 Initial header
+// whose payload does not decrypt, so the session falls back to routing by
+// the original destination once enough datagrams have been buffered
+func undecryptableInitial(seq byte) []byte {
+	datagram := []byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x04, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x40, 0x40}
+	payload := bytes.Repeat([]byte{seq}, 0x40)
+	return append(datagram, payload...)
+}
+
+// startQUICTestServer starts a quicServer on a loopback UDP socket
+func startQUICTestServer(t *testing.T, rules []config.Rule) (*quicServer, *net.UDPConn) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create UDP listener: %v", err)
+	}
+	cfg := &config.Config{
+		Listen: config.ListenConfig{UDPTimeout: 5},
+		Rules:  rules,
+	}
+	server := newQUICServer(conn, func() *config.Config { return cfg })
+	go server.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return server, conn
+}
+
+// waitForQUICState waits for the session of client to leave the pending
+// and routing states and returns it
+func waitForQUICState(t *testing.T, server *quicServer, client *net.UDPAddr) *quicSession {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.mu.Lock()
+		session := server.sessions[client.String()]
+		server.mu.Unlock()
+		if session == nil {
+			t.Fatal("Expected a session for the client")
+		}
+		session.mu.Lock()
+		state := session.state
+		session.mu.Unlock()
+		if state != quicPending && state != quicRouting {
+			return session
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Session was not routed, state %d", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQUICServer_DirectRelay(t *testing.T) {
+	// UDP echo server standing in for the original destination
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create UDP listener: %v", err)
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := remote.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = remote.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	server, conn := startQUICTestServer(t, []config.Rule{{Pattern: ".*", Proxy: "DIRECT"}})
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Cannot create client socket: %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	// Feed the datagrams as if TPROXY had reported the echo server as the
+	// original destination
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	origDst := remote.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < maxPendingDatagrams; i++ {
+		server.handleDatagram(undecryptableInitial(byte(i)), clientAddr, origDst)
+	}
+
+	if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	buf := make([]byte, 2048)
+	for i := 0; i < maxPendingDatagrams; i++ {
+		n, from, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Expected relayed reply %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], undecryptableInitial(byte(i))) {
+			t.Errorf("Reply %d does not match the sent datagram", i)
+		}
+		if !from.IP.Equal(origDst.IP) || (from.Port != origDst.Port && from.Port != conn.LocalAddr().(*net.UDPAddr).Port) {
+			t.Errorf("Unexpected reply source %s", from)
+		}
+	}
+}
+
+func TestQUICServer_Drop(t *testing.T) {
+	server, _ := startQUICTestServer(t, []config.Rule{{Pattern: "127\\.0\\.0\\.1", Proxy: "DROP"}})
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	origDst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	for i := 0; i < maxPendingDatagrams; i++ {
+		server.handleDatagram(undecryptableInitial(byte(i)), clientAddr, origDst)
+	}
+
+	session := waitForQUICState(t, server, clientAddr)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.state != quicDropped {
+		t.Errorf("Expected the session to be dropped, got state %d", session.state)
+	}
+	if len(session.pending) != 0 {
+		t.Errorf("Expected buffered datagrams to be discarded, got %d", len(session.pending))
+	}
+}
+
+func TestQUICServer_IgnoresNonInitial(t *testing.T) {
+	server, _ := startQUICTestServer(t, []config.Rule{{Pattern: ".*", Proxy: "DIRECT"}})
+
+	// A short header packet from an unknown client
+	server.handleDatagram([]byte{0x40, 0x01, 0x02, 0x03}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}, nil)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.sessions) != 0 {
+		t.Errorf("Expected no session for a non-Initial packet, got %d", len(server.sessions))
+	}
+}
+
+func TestQUICServer_MaxSessions(t *testing.T) {
+	server, _ := startQUICTestServer(t, []config.Rule{{Pattern: ".*", Proxy: "DROP"}})
+	cfg := *server.config()
+	cfg.Advanced.MaxConnections = 2
+	server.config = func() *config.Config { return &cfg }
+
+	origDst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	for port := 40010; port < 40013; port++ {
+		server.handleDatagram(undecryptableInitial(0), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, origDst)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.sessions) != 2 {
+		t.Errorf("Expected 2 sessions at the limit, got %d", len(server.sessions))
+	}
+	if server.sessions["127.0.0.1:40012"] != nil {
+		t.Error("Expected no session over the limit")
+	}
+}
+
+func TestQUICServer_RoutingDoesNotBlock(t *testing.T) {
+	// A DNS server that never answers
+	blackhole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create UDP listener: %v", err)
+	}
+	defer func() {
+		_ = blackhole.Close()
+	}()
+	cfg := &config.Config{
+		DNS:    config.DNSConfig{Servers: []string{"udp://" + blackhole.LocalAddr().String()}, Timeout: 2},
+		FakeIP: config.FakeIPConfig{Listen: "127.0.0.1:0", Pool: "198.18.0.0/15", TTL: 1},
+	}
+	useFakeIPs(t, cfg)
+	server, _ := startQUICTestServer(t, []config.Rule{{Pattern: ".*", Proxy: "DIRECT"}})
+
+	// Relaying to the name of a fake IP looks it up
+	slow := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40020}
+	origDst := &net.UDPAddr{IP: fakeIPs.Load().handler.Pool.IP("slow.test"), Port: 443}
+	start := time.Now()
+	for i := 0; i < maxPendingDatagrams+2; i++ {
+		server.handleDatagram(undecryptableInitial(byte(i)), slow, origDst)
+	}
+	// Another session is served meanwhile
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40021}
+	server.handleDatagram([]byte{0x40, 0x01}, other, nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the datagrams to be handled while the lookup runs, took %s", elapsed)
+	}
+
+	server.mu.Lock()
+	session := server.sessions[slow.String()]
+	server.mu.Unlock()
+	session.mu.Lock()
+	if session.state != quicRouting || len(session.pending) != maxPendingDatagrams {
+		t.Errorf("Expected the datagrams to be queued while routing, got state %d with %d datagrams", session.state, len(session.pending))
+	}
+	session.mu.Unlock()
+
+	// The lookup times out and the client falls back to TCP
+	if session := waitForQUICState(t, server, slow); session.state != quicDropped {
+		t.Errorf("Expected the session to be dropped, got state %d", session.state)
+	}
+}
+
+func TestQUICServer_VerifySNI(t *testing.T) {
+	previous := resolvers.Load()
+	defer resolvers.Store(previous)
+	if err := applyDNSConfig(&config.Config{DNS: config.DNSConfig{Hosts: map[string][]string{"allowed.example.com": {"192.0.2.10"}}}}); err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot create UDP listener: %v", err)
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	_, hello := goClientHello(t, "allowed.example.com")
+
+	tests := []struct {
+		policy   string
+		expected int
+	}{
+		{config.SNI_VERIFY_LOG, quicRelaying},
+		// The original IP only matches the catch-all rule
+		{config.SNI_VERIFY_ROUTE_IP, quicDropped},
+		{config.SNI_VERIFY_DROP, quicDropped},
+	}
+	for i, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			server, _ := startQUICTestServer(t, []config.Rule{
+				{Pattern: "^allowed\\.example\\.com$", Proxy: "DIRECT"},
+				{Pattern: ".*", Proxy: "DROP"},
+			})
+			defer server.closeSessions()
+			cfg := *server.config()
+			cfg.VerifySNI.Policy = tt.policy
+			server.config = func() *config.Config { return &cfg }
+
+			// The SNI resolves to 192.0.2.10, the client sends to the UDP listener
+			client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40030 + i}
+			session := &quicSession{client: client, origDst: remote.LocalAddr().(*net.UDPAddr), state: quicRouting}
+			server.mu.Lock()
+			server.sessions[client.String()] = session
+			server.mu.Unlock()
+			server.routeSession(session, hello)
+
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			if session.state != tt.expected {
+				t.Errorf("Expected state %d, got %d", tt.expected, session.state)
+			}
+		})
+	}
+}
+
+func TestQUICServer_CountsRuleHits(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte("rules:\n  - pattern: \"^quic-hits\\\\.example$\"\n    proxy: \"DROP\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	server, _ := startQUICTestServer(t, nil)
+	server.config = func() *config.Config { return cfg }
+	_, hello := goClientHello(t, "quic-hits.example")
+
+	hits := metrics.RuleHits.WithLabelValues("1", "drop")
+	before := hits.Value()
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40040}
+	server.routeSession(&quicSession{client: client, state: quicRouting}, hello)
+
+	if n := cfg.Rules[0].Hits(); n != 1 {
+		t.Errorf("Expected one hit of the rule, got %d", n)
+	}
+	if n := hits.Value() - before; n != 1 {
+		t.Errorf("Expected the rule hits metric to count the session, got %d", n)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+	"tproxy/internal/quota"
+)
+
+var quotaStore atomic.Pointer[quota.Store] // nil until StartServers opens the state file
+
+// quotaLimit counts the bytes of a connection into its quota and calls
+// exhausted once the quota is used up while the connection is open
+type quotaLimit struct {
+	group   string
+	counter *quota.Counter
+	limit   uint64 // 0 if the connection already got the action of the group
+
+	exhausted func()
+	once      sync.Once
+}
+
+func (q *quotaLimit) Add(n uint64) {
+	q.counter.Add(n)
+	if q.limit > 0 && q.counter.Value() >= q.limit && q.exhausted != nil {
+		q.once.Do(q.exhausted)
+	}
+}
+
+// applyQuota returns the action for a connection from clientIP under the
+// quota of its group, the action of the group once the quota is exhausted.
+// The limit is nil if no group matches.
+func applyQuota(cfg *config.Config, clientIP string, action *config.ProxyAction, logger *slog.Logger) (*config.ProxyAction, *quotaLimit) {
+	store := quotaStore.Load()
+	if cfg == nil || store == nil {
+		return action, nil
+	}
+	group := cfg.Quotas.FindQuotaGroup(clientIP)
+	if group == nil {
+		return action, nil
+	}
+
+	client := ""
+	if group.PerClient {
+		client = clientIP
+	}
+	counter := store.Counter(group.Name, client, quota.PeriodKey(group.Period, time.Now()))
+	if counter.Value() < group.LimitBytes {
+		return action, &quotaLimit{group: group.Name, counter: counter, limit: group.LimitBytes}
+	}
+
+	metrics.QuotaExceeded.WithLabelValues(group.Name).Inc()
+	logger.Info("Quota exhausted", "group", group.Name, "bytes", counter.Value(), "limit", group.LimitBytes, "action", group.Action)
+	exceeded := group.ExceededAction()
+	exceeded.Rule = action.Rule
+	exceeded.Bandwidth = action.Bandwidth
+	return exceeded, &quotaLimit{group: group.Name, counter: counter}
+}
+
+// openQuotaStore loads the quota usage from the state file
+func openQuotaStore(cfg config.QuotaConfig) error {
+	store, err := quota.Open(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	quotaStore.Store(store)
+	return nil
+}
+
+// saveQuotas writes the quota usage to the state file, with the usage
+// handed off by processes that drained their connections after an upgrade
+func saveQuotas() {
+	store := quotaStore.Load()
+	if store == nil {
+		return
+	}
+	if err := store.LoadHandoffs(); err != nil {
+		slog.Error("Failed to load quota handoff", "path", store.Path(), "error", err)
+	}
+	if err := store.Save(); err != nil {
+		slog.Error("Failed to save quota state", "path", store.Path(), "error", err)
+	}
+}
+
+// saveQuotasForHandoff saves the quota usage before another process takes
+// over the state file and returns the saved usage
+func saveQuotasForHandoff() []quota.Usage {
+	store := quotaStore.Load()
+	if store == nil {
+		return nil
+	}
+	if err := store.LoadHandoffs(); err != nil {
+		slog.Error("Failed to load quota handoff", "path", store.Path(), "error", err)
+	}
+	base, err := store.SaveSnapshot()
+	if err != nil {
+		slog.Error("Failed to save quota state", "path", store.Path(), "error", err)
+	}
+	return base
+}
+
+// handOffQuotas passes the usage added since base, while draining the
+// connections, to the process that took over the state file
+func handOffQuotas(base []quota.Usage) {
+	store := quotaStore.Load()
+	if store == nil {
+		return
+	}
+	if err := store.Handoff(base); err != nil {
+		slog.Error("Failed to hand off quota usage", "path", store.Path(), "error", err)
+	}
+}
+
+// saveQuotasPeriodically saves the quota usage every interval until ctx is done
+func saveQuotasPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveQuotas()
+		}
+	}
+}
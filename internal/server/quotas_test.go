@@ -0,0 +1,140 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tproxy/internal/accesslog"
+	"tproxy/internal/config"
+	"tproxy/internal/quota"
+)
+
+func TestApplyQuota(t *testing.T) {
+	store, err := quota.Open(filepath.Join(t.TempDir(), "quotas.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	previousStore := quotaStore.Swap(store)
+	defer quotaStore.Store(previousStore)
+
+	cfg := &config.Config{Quotas: config.QuotaConfig{Groups: []config.QuotaGroup{{
+		Name:       "guests",
+		Networks:   []string{"192.168.50.0/24"},
+		PerClient:  true,
+		Period:     quota.PERIOD_DAILY,
+		Action:     "slow-proxy:3128",
+		LimitBytes: 1000,
+	}}}}
+	direct := &config.ProxyAction{Type: "DIRECT", Rule: 2}
+
+	action, counter := applyQuota(cfg, "192.168.50.7", direct, slog.Default())
+	if action != direct || counter == nil {
+		t.Fatalf("Expected the rule action and a counter under the quota, got %+v", action)
+	}
+	counter.Add(1000)
+
+	action, _ = applyQuota(cfg, "192.168.50.7", direct, slog.Default())
+	if action.Type != "PROXY" || action.Host != "slow-proxy" || action.Rule != 2 {
+		t.Errorf("Expected the quota action once exhausted, got %+v", action)
+	}
+	// Per client quotas: another client of the group is not affected
+	if action, _ := applyQuota(cfg, "192.168.50.8", direct, slog.Default()); action != direct {
+		t.Errorf("Expected another client to keep the rule action, got %+v", action)
+	}
+	if action, counter := applyQuota(cfg, "10.0.0.1", direct, slog.Default()); action != direct || counter != nil {
+		t.Error("Expected clients outside the groups not to be counted")
+	}
+
+	previousConfig := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previousConfig)
+
+	var usage []quotaJSON
+	if code := adminRequest(t, http.MethodGet, "/quotas", &usage); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(usage) != 2 || usage[0].Client != "192.168.50.7" || usage[0].Bytes != 1000 || !usage[0].Exhausted {
+		t.Errorf("Unexpected quota usage %+v", usage)
+	}
+
+	if code := adminRequest(t, http.MethodDelete, "/quotas/guests?client=192.168.50.7", nil); code != http.StatusOK {
+		t.Fatalf("Expected 200 for a reset, got %d", code)
+	}
+	if action, _ := applyQuota(cfg, "192.168.50.7", direct, slog.Default()); action != direct {
+		t.Errorf("Expected the rule action after a reset, got %+v", action)
+	}
+	if code := adminRequest(t, http.MethodDelete, "/quotas/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown group, got %d", code)
+	}
+
+	// The reset is saved
+	restored, err := quota.Open(store.Path())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, u := range restored.Usage() {
+		if u.Client == "192.168.50.7" && u.Bytes != 0 {
+			t.Errorf("Expected the saved usage to be reset, got %d", u.Bytes)
+		}
+	}
+}
+
+func TestProxyConnection_QuotaExhausted(t *testing.T) {
+	store, _ := quota.Open("")
+	previousStore := quotaStore.Swap(store)
+	defer quotaStore.Store(previousStore)
+	cfg := &config.Config{Quotas: config.QuotaConfig{Groups: []config.QuotaGroup{{
+		Name:       "guests",
+		Networks:   []string{"192.168.1.0/24"},
+		Period:     quota.PERIOD_DAILY,
+		Action:     "DROP",
+		LimitBytes: 1000,
+	}}}}
+	previousConfig := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previousConfig)
+	buf := captureAccessLog(t)
+	echo := startEchoServer(t)
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		proxyConnection("127.0.0.1", echo.Port, "127.0.0.1", echo.Port, "192.168.1.2:40300", server, &config.ProxyAction{Type: "DIRECT"}, nil, 5)
+		close(done)
+	}()
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+
+	// 400 bytes each way stay under the limit
+	data := make([]byte, 400)
+	if _, err := client.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatalf("Expected echoed data: %v", err)
+	}
+	// Crossing the limit closes the open connection
+	if _, err := client.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyConnection did not return after the quota was exhausted")
+	}
+
+	records := buf.records(t, "192.168.1.2:40300")
+	if len(records) != 1 || records[0].CloseReason != accesslog.REASON_QUOTA {
+		t.Errorf("Expected one record closed by the quota, got %+v", records)
+	}
+}
@@ -2,69 +2,161 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
-	"unsafe"
 
+	"tproxy/internal/accesslog"
 	"tproxy/internal/config"
+	"tproxy/internal/metrics"
 	"tproxy/internal/proxy"
+	"tproxy/internal/quota"
+	"tproxy/internal/systemd"
 )
 
-// Constants for SO_ORIGINAL_DST (Linux-specific)
-const SO_ORIGINAL_DST = 80 // Typically 80 on Linux systems
+// State shared by the listeners, the admin API and reloads
+var (
+	currentConfig atomic.Pointer[config.Config] // configuration for new connections
+	connections   = newConnRegistry()
+	upstreams     = newUpstreamTracker()
+	accessLog     atomic.Pointer[accesslog.Logger] // nil if the access log is disabled
+	clients       = newClientTracker()
+)
 
-// getOriginalDst gets the original destination using SO_ORIGINAL_DST (Linux only)
-func getOriginalDst(conn net.Conn) (string, int, error) {
-	// Get the underlying file descriptor
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		return "", 0, fmt.Errorf("not a TCP connection")
-	}
+// shutdownGracePeriod is how long shutdown waits for handlers after their
+// connections were closed
+const shutdownGracePeriod = 2 * time.Second
 
-	file, err := tcpConn.File()
-	if err != nil {
-		return "", 0, err
+// originalDestination returns the original destination of a redirected
+// connection. Without SO_ORIGINAL_DST it falls back to the client address
+// (similar to Python version) and the default port.
+func originalDestination(conn net.Conn, defaultPort int) (string, int) {
+	ip, port, err := getOriginalDst(conn)
+	if err == nil {
+		return ip, port
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.IP.String(), defaultPort
 	}
+	return "", defaultPort
+}
+
+func handleHTTPSClient(conn net.Conn, cfg *config.Config) {
 	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			// File close errors are expected and can be safely ignored
-			_ = closeErr // explicitly ignore the error
+		if err := conn.Close(); err != nil {
+			// Connection close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
 		}
 	}()
 
-	fd := int(file.Fd())
+	clientIP := conn.RemoteAddr().String()
+	originalIP, originalPort := originalDestination(conn, config.DEFAULT_HTTPS_PORT)
+	routeTLS(conn, cfg, clientIP, originalIP, originalPort)
+}
+
+// routeTLS reads the ClientHello and routes the connection by its SNI
+func routeTLS(conn net.Conn, cfg *config.Config, clientIP, originalIP string, originalPort int) {
+	logger := connLogger(clientIP, originalIP, originalPort)
+
+	// Read the complete ClientHello, which may span several segments and records
+	initialData, err := proxy.ReadClientHello(conn, config.MAX_CLIENT_HELLO_SIZE, config.CLIENT_HELLO_TIMEOUT*time.Second)
+	if len(initialData) == 0 {
+		return
+	}
+	if err != nil {
+		logger.Warn("Incomplete ClientHello", "bytes", len(initialData), "error", err)
+	}
+
+	// A truncated ClientHello still yields the fields that were received
+	hello, err := proxy.ParseClientHello(initialData)
+	if err != nil {
+		logger.Debug("ClientHello parse error", "error", err)
+	}
+	info := clientHelloInfo(hello, logger)
+	sni := info.Host
+	if sni == "" && err != nil {
+		// Fall back to the lenient parser for malformed handshakes
+		sni = proxy.ParseSNI(initialData)
+	}
+
+	if sni == "" {
+		logger.Info("SNI not found")
+		metrics.SNIParseFailures.WithLabelValues("tls").Inc()
+		// Use original IP as fallback (similar to Python version)
+		if originalIP != "" {
+			sni = originalIP
+		} else {
+			return
+		}
+	}
+
+	// A client may send an allowed name to the address of another service.
+	// Without SO_ORIGINAL_DST the original IP is the client's and unknown.
+	if originalIP != hostIP(clientIP) {
+		switch verifySNI(&cfg.VerifySNI, sni, originalIP, logger) {
+		case config.SNI_VERIFY_ROUTE_IP:
+			sni = originalIP
+		case config.SNI_VERIFY_DROP:
+			proxyTLSConnection(sni, originalPort, originalIP, originalPort, clientIP, conn, &config.ProxyAction{Type: "DROP"}, initialData, cfg.Listen.Timeout, tlsFingerprint{info.JA3, info.JA4})
+			return
+		}
+	}
 
-	// Use getsockopt to get SO_ORIGINAL_DST
-	var addr [16]byte
-	addrLen := uint32(16)
+	info.Host = sni
+	info.DstIP = originalIP
+	info.DstPort = originalPort
+	proxyAction, err := findProxyForClientHello(cfg, hello, info, logger)
+	if err != nil {
+		logger.Error("Error finding proxy", "host", sni, "error", err)
+		return
+	}
 
-	_, _, errno := syscall.Syscall6(
-		syscall.SYS_GETSOCKOPT,
-		uintptr(fd),
-		syscall.IPPROTO_IP,
-		SO_ORIGINAL_DST,
-		uintptr(unsafe.Pointer(&addr[0])),
-		uintptr(unsafe.Pointer(&addrLen)),
-		0,
-	)
+	proxyTLSConnection(sni, originalPort, originalIP, originalPort, clientIP, conn, proxyAction, initialData, cfg.Listen.Timeout, tlsFingerprint{info.JA3, info.JA4})
+}
 
-	if errno != 0 {
-		return "", 0, fmt.Errorf("getsockopt failed: %v", errno)
+// clientHelloInfo returns the ClientHello fields used for rule matching and
+// logs them at debug level. hello may be nil if no ClientHello could be parsed.
+func clientHelloInfo(hello *proxy.ClientHello, logger *slog.Logger) *config.ConnInfo {
+	info := &config.ConnInfo{}
+	if hello == nil {
+		return info
 	}
 
-	// Parse the result (similar to Python version)
-	// Format: 2 bytes padding, 2 bytes port, 4 bytes IP, 8 bytes padding
-	port := int(addr[2])<<8 | int(addr[3])
-	ip := fmt.Sprintf("%d.%d.%d.%d", addr[4], addr[5], addr[6], addr[7])
+	info.Host = hello.ServerName
+	info.ALPN = hello.ALPNProtocols
+	info.JA3 = hello.JA3()
+	info.JA4 = hello.JA4()
+	logger.Debug("ClientHello", "sni", hello.ServerName, "alpn", hello.ALPNProtocols,
+		"version", proxy.TLSVersionName(hello.MaxVersion()), "ech", hello.HasECH,
+		"resumption", hello.SessionResumption, "ja3", info.JA3, "ja4", info.JA4)
+	return info
+}
 
-	return ip, port, nil
+// findProxyForClientHello applies the ECH policy and then the routing rules
+// to a TLS or QUIC connection
+func findProxyForClientHello(cfg *config.Config, hello *proxy.ClientHello, info *config.ConnInfo, logger *slog.Logger) (*config.ProxyAction, error) {
+	if hello != nil && hello.HasECH {
+		if proxyAction := config.FindECHAction(hello.OuterServerName, cfg.ECH); proxyAction != nil {
+			logger.Info("ECH connection", "outer_name", hello.OuterServerName,
+				"policy", cfg.ECH.Policy, "action", proxyAction.Type)
+			return proxyAction, nil
+		}
+		// Browsers send GREASE ECH, which looks the same, on most connections
+		logger.Debug("ECH connection, routing by outer name", "outer_name", hello.OuterServerName)
+	}
+	return config.FindProxyForConn(info, cfg.Rules)
 }
 
-func handleHTTPSClient(conn net.Conn, rules []config.Rule, timeout int) {
+func handleHTTPClient(conn net.Conn, cfg *config.Config) {
 	defer func() {
 		if err := conn.Close(); err != nil {
 			// Connection close errors are expected and can be safely ignored
@@ -73,51 +165,42 @@ func handleHTTPSClient(conn net.Conn, rules []config.Rule, timeout int) {
 	}()
 
 	clientIP := conn.RemoteAddr().String()
-	originalIP := ""
-	originalPort := config.DEFAULT_HTTPS_PORT
-
-	// Try to get original destination using SO_ORIGINAL_DST
-	ip, port, err := getOriginalDst(conn)
-	if err == nil {
-		originalIP = ip
-		originalPort = port
-	} else {
-		// Fallback to RemoteAddr if SO_ORIGINAL_DST fails
-		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-			originalIP = tcpAddr.IP.String()
-		}
-	}
+	originalIP, originalPort := originalDestination(conn, config.DEFAULT_HTTP_PORT)
 
-	// Read initial data to parse SNI
+	// Read initial data to parse Host header
 	buf := make([]byte, config.BUFFER_SIZE)
 	n, err := conn.Read(buf)
 	if err != nil || n == 0 {
 		return
 	}
 
-	initialData := buf[:n]
-	sni := proxy.ParseSNI(initialData)
+	routeHTTP(conn, cfg, clientIP, originalIP, originalPort, buf[:n], config.DEFAULT_HTTP_PORT)
+}
 
-	if sni == "" {
-		log.Printf("SNI not found from %s -> %s:%d\n", clientIP, originalIP, originalPort)
-		// Use original IP as fallback (similar to Python version)
-		if originalIP != "" {
-			sni = originalIP
-		} else {
-			return
-		}
+// routeHTTP routes a connection by the Host header in its first request.
+// defaultPort is used when the Host header has no port.
+func routeHTTP(conn net.Conn, cfg *config.Config, clientIP, originalIP string, originalPort int, initialData []byte, defaultPort int) {
+	host, port := proxy.ParseHTTPHostWithDefault(initialData, defaultPort)
+
+	if host == "" {
+		slog.Info("Host header not found", "client", clientIP)
+		return
 	}
 
-	proxyAction, err := config.FindProxyForHost(sni, rules)
+	info := &config.ConnInfo{Host: host, DstIP: originalIP, DstPort: originalPort}
+	proxyAction, err := config.FindProxyForConn(info, cfg.Rules)
 	if err != nil {
-		log.Printf("Error finding proxy for %s: %v\n", sni, err)
+		slog.Error("Error finding proxy", "client", clientIP, "host", host, "error", err)
 		return
 	}
 
-	proxyConnection(sni, originalPort, originalIP, clientIP, conn, proxyAction, initialData, timeout)
+	proxyConnection(host, port, originalIP, originalPort, clientIP, conn, proxyAction, initialData, cfg.Listen.Timeout)
 }
 
-func handleHTTPClient(conn net.Conn, rules []config.Rule, timeout int) {
+// handleSniffClient serves the catch-all port. The first bytes decide
+// whether the connection is routed by SNI, by Host header or, for any other
+// protocol, by its original destination IP and port.
+func handleSniffClient(conn net.Conn, cfg *config.Config) {
 	defer func() {
 		if err := conn.Close(); err != nil {
 			// Connection close errors are expected and can be safely ignored
@@ -126,52 +209,118 @@ func handleHTTPClient(conn net.Conn, rules []config.Rule, timeout int) {
 	}()
 
 	clientIP := conn.RemoteAddr().String()
-	originalIP := ""
-
-	// Try to get original destination using SO_ORIGINAL_DST
-	ip, _, err := getOriginalDst(conn)
-	if err == nil {
-		originalIP = ip
-	} else {
-		// Fallback to RemoteAddr if SO_ORIGINAL_DST fails
-		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-			originalIP = tcpAddr.IP.String()
-		}
+	originalIP, originalPort, err := getOriginalDst(conn)
+	if err != nil {
+		slog.Warn("Original destination unknown", "client", clientIP, "error", err)
+		return
 	}
 
-	// Read initial data to parse Host header
+	// Clients of server-first protocols (SMTP, FTP) send nothing and are
+	// routed as raw TCP when the timeout expires
 	buf := make([]byte, config.BUFFER_SIZE)
+	if err := conn.SetReadDeadline(time.Now().Add(config.SNIFF_TIMEOUT * time.Second)); err != nil {
+		return
+	}
 	n, err := conn.Read(buf)
-	if err != nil || n == 0 {
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		return
 	}
 
 	initialData := buf[:n]
-	host, port := proxy.ParseHTTPHost(initialData)
-
-	if host == "" {
-		log.Printf("Host header not found from %s\n", clientIP)
-		return
+	protocol := proxy.DetectProtocol(initialData)
+	connLogger(clientIP, originalIP, originalPort).Debug("Detected protocol", "protocol", protocol.String(), "bytes", n)
+
+	switch protocol {
+	case proxy.ProtocolTLS:
+		routeTLS(&peekedConn{Conn: conn, peeked: initialData}, cfg, clientIP, originalIP, originalPort)
+	case proxy.ProtocolHTTP:
+		routeHTTP(conn, cfg, clientIP, originalIP, originalPort, initialData, originalPort)
+	default:
+		routeRaw(conn, cfg, clientIP, originalIP, originalPort, initialData)
 	}
+}
 
-	proxyAction, err := config.FindProxyForHost(host, rules)
+// routeRaw routes a connection of an unknown protocol by its original
+// destination, matching the rules against the destination IP
+func routeRaw(conn net.Conn, cfg *config.Config, clientIP, originalIP string, originalPort int, initialData []byte) {
+	info := &config.ConnInfo{Host: originalIP, DstIP: originalIP, DstPort: originalPort}
+	proxyAction, err := config.FindProxyForConn(info, cfg.Rules)
 	if err != nil {
-		log.Printf("Error finding proxy for %s: %v\n", host, err)
+		connLogger(clientIP, originalIP, originalPort).Error("Error finding proxy", "error", err)
 		return
 	}
 
-	proxyConnection(host, port, originalIP, clientIP, conn, proxyAction, initialData, timeout)
+	proxyConnection(originalIP, originalPort, originalIP, originalPort, clientIP, conn, proxyAction, initialData, cfg.Listen.Timeout)
+}
+
+// peekedConn returns bytes that were already read from the connection
+// before reading from it again
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite lets Pipe half-close the wrapped connection
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("half-close not supported")
+}
+
+// connLogger returns a logger with the client and original destination of a
+// connection
+func connLogger(clientIP, originalIP string, originalPort int) *slog.Logger {
+	return slog.With("client", clientIP, "original", net.JoinHostPort(originalIP, strconv.Itoa(originalPort)))
+}
+
+// tlsFingerprint identifies the TLS client of a connection in the access log
+type tlsFingerprint struct {
+	JA3 string
+	JA4 string
 }
 
 func proxyConnection(
 	targetHost string,
 	targetPort int,
 	originalIP string,
+	originalPort int,
 	clientIP string,
 	clientConn net.Conn,
 	proxyAction *config.ProxyAction,
 	initialData []byte,
 	timeout int,
+) {
+	proxyTLSConnection(targetHost, targetPort, originalIP, originalPort, clientIP, clientConn, proxyAction, initialData, timeout, tlsFingerprint{})
+}
+
+// proxyTLSConnection is proxyConnection for a TLS client, whose fingerprint
+// is written to the access log
+func proxyTLSConnection(
+	targetHost string,
+	targetPort int,
+	originalIP string,
+	originalPort int,
+	clientIP string,
+	clientConn net.Conn,
+	proxyAction *config.ProxyAction,
+	initialData []byte,
+	timeout int,
+	fingerprint tlsFingerprint,
 ) {
 	// If originalIP is not provided, try to extract it from client connection
 	if originalIP == "" {
@@ -179,29 +328,89 @@ func proxyConnection(
 			originalIP = tcpAddr.IP.String()
 		}
 	}
+	// Without SO_ORIGINAL_DST the client address stands in for it
+	knownOriginalIP := originalIP
+	if originalIP == hostIP(clientIP) {
+		knownOriginalIP = ""
+	}
+
+	logger := connLogger(clientIP, originalIP, targetPort)
+	// The rule matched even if its quota replaces the action
+	proxyAction.CountHit()
+	proxyAction, quotaCounter := applyQuota(currentConfig.Load(), hostIP(clientIP), proxyAction, logger)
+	action := strings.ToLower(proxyAction.Type)
+	upstream := ""
+	if proxyAction.Type == "PROXY" {
+		upstream = net.JoinHostPort(proxyAction.Host, strconv.Itoa(proxyAction.Port))
+	}
+	metrics.RuleHits.WithLabelValues(strconv.Itoa(proxyAction.Rule), action).Inc()
+
+	conn := &activeConn{
+		ID:       connections.newID(),
+		Client:   clientIP,
+		Host:     targetHost,
+		Target:   net.JoinHostPort(targetHost, strconv.Itoa(targetPort)),
+		OrigDst:  originalIP,
+		Action:   action,
+		Upstream: upstream,
+		Rule:     proxyAction.Rule,
+		TLS:      fingerprint,
+		Started:  time.Now(),
+	}
+	closeReason, closeCause := accesslog.REASON_ERROR, error(nil)
+	defer func() {
+		logAccess(conn, closeReason, closeCause)
+	}()
 
+	if proxyAction.Type == "REJECT" {
+		logger.Info("Reject", "target", conn.Target, "rule", proxyAction.Rule)
+		if tcpConn, ok := clientConn.(*net.TCPConn); ok {
+			// Closing the client connection sends a reset
+			_ = tcpConn.SetLinger(0)
+		}
+		closeReason = accesslog.REASON_REJECTED
+		return
+	}
 	if proxyAction.Type == "DROP" {
-		log.Printf("%s => %s:%d: Drop for %s:%d\n", clientIP, originalIP, targetPort, targetHost, targetPort)
+		logger.Info("Drop", "target", conn.Target, "rule", proxyAction.Rule)
+		closeReason = accesslog.REASON_DROPPED
 		return
 	}
 
 	var remoteConn net.Conn
 	var err error
 
+	dialOptions := outboundOptions(currentConfig.Load(), upstream, proxyAction)
+	dialStart := time.Now()
 	if proxyAction.Type == "PROXY" && proxyAction.Host != "" && proxyAction.Port != 0 {
-		log.Printf("%s => %s:%d: Proxying connection for %s:%d via %s:%d\n",
-			clientIP, originalIP, targetPort, targetHost, targetPort, proxyAction.Host, proxyAction.Port)
+		logger.Info("Proxying connection", "target", conn.Target, "upstream", upstream, "rule", proxyAction.Rule)
 
-		remoteConn, err = proxy.ConnectViaProxy(proxyAction.Host, proxyAction.Port, targetHost, targetPort, clientIP, timeout)
+		remoteConn, err = proxy.ConnectViaProxy(proxyAction.Host, proxyAction.Port, targetHost, targetPort, clientIP, timeout, dialOptions)
+		upstreams.record(upstream, time.Since(dialStart), err)
+		if err != nil {
+			status := "error"
+			var connectErr *proxy.ConnectError
+			if errors.As(err, &connectErr) {
+				status = strconv.Itoa(connectErr.StatusCode)
+			}
+			metrics.UpstreamConnectFailures.WithLabelValues(upstream, status).Inc()
+		}
 	} else {
-		log.Printf("%s => %s:%d: Direct connection for %s:%d\n", clientIP, originalIP, targetPort, targetHost, targetPort)
-		remoteConn, err = proxy.ConnectDirect(targetHost, targetPort, timeout)
+		dialHost, dialPort := connectTarget(proxyAction.ConnectTo, targetHost, targetPort, knownOriginalIP, originalPort, dialOptions.Resolver, logger)
+		if dialHost != targetHost || dialPort != targetPort {
+			logger.Info("Direct connection", "target", conn.Target, "address", net.JoinHostPort(dialHost, strconv.Itoa(dialPort)), "rule", proxyAction.Rule)
+		} else {
+			logger.Info("Direct connection", "target", conn.Target, "rule", proxyAction.Rule)
+		}
+		remoteConn, err = proxy.ConnectDirect(dialHost, dialPort, timeout, dialOptions)
 	}
 
 	if err != nil {
-		log.Printf("Connection failed: %v\n", err)
+		logger.Warn("Connection failed", "target", conn.Target, "upstream", upstream, "error", err)
+		closeReason, closeCause = accesslog.REASON_DIAL_ERROR, err
 		return
 	}
+	metrics.DialDuration.WithLabelValues(action, upstream).Observe(time.Since(dialStart).Seconds())
 	defer func() {
 		if closeErr := remoteConn.Close(); closeErr != nil {
 			// Connection close errors are expected and can be safely ignored
@@ -209,21 +418,53 @@ func proxyConnection(
 		}
 	}()
 
+	metrics.ActiveTunnels.Inc()
+	defer metrics.ActiveTunnels.Dec()
+
+	conn.kill = func() {
+		// Closing both sides ends the pipes
+		_ = clientConn.Close()
+		_ = remoteConn.Close()
+	}
+	connections.add(conn)
+	defer connections.remove(conn.ID)
+	if quotaCounter != nil {
+		quotaCounter.exhausted = func() {
+			metrics.QuotaExceeded.WithLabelValues(quotaCounter.group).Inc()
+			logger.Info("Quota exhausted, closing the connection", "group", quotaCounter.group, "limit", quotaCounter.limit)
+			connections.kill(conn.ID, accesslog.REASON_QUOTA)
+		}
+	}
+
 	// Set read/write deadlines
 	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
 	if err := remoteConn.SetDeadline(deadline); err != nil {
-		log.Printf("Failed to set deadline: %v\n", err)
+		logger.Error("Failed to set deadline", "error", err)
+		closeCause = err
 		return
 	}
 	if err := clientConn.SetDeadline(deadline); err != nil {
-		log.Printf("Failed to set deadline: %v\n", err)
+		logger.Error("Failed to set deadline", "error", err)
+		closeCause = err
 		return
 	}
 
+	counterIn := []proxy.ByteCounter{&conn.BytesIn, metrics.Bytes.WithLabelValues("in", action, upstream)}
+	counterOut := []proxy.ByteCounter{&conn.BytesOut, metrics.Bytes.WithLabelValues("out", action, upstream)}
+	if quotaCounter != nil {
+		counterIn = append(counterIn, quotaCounter)
+		counterOut = append(counterOut, quotaCounter)
+	}
+
 	// Send initial data if we have it
 	if len(initialData) > 0 {
-		if _, err := remoteConn.Write(initialData); err != nil {
-			log.Printf("Failed to send initial data: %v\n", err)
+		n, err := remoteConn.Write(initialData)
+		for _, c := range counterIn {
+			c.Add(uint64(n))
+		}
+		if err != nil {
+			logger.Warn("Failed to send initial data", "error", err)
+			closeCause = err
 			return
 		}
 	}
@@ -232,70 +473,390 @@ func proxyConnection(
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	upload, download, releaseBuckets := bandwidth.acquire(currentConfig.Load(), proxyAction, hostIP(clientIP), upstream)
+	defer releaseBuckets()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Pipe data between client and remote
-	go proxy.Pipe(ctx, clientConn, remoteConn, &wg)
-	go proxy.Pipe(ctx, remoteConn, clientConn, &wg)
+	// Pipe data between client and remote. The direction that ends first
+	// tells why the connection was closed.
+	type pipeResult struct {
+		fromClient bool
+		err        error
+	}
+	results := make(chan pipeResult, 2)
+	// Pipe splices between TCP connections, so pass the connection itself
+	// once the peeked bytes were read
+	client := clientConn
+	if peeked, ok := client.(*peekedConn); ok && len(peeked.peeked) == 0 {
+		client = peeked.Conn
+	}
+	go func() {
+		results <- pipeResult{true, proxy.Pipe(ctx, client, remoteConn, &wg, upload, counterIn...)}
+	}()
+	go func() {
+		results <- pipeResult{false, proxy.Pipe(ctx, remoteConn, client, &wg, download, counterOut...)}
+	}()
 
+	// A direction ending with EOF was half-closed and the other one goes
+	// on until its own EOF, an error or the connection timeout. Otherwise
+	// both connections are closed and cancel wakes the other direction if
+	// it waits for a bandwidth limit.
+	first := <-results
+	if !errors.Is(first.err, io.EOF) {
+		cancel()
+	}
 	wg.Wait()
+	closeReason, closeCause = pipeCloseReason(first.fromClient, first.err, conn.killedBy())
+}
+
+// outboundOptions returns the socket options and resolver for a
+// connection through upstream, empty for DIRECT, with action, nil for
+// connections not matched by a rule
+func outboundOptions(cfg *config.Config, upstream string, action *config.ProxyAction) proxy.DialOptions {
+	if cfg == nil {
+		return proxy.DialOptions{}
+	}
+	var rule *config.Outbound
+	resolver := ""
+	if action != nil {
+		rule, resolver = action.Outbound, action.Resolver
+	}
+	o := cfg.Outbound.FindOutbound(upstream, rule)
+	return proxy.DialOptions{Mark: o.Mark, Interface: o.Interface, SourceAddress: o.SourceAddress, Resolver: hostResolver(resolver)}
+}
+
+// pipeCloseReason classifies how the first direction of a connection ended
+// unless the connection was closed through the registry
+func pipeCloseReason(fromClient bool, err error, killedBy string) (string, error) {
+	var ne net.Error
+	switch {
+	case killedBy != "":
+		return killedBy, nil
+	case errors.Is(err, io.EOF) && fromClient:
+		return accesslog.REASON_CLIENT_EOF, nil
+	case errors.Is(err, io.EOF):
+		return accesslog.REASON_REMOTE_EOF, nil
+	case errors.As(err, &ne) && ne.Timeout():
+		return accesslog.REASON_TIMEOUT, nil
+	default:
+		return accesslog.REASON_ERROR, err
+	}
 }
 
-func StartServers(config *config.Config) error {
+// logAccess writes the access log record of a closed connection
+func logAccess(conn *activeConn, reason string, err error) {
+	logger := accessLog.Load()
+	if logger == nil {
+		return
+	}
+
+	record := &accesslog.Record{
+		Time:        time.Now(),
+		ID:          conn.ID,
+		Client:      conn.Client,
+		OriginalIP:  conn.OrigDst,
+		Host:        conn.Host,
+		Target:      conn.Target,
+		Rule:        conn.Rule,
+		Action:      conn.Action,
+		Upstream:    conn.Upstream,
+		BytesIn:     conn.BytesIn.Load(),
+		BytesOut:    conn.BytesOut.Load(),
+		DurationMs:  float64(time.Since(conn.Started).Microseconds()) / 1000,
+		JA3:         conn.TLS.JA3,
+		JA4:         conn.TLS.JA4,
+		CloseReason: reason,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := logger.Log(record); err != nil {
+		slog.Error("Failed to write access log", "error", err)
+	}
+}
+
+// StartServers opens the listeners and serves connections until ctx is
+// done. Then the listeners are closed and active connections get the drain
+// period to finish before they are closed. Listeners passed by a previous
+// process on upgrade are used instead of opening new ones.
+func StartServers(ctx context.Context, config *config.Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	listenConfig := config.Listen
 	rules := config.Rules
+	currentConfig.Store(config)
 
-	// Start HTTPS server
-	httpsListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.HTTPSPort))
-	if err != nil {
-		return fmt.Errorf("failed to start HTTPS server: %w", err)
+	if err := openAccessLog(config.Logging.AccessLog); err != nil {
+		return err
 	}
 	defer func() {
-		if closeErr := httpsListener.Close(); closeErr != nil {
-			// Listener close errors are expected and can be safely ignored
-			_ = closeErr // explicitly ignore the error
+		if logger := accessLog.Swap(nil); logger != nil {
+			if closeErr := logger.Close(); closeErr != nil {
+				// Log file close errors are expected and can be safely ignored
+				_ = closeErr // explicitly ignore the error
+			}
 		}
 	}()
 
+	if err := openQuotaStore(config.Quotas); err != nil {
+		return err
+	}
+
+	setOriginalDstResolver(newOriginalDstResolver(listenConfig.Mode))
+	if err := applyDNSConfig(config); err != nil {
+		return fmt.Errorf("failed to set up dns: %w", err)
+	}
+	if err := applyFakeIPConfig(config); err != nil {
+		return fmt.Errorf("failed to set up fake IPs: %w", err)
+	}
+
+	// Listeners are closed first on shutdown, or on return if starting fails
+	inherited := inheritFiles()
+	listeners := &listenerGroup{}
+	defer listeners.close()
+
+	// Start HTTPS server
+	httpsAddress := fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.HTTPSPort)
+	httpsListener, err := inherited.listen("https", httpsAddress, func() (net.Listener, error) {
+		return listenTCP(httpsAddress, listenConfig.Mode)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start HTTPS server: %w", err)
+	}
+	listeners.add("https", httpsListener.(inheritable), func() {
+		acceptLoop(httpsListener, "https", handleHTTPSClient)
+	})
+
 	// Start HTTP server
-	httpListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.HTTPPort))
+	httpAddress := fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.HTTPPort)
+	httpListener, err := inherited.listen("http", httpAddress, func() (net.Listener, error) {
+		return listenTCP(httpAddress, listenConfig.Mode)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to start HTTP server: %w", err)
 	}
-	defer func() {
-		if closeErr := httpListener.Close(); closeErr != nil {
-			// Listener close errors are expected and can be safely ignored
-			_ = closeErr // explicitly ignore the error
+	listeners.add("http", httpListener.(inheritable), func() {
+		acceptLoop(httpListener, "http", handleHTTPClient)
+	})
+
+	// Start QUIC server if enabled
+	var quicServer *quicServer
+	if listenConfig.QUICPort != 0 {
+		quicAddress := fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.QUICPort)
+		quicConn, err := inherited.listenUDP("quic", quicAddress, func() (*net.UDPConn, error) {
+			return listenUDP(quicAddress)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start QUIC server: %w", err)
 		}
-	}()
 
-	log.Printf("SNI proxy (HTTPS) listening on %s:%d\n", listenConfig.Host, listenConfig.HTTPSPort)
-	log.Printf("Host proxy (HTTP) listening on %s:%d\n", listenConfig.Host, listenConfig.HTTPPort)
-	log.Println("Routing rules:")
-	for i, rule := range rules {
-		log.Printf("  %d. %s -> %s\n", i+1, rule.Pattern, rule.Proxy)
+		slog.Info("SNI proxy (QUIC) listening", "address", quicAddress+"/udp")
+		quicServer = newQUICServer(quicConn, currentConfig.Load)
+		listeners.add("quic", quicConn, quicServer.serve)
 	}
 
-	// Handle HTTPS connections
-	go func() {
-		for {
-			conn, err := httpsListener.Accept()
+	// Start the protocol sniffing server if enabled
+	if listenConfig.SniffPort != 0 {
+		sniffAddress := fmt.Sprintf("%s:%d", listenConfig.Host, listenConfig.SniffPort)
+		sniffListener, err := inherited.listen("sniff", sniffAddress, func() (net.Listener, error) {
+			return listenTCP(sniffAddress, listenConfig.Mode)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start sniff server: %w", err)
+		}
+
+		slog.Info("Sniffing proxy (TLS/HTTP/raw) listening", "address", sniffAddress)
+		listeners.add("sniff", sniffListener.(inheritable), func() {
+			acceptLoop(sniffListener, "sniff", handleSniffClient)
+		})
+	}
+
+	// Start the fake IP DNS server if enabled
+	if config.FakeIP.Listen != "" {
+		dnsConn, err := inherited.listenUDP("dns", config.FakeIP.Listen, func() (*net.UDPConn, error) {
+			addr, err := net.ResolveUDPAddr("udp", config.FakeIP.Listen)
 			if err != nil {
-				log.Printf("HTTPS accept error: %v\n", err)
-				continue
+				return nil, err
 			}
-			go handleHTTPSClient(conn, rules, listenConfig.Timeout)
+			return net.ListenUDP("udp", addr)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start DNS server: %w", err)
 		}
-	}()
+		listeners.add("dns", dnsConn, func() {
+			serveDNS(dnsConn)
+		})
+
+		dnsListener, err := inherited.listen("dns-tcp", config.FakeIP.Listen, func() (net.Listener, error) {
+			return net.Listen("tcp", config.FakeIP.Listen)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start DNS server: %w", err)
+		}
+		listeners.add("dns-tcp", dnsListener.(inheritable), func() {
+			serveDNSTCP(dnsListener)
+		})
+		slog.Info("Fake IP DNS server listening", "address", config.FakeIP.Listen, "pool", config.FakeIP.Pool)
+	}
+
+	// Start the metrics endpoint if enabled
+	if config.Metrics.Listen != "" {
+		metricsListener, err := inherited.listen("metrics", config.Metrics.Listen, func() (net.Listener, error) {
+			return net.Listen("tcp", config.Metrics.Listen)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(config.Metrics.Path, metrics.Default.Handler())
+		slog.Info("Metrics listening", "url", "http://"+config.Metrics.Listen+config.Metrics.Path)
+		listeners.add("metrics", metricsListener.(inheritable), func() {
+			serveHTTP(metricsListener, mux, "metrics")
+		})
+	}
+
+	// Start the admin API if enabled
+	if config.Admin.Listen != "" {
+		adminListener, err := inherited.listen("admin", config.Admin.Listen, func() (net.Listener, error) {
+			return listenAdmin(config.Admin.Listen)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start admin server: %w", err)
+		}
+
+		slog.Info("Admin API listening", "address", config.Admin.Listen)
+		listeners.add("admin", adminListener.(inheritable), func() {
+			serveHTTP(adminListener, newAdminHandler(), "admin")
+		})
+	}
+
+	slog.Info("SNI proxy (HTTPS) listening", "address", httpsAddress)
+	slog.Info("Host proxy (HTTP) listening", "address", httpAddress)
+	for i, rule := range rules {
+		slog.Info("Routing rule", "rule", i+1, "pattern", rule.Pattern, "proxy", rule.Proxy)
+	}
+	slog.Info("ECH policy", "policy", config.ECH.Policy)
+
+	listeners.start()
+	inherited.done()
+
+	// MAINPID tells systemd about the new main process after an upgrade
+	notifySystemd(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	go systemd.Watchdog(ctx, func(err error) {
+		slog.Warn("Cannot send watchdog notification", "error", err)
+	})
+	if config.Quotas.StateFile != "" {
+		go saveQuotasPeriodically(ctx, time.Duration(max(config.Quotas.SaveInterval, 1))*time.Second)
+	}
 
-	// Handle HTTP connections
+	// SIGUSR2 hands the listeners to a new process, this one then drains
+	// its connections
+	var upgraded atomic.Bool
+	var quotaBase []quota.Usage // usage saved for the new process
+	watchSignals(ctx, func() {
+		slog.Info("Starting a new process for the upgrade")
+		// The new process continues from the saved usage, the usage of the
+		// draining connections is handed off after them
+		quotaBase = saveQuotasForHandoff()
+		if err := upgradeProcess(listeners); err != nil {
+			slog.Error("Upgrade failed", "error", err)
+			return
+		}
+		slog.Info("New process is serving, draining connections")
+		upgraded.Store(true)
+		cancel()
+	})
+
+	<-ctx.Done()
+	slog.Info("Shutting down, closing listeners")
+	if !upgraded.Load() {
+		// After an upgrade the service keeps running in the new process
+		notifySystemd("STOPPING=1")
+	}
+	listeners.close()
+
+	drainConnections(time.Duration(listenConfig.DrainTimeout) * time.Second)
+	if quicServer != nil {
+		quicServer.closeSessions()
+	}
+	if upgraded.Load() {
+		// After an upgrade the new process owns the state file
+		handOffQuotas(quotaBase)
+	} else {
+		saveQuotas()
+	}
+	return nil
+}
+
+// notifySystemd sends a state to systemd, see systemd.Notify
+func notifySystemd(state string) {
+	if err := systemd.Notify(state); err != nil {
+		slog.Warn("Cannot notify systemd", "state", state, "error", err)
+	}
+}
+
+// acceptLoop serves a listener until it is closed or paused
+func acceptLoop(listener net.Listener, name string, handle func(net.Conn, *config.Config)) {
 	for {
-		conn, err := httpListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("HTTP accept error: %v\n", err)
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			slog.Error("Accept error", "listener", name, "error", err)
+			metrics.AcceptErrors.WithLabelValues(name).Inc()
+			continue
+		}
+		metrics.AcceptedConnections.WithLabelValues(name).Inc()
+
+		// Waiting for max_connections here leaves further connections in
+		// the kernel backlog
+		cfg := currentConfig.Load()
+		if !limiter.acquire(cfg.Advanced) {
+			rejectConn(conn, name, "max_connections")
 			continue
 		}
-		go handleHTTPClient(conn, rules, listenConfig.Timeout)
+
+		done := clients.track(conn)
+		go func() {
+			defer done()
+			defer limiter.release()
+
+			release, limit := limiter.acquireClient(cfg.Advanced, remoteIP(conn))
+			if limit != "" {
+				rejectConn(conn, name, limit)
+				return
+			}
+			defer release()
+			handle(conn, cfg)
+		}()
+	}
+}
+
+// drainConnections waits for the handlers of accepted connections to return.
+// Connections still open after timeout are closed.
+func drainConnections(timeout time.Duration) {
+	active := clients.count()
+	if active == 0 {
+		return
+	}
+	slog.Info("Waiting for active connections", "connections", active, "timeout", timeout)
+	if clients.wait(timeout) {
+		slog.Info("All connections finished")
+		return
+	}
+
+	relayed := connections.killAll(accesslog.REASON_SHUTDOWN)
+	slog.Warn("Drain period expired, closing connections", "connections", clients.count(), "relayed", relayed)
+	clients.closeAll()
+
+	// Handlers return once their connections are closed, unless they are
+	// still dialing
+	if !clients.wait(shutdownGracePeriod) {
+		slog.Warn("Connections did not close in time", "connections", clients.count())
 	}
 }
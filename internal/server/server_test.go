@@ -4,16 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"tproxy/internal/accesslog"
 	"tproxy/internal/config"
+	"tproxy/internal/metrics"
 	"tproxy/internal/proxy"
 )
 
@@ -96,7 +102,7 @@ func TestProxyConnection_Direct(t *testing.T) {
 	proxyAction := &config.ProxyAction{Type: "DIRECT"}
 	initialData := []byte(httpRequest)
 	// This should attempt to connect and fail (which is expected in test environment)
-	proxyConnection(targetHost, targetPort, originalIP, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
+	proxyConnection(targetHost, targetPort, originalIP, targetPort, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
 
 	// Verify the connection was attempted (connection will be closed)
 	if !clientConn.closed {
@@ -116,7 +122,7 @@ func TestProxyConnection_Drop(t *testing.T) {
 	originalIP := "192.168.1.1"
 	clientIP := "192.168.1.2"
 	initialData := []byte(httpRequest)
-	proxyConnection(targetHost, targetPort, originalIP, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
+	proxyConnection(targetHost, targetPort, originalIP, targetPort, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
 
 	// For DROP action, the connection should be handled (may not necessarily close immediately in mock)
 	// We'll verify the function executed without panicking
@@ -139,7 +145,7 @@ func TestProxyConnection_Proxy(t *testing.T) {
 	clientIP := "192.168.1.2"
 	initialData := []byte(httpRequest)
 	// This will attempt proxy connection and fail (expected in test)
-	proxyConnection(targetHost, targetPort, originalIP, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
+	proxyConnection(targetHost, targetPort, originalIP, targetPort, clientIP, clientConn, proxyAction, initialData, 30) // 30 second timeout
 
 	// For PROXY action, connection attempt will fail in test environment
 	// We'll verify the function executed without panicking
@@ -237,7 +243,7 @@ func TestStartServers_InvalidPorts(t *testing.T) {
 		Rules: []config.Rule{},
 	}
 
-	err := StartServers(invalidConfig)
+	err := StartServers(context.Background(), invalidConfig)
 	if err == nil {
 		t.Error("Expected StartServers to fail with invalid ports")
 	}
@@ -343,7 +349,7 @@ func TestContextCancellation(t *testing.T) {
 	wg.Add(1)
 
 	// Start pipe operation
-	go proxy.Pipe(ctx, clientConn, serverConn, &wg)
+	go proxy.Pipe(ctx, clientConn, serverConn, &wg, nil)
 
 	// Cancel context immediately
 	cancel()
@@ -357,3 +363,431 @@ func TestContextCancellation(t *testing.T) {
 		t.Error("Expected write to fail after context cancellation")
 	}
 }
+
+// startEchoServer starts a TCP server echoing everything it receives
+func startEchoServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestRouteRaw_ByDestination(t *testing.T) {
+	echo := startEchoServer(t)
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules: []config.Rule{
+			{Pattern: ".*", Proxy: "DROP", Ports: []int{22}},
+			{Pattern: "127\\.0\\.0\\.1", Proxy: "DIRECT"},
+		},
+	}
+
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go func() {
+		routeRaw(server, cfg, "192.168.1.2:40000", "127.0.0.1", echo.Port, []byte("SSH-2.0-test\r\n"))
+		_ = server.Close()
+	}()
+
+	// The peeked bytes are forwarded before anything else
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	reply := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected echoed initial data: %v", err)
+	}
+	if string(reply) != "SSH-2.0-test\r\n" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestRouteRaw_DropByPort(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules:  []config.Rule{{Pattern: ".*", Proxy: "DROP", Ports: []int{22}}},
+	}
+
+	clientConn := newMockConn()
+	routeRaw(clientConn, cfg, "192.168.1.2:40000", "192.0.2.10", 22, nil)
+
+	if len(clientConn.GetWrittenData()) != 0 {
+		t.Error("Expected no data for a dropped connection")
+	}
+}
+
+func TestRouteRaw_HalfClose(t *testing.T) {
+	// The server answers once the request is complete, i.e. on EOF
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("reply to "), request...))
+	}()
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules:  []config.Rule{{Pattern: "127\\.0\\.0\\.1", Proxy: "DIRECT"}},
+	}
+	client, server := tcpPair(t)
+	go func() {
+		routeRaw(server, cfg, "192.168.1.2:40000", "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, nil)
+		_ = server.Close()
+	}()
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Expected the reply after the half-close: %v", err)
+	}
+	if string(reply) != "reply to request" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestPeekedConn_Read(t *testing.T) {
+	// The sniff listener consumed the record header, the rest is still unread
+	data := []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}
+	conn := newMockConn()
+	conn.WriteData(data[5:])
+	peeked := &peekedConn{Conn: conn, peeked: data[:5]}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(peeked, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected the peeked bytes followed by the remaining data, got %x", got)
+	}
+}
+
+func TestProxyConnection_RuleHitMetric(t *testing.T) {
+	hits := metrics.RuleHits.WithLabelValues("7", "drop")
+	before := hits.Value()
+
+	proxyAction := &config.ProxyAction{Type: "DROP", Rule: 7}
+	proxyConnection("blocked.com", 443, "192.0.2.1", 443, "192.168.1.2", newMockConn(), proxyAction, nil, 30)
+
+	if got := hits.Value() - before; got != 1 {
+		t.Errorf("Expected one rule hit, got %d", got)
+	}
+}
+
+// captureAccessLog installs a JSON access log writing to a buffer
+func captureAccessLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+
+	buf := &lockedBuffer{}
+	previous := accessLog.Swap(accesslog.New(buf, accesslog.FORMAT_JSON))
+	t.Cleanup(func() {
+		accessLog.Store(previous)
+	})
+	return buf
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the records of one client, connections of other tests
+// may still be closing in the background
+func (b *lockedBuffer) records(t *testing.T, client string) []accesslog.Record {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []accesslog.Record
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r accesslog.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Invalid access log line %q: %v", line, err)
+		}
+		if r.Client == client {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func TestProxyConnection_AccessLog(t *testing.T) {
+	buf := captureAccessLog(t)
+	echo := startEchoServer(t)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		proxyAction := &config.ProxyAction{Type: "DIRECT", Rule: 2}
+		proxyConnection("127.0.0.1", echo.Port, "127.0.0.1", echo.Port, "192.168.1.2:40100", server, proxyAction, []byte("ping"), 5)
+		close(done)
+	}()
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected echoed data: %v", err)
+	}
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyConnection did not return after the client closed")
+	}
+
+	records := buf.records(t, "192.168.1.2:40100")
+	if len(records) != 1 {
+		t.Fatalf("Expected one access log record, got %d", len(records))
+	}
+	r := records[0]
+	if r.ID == 0 || r.Rule != 2 || r.Action != "direct" {
+		t.Errorf("Unexpected record %+v", r)
+	}
+	if r.BytesIn != 4 || r.BytesOut != 4 {
+		t.Errorf("Expected 4 bytes each way, got in=%d out=%d", r.BytesIn, r.BytesOut)
+	}
+	if r.CloseReason != accesslog.REASON_CLIENT_EOF && r.CloseReason != accesslog.REASON_ERROR {
+		t.Errorf("Unexpected close reason %q", r.CloseReason)
+	}
+}
+
+// goClientHello returns the ClientHello of a Go TLS client for serverName
+func goClientHello(t *testing.T, serverName string) ([]byte, *proxy.ClientHello) {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	initialData, err := proxy.ReadClientHello(server, config.MAX_CLIENT_HELLO_SIZE, 5*time.Second)
+	_ = server.Close()
+	_ = client.Close()
+	if err != nil {
+		t.Fatalf("ReadClientHello failed: %v", err)
+	}
+	hello, err := proxy.ParseClientHello(initialData)
+	if err != nil {
+		t.Fatalf("ParseClientHello failed: %v", err)
+	}
+	return initialData, hello
+}
+
+func TestRouteTLS_AccessLogFingerprints(t *testing.T) {
+	buf := captureAccessLog(t)
+	initialData, hello := goClientHello(t, "blocked.com")
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{Timeout: 5},
+		Rules:  []config.Rule{{Pattern: ".*", Proxy: "DROP"}},
+	}
+	conn := newMockConn()
+	conn.readBuf.Write(initialData)
+	routeTLS(conn, cfg, "192.168.1.2:40102", "", 443)
+
+	records := buf.records(t, "192.168.1.2:40102")
+	if len(records) != 1 || records[0].Host != "blocked.com" {
+		t.Fatalf("Expected one record for blocked.com, got %+v", records)
+	}
+	if r := records[0]; r.JA3 == "" || r.JA3 != hello.JA3() || r.JA4 != hello.JA4() {
+		t.Errorf("Expected JA3 %s and JA4 %s, got %q %q", hello.JA3(), hello.JA4(), r.JA3, r.JA4)
+	}
+
+	// Connections without a ClientHello have no fingerprints
+	proxyConnection("blocked.com", 443, "192.0.2.1", 443, "192.168.1.2:40103", newMockConn(), &config.ProxyAction{Type: "DROP"}, nil, 30)
+	if records := buf.records(t, "192.168.1.2:40103"); len(records) != 1 || records[0].JA3 != "" || records[0].JA4 != "" {
+		t.Errorf("Expected a record without fingerprints, got %+v", records)
+	}
+}
+
+func TestProxyConnection_AccessLogDrop(t *testing.T) {
+	buf := captureAccessLog(t)
+
+	proxyAction := &config.ProxyAction{Type: "DROP", Rule: 1}
+	proxyConnection("blocked.com", 443, "192.0.2.1", 443, "192.168.1.2:40101", newMockConn(), proxyAction, nil, 30)
+
+	records := buf.records(t, "192.168.1.2:40101")
+	if len(records) != 1 || records[0].CloseReason != accesslog.REASON_DROPPED || records[0].Host != "blocked.com" {
+		t.Errorf("Expected one dropped record, got %+v", records)
+	}
+}
+
+func TestPipeCloseReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		fromClient bool
+		err        error
+		killedBy   string
+		expected   string
+	}{
+		{"ClientEOF", true, io.EOF, "", accesslog.REASON_CLIENT_EOF},
+		{"RemoteEOF", false, io.EOF, "", accesslog.REASON_REMOTE_EOF},
+		{"Timeout", true, os.ErrDeadlineExceeded, "", accesslog.REASON_TIMEOUT},
+		{"Killed", true, net.ErrClosed, accesslog.REASON_KILLED, accesslog.REASON_KILLED},
+		{"Shutdown", false, io.EOF, accesslog.REASON_SHUTDOWN, accesslog.REASON_SHUTDOWN},
+		{"Error", false, net.ErrClosed, "", accesslog.REASON_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, _ := pipeCloseReason(tt.fromClient, tt.err, tt.killedBy)
+			if reason != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, reason)
+			}
+		})
+	}
+}
+
+// freePort returns a TCP port on the loopback interface that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	return port
+}
+
+func TestStartServers_ShutdownDrainsConnections(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	accessLogPath := filepath.Join(t.TempDir(), "access.log")
+	cfg := &config.Config{
+		Listen: config.ListenConfig{
+			Host:         "127.0.0.1",
+			HTTPSPort:    freePort(t),
+			HTTPPort:     freePort(t),
+			Timeout:      60,
+			DrainTimeout: 1,
+		},
+		Rules:   []config.Rule{{Pattern: ".*", Proxy: "DIRECT"}},
+		Logging: config.LoggingConfig{AccessLog: config.AccessLogConfig{Output: accessLogPath}},
+	}
+	httpAddr := fmt.Sprintf("127.0.0.1:%d", cfg.Listen.HTTPPort)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- StartServers(ctx, cfg)
+	}()
+
+	var client net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if client, err = net.Dial("tcp", httpAddr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Proxy did not start: %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	// The echo server returns the request, so the tunnel is established
+	request := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr)
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("Read through the tunnel failed: %v", err)
+	}
+
+	cancel()
+	start := time.Now()
+
+	// The tunnel stays open during the drain period, then it is closed
+	if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline failed: %v", err)
+	}
+	if _, err := client.Read(buf); err == nil {
+		t.Error("Expected the tunnel to be closed")
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Tunnel closed after %v, before the drain period", elapsed)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("StartServers returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartServers did not return")
+	}
+
+	if conn, err := net.Dial("tcp", httpAddr); err == nil {
+		_ = conn.Close()
+		t.Error("Expected the listener to be closed")
+	}
+	data, err := os.ReadFile(accessLogPath)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	if !strings.Contains(string(data), `"close_reason":"shutdown"`) {
+		t.Errorf("Expected a shutdown record, got %s", data)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package server
+
+import "context"
+
+// watchSignals does nothing, the control signals do not exist on this platform
+func watchSignals(ctx context.Context, upgrade func()) {}
@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignals handles the signals that control a running proxy:
+//
+//	SIGHUP   reload the configuration
+//	SIGUSR1  reopen the log files, e.g. after logrotate moved them
+//	SIGUSR2  call upgrade
+//
+// SIGINT and SIGTERM are left to the caller of StartServers, which cancels
+// its context. The handler stops when ctx is done.
+func watchSignals(ctx context.Context, upgrade func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				switch sig {
+				case syscall.SIGHUP:
+					if _, err := reloadConfig(); err != nil {
+						slog.Error("Configuration reload failed", "error", err)
+					}
+				case syscall.SIGUSR1:
+					reopenLogs()
+				case syscall.SIGUSR2:
+					upgrade()
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// listenUDP opens the UDP listener for intercepted traffic. The socket asks
+// the kernel for the original destination of each datagram, which TPROXY
+// rules preserve, and is made transparent when the process may do so.
+func listenUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+					// Only needed for TPROXY, REDIRECT works without it
+					slog.Warn("UDP listener is not transparent (TPROXY unavailable)", "error", err)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// readUDP reads a datagram and returns the client address and, if the
+// kernel reported one that differs from the listener, the original
+// destination of the datagram.
+func readUDP(conn *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, client, nil, nil
+	}
+
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	for _, m := range messages {
+		if m.Header.Level != syscall.SOL_IP || m.Header.Type != syscall.IP_ORIGDSTADDR || len(m.Data) < 8 {
+			continue
+		}
+		// struct sockaddr_in: family, port (network order), address
+		origDst := &net.UDPAddr{
+			IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]),
+			Port: int(m.Data[2])<<8 | int(m.Data[3]),
+		}
+		if local != nil && origDst.Port == local.Port {
+			// Addressed to the listener itself, e.g. after REDIRECT
+			return n, client, nil, nil
+		}
+		return n, client, origDst, nil
+	}
+	return n, client, nil, nil
+}
+
+// listenTransparentUDP opens a socket bound to a foreign address, the
+// original destination of a TPROXY session, so replies reach the client
+// from the address it sent its datagrams to.
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenUDP opens the UDP listener. Original destinations are only
+// available on Linux.
+func listenUDP(address string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp4", addr)
+}
+
+// readUDP reads a datagram and returns the client address. The original
+// destination is never known on this platform.
+func readUDP(conn *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, client, err := conn.ReadFromUDP(buf)
+	return n, client, nil, err
+}
+
+// listenTransparentUDP is not supported on this platform.
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("transparent UDP sockets are not supported on this platform")
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"tproxy/internal/systemd"
+)
+
+// UPGRADE_FDS_ENV names the file descriptors a new process inherits on a
+// binary upgrade, comma separated and starting at 3. "ready" is a pipe that
+// is written to once the listeners are served.
+const UPGRADE_FDS_ENV = "TPROXY_UPGRADE_FDS"
+
+// upgradeReadyTimeout is how long the old process waits for the new one
+const upgradeReadyTimeout = 30 * time.Second
+
+// inheritable is a listening socket that can be passed to a new process:
+// *net.TCPListener, *net.UnixListener or *net.UDPConn
+type inheritable interface {
+	SyscallConn() (syscall.RawConn, error)
+	SetDeadline(t time.Time) error
+	Close() error
+}
+
+type groupListener struct {
+	name  string
+	conn  inheritable
+	serve func() // returns when the socket is closed or its deadline expired
+}
+
+// listenerGroup holds the listening sockets and the loops serving them. For
+// an upgrade the loops are paused without closing the sockets, so new
+// connections wait in the backlog until the new process accepts them.
+type listenerGroup struct {
+	mu        sync.Mutex // held while the sockets are passed on
+	listeners []groupListener
+	loops     sync.WaitGroup
+	closed    bool
+}
+
+func (g *listenerGroup) add(name string, conn inheritable, serve func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listeners = append(g.listeners, groupListener{name: name, conn: conn, serve: serve})
+}
+
+// start runs the serve loops
+func (g *listenerGroup) start() {
+	for _, l := range g.listeners {
+		g.loops.Add(1)
+		go func(serve func()) {
+			defer g.loops.Done()
+			serve()
+		}(l.serve)
+	}
+}
+
+// pause stops the serve loops and leaves the sockets open
+func (g *listenerGroup) pause() {
+	for _, l := range g.listeners {
+		if err := l.conn.SetDeadline(time.Unix(1, 0)); err != nil {
+			slog.Warn("Failed to pause listener", "listener", l.name, "error", err)
+		}
+	}
+	g.loops.Wait()
+}
+
+// resume restarts the serve loops after pause
+func (g *listenerGroup) resume() {
+	for _, l := range g.listeners {
+		if err := l.conn.SetDeadline(time.Time{}); err != nil {
+			slog.Warn("Failed to resume listener", "listener", l.name, "error", err)
+		}
+	}
+	g.start()
+}
+
+// close closes the sockets, which ends the serve loops
+func (g *listenerGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.closed = true
+	for _, l := range g.listeners {
+		if err := l.conn.Close(); err != nil {
+			// Listener close errors are expected and can be safely ignored
+			_ = err // explicitly ignore the error
+		}
+	}
+}
+
+// serveHTTP serves HTTP requests until the listener is closed or paused
+func serveHTTP(listener net.Listener, handler http.Handler, name string) {
+	// http.Serve retries temporary errors and closes the listener when it
+	// returns, neither is wanted for a paused listener
+	err := http.Serve(pausableListener{listener}, handler)
+	if !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		slog.Error("HTTP server stopped", "listener", name, "error", err)
+	}
+}
+
+type pausableListener struct {
+	net.Listener
+}
+
+func (l pausableListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("listener paused: %w", err)
+	}
+	return conn, err
+}
+
+func (l pausableListener) Close() error {
+	return nil
+}
+
+// inheritance holds the sockets passed by the previous process or by
+// systemd socket activation
+type inheritance struct {
+	files     map[string]*os.File
+	activated []*os.File // sockets from systemd without a listener name, matched by address
+	ready     *os.File   // nil if not started by an upgrade
+}
+
+// inheritFiles takes the file descriptors named in UPGRADE_FDS_ENV or
+// passed by systemd. Sockets from systemd named after a listener
+// (FileDescriptorName=https) are used for it, others for the listener
+// with the same address.
+func inheritFiles() *inheritance {
+	in := &inheritance{files: make(map[string]*os.File)}
+	for _, file := range systemd.ListenFiles() {
+		switch file.Name() {
+		case "https", "http", "quic", "sniff", "metrics", "admin", "dns", "dns-tcp":
+			in.files[file.Name()] = file
+		default:
+			in.activated = append(in.activated, file)
+		}
+	}
+
+	names := os.Getenv(UPGRADE_FDS_ENV)
+	if names == "" {
+		return in
+	}
+	// Processes started later must not take them again
+	_ = os.Unsetenv(UPGRADE_FDS_ENV)
+
+	for i, name := range strings.Split(names, ",") {
+		file := os.NewFile(uintptr(3+i), name)
+		if name == "ready" {
+			in.ready = file
+		} else {
+			in.files[name] = file
+		}
+	}
+	return in
+}
+
+// listen returns the inherited listener with the name if it listens on
+// address, otherwise it calls listen
+func (in *inheritance) listen(name, address string, listen func() (net.Listener, error)) (net.Listener, error) {
+	if file := in.take(name); file != nil {
+		listener, err := net.FileListener(file)
+		closeQuietly(file)
+		if err == nil && sameAddress(listener.Addr(), address) {
+			slog.Info("Using inherited listener", "listener", name, "address", address)
+			return listener, nil
+		}
+		if err == nil {
+			closeQuietly(listener)
+		}
+		slog.Warn("Inherited listener does not match the configuration", "listener", name, "address", address)
+	}
+
+	for i, file := range in.activated {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			continue // not a stream socket
+		}
+		if sameAddress(listener.Addr(), address) {
+			in.activated = append(in.activated[:i], in.activated[i+1:]...)
+			closeQuietly(file)
+			slog.Info("Using socket from systemd", "listener", name, "address", address)
+			return listener, nil
+		}
+		closeQuietly(listener)
+	}
+	return listen()
+}
+
+// listenUDP is listen for UDP sockets
+func (in *inheritance) listenUDP(name, address string, listen func() (*net.UDPConn, error)) (*net.UDPConn, error) {
+	if file := in.take(name); file != nil {
+		conn, err := net.FilePacketConn(file)
+		closeQuietly(file)
+		if udpConn, ok := conn.(*net.UDPConn); ok && sameAddress(udpConn.LocalAddr(), address) {
+			slog.Info("Using inherited listener", "listener", name, "address", address)
+			return udpConn, nil
+		}
+		if err == nil {
+			closeQuietly(conn)
+		}
+		slog.Warn("Inherited listener does not match the configuration", "listener", name, "address", address)
+	}
+
+	for i, file := range in.activated {
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			continue // not a datagram socket
+		}
+		if udpConn, ok := conn.(*net.UDPConn); ok && sameAddress(udpConn.LocalAddr(), address) {
+			in.activated = append(in.activated[:i], in.activated[i+1:]...)
+			closeQuietly(file)
+			slog.Info("Using socket from systemd", "listener", name, "address", address)
+			return udpConn, nil
+		}
+		closeQuietly(conn)
+	}
+	return listen()
+}
+
+func (in *inheritance) take(name string) *os.File {
+	file := in.files[name]
+	delete(in.files, name)
+	return file
+}
+
+// done tells the previous process that the listeners are served and closes
+// inherited sockets that are no longer configured
+func (in *inheritance) done() {
+	for name, file := range in.files {
+		slog.Info("Closing inherited listener that is not configured", "listener", name)
+		closeQuietly(file)
+	}
+	in.files = nil
+	for _, file := range in.activated {
+		slog.Warn("Socket from systemd does not match a listener", "name", file.Name())
+		closeQuietly(file)
+	}
+	in.activated = nil
+
+	if in.ready != nil {
+		if _, err := in.ready.Write([]byte{1}); err != nil {
+			slog.Warn("Failed to notify the previous process", "error", err)
+		}
+		closeQuietly(in.ready)
+		in.ready = nil
+	}
+}
+
+// sameAddress reports whether a listener's address is the configured one
+func sameAddress(addr net.Addr, address string) bool {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return addr.Network() == "unix" && addr.String() == path
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ips := []net.IP{nil}
+	if host != "" {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		ips = addrs
+	}
+
+	var ip net.IP
+	var actualPort int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, actualPort = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, actualPort = a.IP, a.Port
+	default:
+		return false
+	}
+	if strconv.Itoa(actualPort) != port {
+		return false
+	}
+	for _, want := range ips {
+		if ip.Equal(want) || (want == nil || want.IsUnspecified()) && ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+func closeQuietly(c io.Closer) {
+	if err := c.Close(); err != nil {
+		// The descriptor is not used any more
+		_ = err // explicitly ignore the error
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package server
+
+import "fmt"
+
+// upgradeProcess is not supported on this platform
+func upgradeProcess(group *listenerGroup) error {
+	return fmt.Errorf("upgrade is not supported on this platform")
+}
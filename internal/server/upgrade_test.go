@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListenerGroup_PauseKeepsBacklog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	group := &listenerGroup{}
+	group.add("test", listener.(inheritable), func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	})
+	group.start()
+	defer group.close()
+
+	group.pause()
+
+	// The kernel completes the handshake while nobody accepts
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial to a paused listener failed: %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("Paused listener accepted a connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	group.resume()
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection from the backlog was not accepted after resume")
+	}
+}
+
+func TestServeHTTP_PauseAndResume(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	group := &listenerGroup{}
+	group.add("test", listener.(inheritable), func() {
+		serveHTTP(listener, handler, "test")
+	})
+	group.start()
+	defer group.close()
+
+	// serveHTTP returns without closing the listener
+	group.pause()
+	group.resume()
+
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Request after resume failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestInheritance_Listen(t *testing.T) {
+	previous, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	file, err := previous.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	_ = previous.Close()
+
+	address := previous.Addr().String()
+	in := &inheritance{files: map[string]*os.File{"http": file}}
+	listener, err := in.listen("http", address, func() (net.Listener, error) {
+		t.Fatal("Expected the inherited listener to be used")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	if listener.Addr().String() != address {
+		t.Errorf("Expected %s, got %s", address, listener.Addr())
+	}
+
+	// The socket is still open, so connections are accepted
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	_ = client.Close()
+
+	// Not inherited: the listen function is called
+	called := false
+	_, _ = in.listen("http", address, func() (net.Listener, error) {
+		called = true
+		return nil, os.ErrNotExist
+	})
+	if !called {
+		t.Error("Expected the listen function to be called")
+	}
+}
+
+func TestInheritance_ListenActivated(t *testing.T) {
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = activated.Close()
+	}()
+	file, err := activated.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+
+	// A socket without a listener name is used for the listener with its address
+	in := &inheritance{files: map[string]*os.File{}, activated: []*os.File{file}}
+	called := false
+	_, _ = in.listen("https", "127.0.0.1:1", func() (net.Listener, error) {
+		called = true
+		return nil, os.ErrNotExist
+	})
+	if !called || len(in.activated) != 1 {
+		t.Fatal("Expected a socket with another address to be kept")
+	}
+
+	address := activated.Addr().String()
+	listener, err := in.listen("http", address, func() (net.Listener, error) {
+		t.Fatal("Expected the socket from systemd to be used")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	if listener.Addr().String() != address {
+		t.Errorf("Expected %s, got %s", address, listener.Addr())
+	}
+	if len(in.activated) != 0 {
+		t.Errorf("Expected the socket to be taken, %d left", len(in.activated))
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		address  string
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3130}, "127.0.0.1:3130", true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3130}, "127.0.0.1:3131", false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3130}, "127.0.0.2:3130", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 3130}, ":3130", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 3130}, "0.0.0.0:3130", true},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, "127.0.0.1:443", true},
+		{&net.UnixAddr{Name: "/run/tproxy/admin.sock", Net: "unix"}, "unix:/run/tproxy/admin.sock", true},
+		{&net.UnixAddr{Name: "/run/tproxy/admin.sock", Net: "unix"}, "unix:/tmp/admin.sock", false},
+	}
+
+	for _, tt := range tests {
+		if got := sameAddress(tt.addr, tt.address); got != tt.expected {
+			t.Errorf("sameAddress(%s, %q) = %v, expected %v", tt.addr, tt.address, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeProcess starts the binary again with the listening sockets of the
+// group and waits until the new process serves them. On success the loops
+// of the group stay paused and this process only drains its connections.
+// On failure they are resumed.
+func upgradeProcess(group *listenerGroup) error {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if group.closed {
+		return fmt.Errorf("listeners are closed")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer closeQuietly(readyR)
+
+	group.pause()
+
+	// The descriptors are used directly, File() would switch the sockets to
+	// blocking mode in this process as well
+	names := []string{"ready"}
+	files := []uintptr{uintptr(syscall.Stdin), uintptr(syscall.Stdout), uintptr(syscall.Stderr), readyW.Fd()}
+	for _, l := range group.listeners {
+		rawConn, err := l.conn.SyscallConn()
+		if err != nil {
+			closeQuietly(readyW)
+			group.resume()
+			return err
+		}
+		if err := rawConn.Control(func(fd uintptr) { files = append(files, fd) }); err != nil {
+			closeQuietly(readyW)
+			group.resume()
+			return err
+		}
+		names = append(names, l.name)
+	}
+
+	env := []string{UPGRADE_FDS_ENV + "=" + strings.Join(names, ",")}
+	for _, v := range os.Environ() {
+		// Under systemd the new process becomes the main process and takes
+		// over the watchdog
+		if !strings.HasPrefix(v, UPGRADE_FDS_ENV+"=") && !strings.HasPrefix(v, "WATCHDOG_PID=") {
+			env = append(env, v)
+		}
+	}
+
+	pid, err := syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{Env: env, Files: files})
+	closeQuietly(readyW)
+	if err != nil {
+		group.resume()
+		return fmt.Errorf("failed to start %s: %w", executable, err)
+	}
+	slog.Info("Started new process", "pid", pid, "executable", executable)
+
+	// The new process writes to the pipe once it serves the listeners. The
+	// pipe is closed without data if it exits before.
+	if err := readyR.SetReadDeadline(time.Now().Add(upgradeReadyTimeout)); err != nil {
+		slog.Warn("Failed to set deadline", "error", err)
+	}
+	buf := make([]byte, 1)
+	if n, err := readyR.Read(buf); n == 0 {
+		if killErr := syscall.Kill(pid, syscall.SIGTERM); killErr != nil {
+			// It exited already
+			_ = killErr // explicitly ignore the error
+		}
+		go func() {
+			// Reap the failed process
+			var status syscall.WaitStatus
+			_, _ = syscall.Wait4(pid, &status, 0, nil)
+		}()
+		group.resume()
+		return fmt.Errorf("new process %d did not start: %v", pid, err)
+	}
+
+	// The socket files belong to the new process now
+	for _, l := range group.listeners {
+		if unixListener, ok := l.conn.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+)
+
+// verifySNI checks that the SNI of a TLS connection resolves to its
+// original destination, empty if unknown or a host name for a fake IP. It
+// returns the policy to apply: off if the SNI was verified or could not be
+// checked.
+func verifySNI(cfg *config.SNIVerifyConfig, sni, originalIP string, logger *slog.Logger) string {
+	if cfg.Policy == config.SNI_VERIFY_OFF || originalIP == "" || sni == originalIP || cfg.Trusts(originalIP) {
+		return config.SNI_VERIFY_OFF
+	}
+
+	if net.ParseIP(originalIP) == nil {
+		// The client connected to the fake IP of another name
+		if strings.EqualFold(sni, originalIP) {
+			return config.SNI_VERIFY_OFF
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		resolves, err := resolvesTo(ctx, hostResolver(cfg.Resolver), sni, originalIP)
+		var dnsErr *net.DNSError
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			// Connections are not blocked because of a failing resolver
+			logger.Warn("SNI could not be verified", "sni", sni, "error", err)
+			return config.SNI_VERIFY_OFF
+		}
+		if resolves {
+			return config.SNI_VERIFY_OFF
+		}
+	}
+
+	metrics.SNIMismatches.WithLabelValues(cfg.Policy).Inc()
+	logger.Warn("SNI does not resolve to the original destination", "sni", sni, "policy", cfg.Policy)
+	return cfg.Policy
+}
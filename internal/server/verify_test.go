@@ -0,0 +1,69 @@
+package server
+
+import (
+	"log/slog"
+	"testing"
+
+	"tproxy/internal/config"
+	"tproxy/internal/metrics"
+)
+
+func TestVerifySNI(t *testing.T) {
+	previous := resolvers.Load()
+	defer resolvers.Store(previous)
+	err := applyDNSConfig(&config.Config{DNS: config.DNSConfig{
+		Hosts: map[string][]string{
+			"allowed.example.com": {"192.0.2.10"},
+			"blocked.example.com": {"198.51.100.1"},
+		},
+		// Answers nothing, so lookups through it fail
+		Resolvers: map[string]config.DNSResolver{"broken": {Servers: []string{"127.0.0.1:1"}}},
+		Timeout:   1,
+	}})
+	if err != nil {
+		t.Fatalf("applyDNSConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.SNIVerifyConfig
+		originalIP string
+		expected   string
+	}{
+		{"Off", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_OFF}, "198.51.100.1", config.SNI_VERIFY_OFF},
+		{"Matches", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP}, "192.0.2.10", config.SNI_VERIFY_OFF},
+		{"UnknownDst", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP}, "", config.SNI_VERIFY_OFF},
+		{"Log", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_LOG}, "198.51.100.1", config.SNI_VERIFY_LOG},
+		{"RouteIP", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_ROUTE_IP}, "198.51.100.1", config.SNI_VERIFY_ROUTE_IP},
+		{"Drop", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP}, "198.51.100.1", config.SNI_VERIFY_DROP},
+		{"TrustedNetwork", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP, Networks: []string{"198.51.100.0/24"}}, "198.51.100.1", config.SNI_VERIFY_OFF},
+		// Connections to fake IPs have the name that was looked up
+		{"FakeIP", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP}, "Allowed.example.com", config.SNI_VERIFY_OFF},
+		{"FakeIPOtherName", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP}, "blocked.example.com", config.SNI_VERIFY_DROP},
+		// Static hosts are known to every resolver
+		{"NamedResolver", config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP, Resolver: "broken"}, "198.51.100.1", config.SNI_VERIFY_DROP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifySNI(&tt.cfg, "allowed.example.com", tt.originalIP, slog.Default()); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// A failing lookup does not block the connection
+	mismatches := metrics.SNIMismatches.WithLabelValues(config.SNI_VERIFY_DROP)
+	before := mismatches.Value()
+	cfg := config.SNIVerifyConfig{Policy: config.SNI_VERIFY_DROP, Resolver: "broken"}
+	if got := verifySNI(&cfg, "intranet.example.com", "198.51.100.1", slog.Default()); got != config.SNI_VERIFY_OFF {
+		t.Errorf("Expected a failed lookup to pass, got %q", got)
+	}
+	if mismatches.Value() != before {
+		t.Error("Expected no mismatch for a failed lookup")
+	}
+	verifySNI(&cfg, "allowed.example.com", "198.51.100.1", slog.Default())
+	if got := mismatches.Value() - before; got != 1 {
+		t.Errorf("Expected one mismatch, got %v", got)
+	}
+}
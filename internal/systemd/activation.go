@@ -0,0 +1,42 @@
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LISTEN_FDS_START is the first file descriptor passed with socket activation
+const LISTEN_FDS_START = 3
+
+// ListenFiles returns the sockets passed with socket activation. Each file
+// is named by FileDescriptorName, systemd defaults to the socket unit name.
+// The environment variables are removed so that child processes do not take
+// the sockets again.
+func ListenFiles() []*os.File {
+	pid := os.Getenv("LISTEN_PID")
+	count := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(name)
+	}
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	fdNames := strings.Split(names, ":")
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		files = append(files, os.NewFile(uintptr(LISTEN_FDS_START+i), name))
+	}
+	return files
+}
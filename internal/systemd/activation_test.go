@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestListenFiles_OtherPID(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "https")
+
+	if files := ListenFiles(); files != nil {
+		t.Errorf("Expected no files for another process, got %d", len(files))
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf("Expected %s to be unset", name)
+		}
+	}
+}
+
+// TestListenFiles starts the test binary the way systemd would, with the
+// socket at fd 3 and LISTEN_PID set to the pid of the new process
+func TestListenFiles(t *testing.T) {
+	if os.Getenv("TPROXY_TEST_ACTIVATION") == "1" {
+		files := ListenFiles()
+		for _, file := range files {
+			listener, err := net.FileListener(file)
+			if err != nil {
+				fmt.Printf("error %v\n", err)
+				continue
+			}
+			fmt.Printf("socket %s %s\n", file.Name(), listener.Addr())
+		}
+		return
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell to set LISTEN_PID")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot create test listener: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	cmd := exec.Command(sh, "-c", `LISTEN_PID=$$ exec "$0" -test.run=^TestListenFiles$`, os.Args[0])
+	cmd.Env = append(os.Environ(), "TPROXY_TEST_ACTIVATION=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=https")
+	cmd.ExtraFiles = []*os.File{file}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Test process failed: %v\n%s", err, output)
+	}
+
+	expected := fmt.Sprintf("socket https %s", listener.Addr())
+	if !strings.Contains(string(output), expected) {
+		t.Errorf("Expected %q in output:\n%s", expected, output)
+	}
+}
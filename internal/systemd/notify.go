@@ -0,0 +1,73 @@
+// Package systemd implements the parts of the systemd service protocol the
+// proxy uses, socket activation and sd_notify, without libsystemd.
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends a state such as "READY=1" to the service manager. It does
+// nothing when NOTIFY_SOCKET is not set, i.e. without Type=notify.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ stands for the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			// The datagram was sent or the error is returned below
+			_ = err // explicitly ignore the error
+		}
+	}()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the timeout set with WatchdogSec and whether the
+// watchdog applies to this process
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// Watchdog sends WATCHDOG=1 at half the watchdog timeout until ctx is done.
+// It returns at once if the watchdog is not enabled.
+func Watchdog(ctx context.Context, onError func(error)) {
+	interval, ok := WatchdogInterval()
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if err := Notify("WATCHDOG=1"); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify creates a datagram socket standing in for systemd
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("Cannot create notify socket: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readState(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := listenNotify(t)
+
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if state := readState(t, conn); state != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", state)
+	}
+}
+
+func TestNotify_NoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Expected no error without NOTIFY_SOCKET, got %v", err)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Watchdog(ctx, func(err error) {
+			t.Errorf("Watchdog notification failed: %v", err)
+		})
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		if state := readState(t, conn); state != "WATCHDOG=1" {
+			t.Errorf("Expected WATCHDOG=1, got %q", state)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watchdog did not stop after cancel")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		expected time.Duration
+		enabled  bool
+	}{
+		{"Not set", "", "", 0, false},
+		{"Invalid", "abc", "", 0, false},
+		{"No PID", "30000000", "", 30 * time.Second, true},
+		{"Own PID", "30000000", strconv.Itoa(os.Getpid()), 30 * time.Second, true},
+		{"Other PID", "30000000", "1", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			interval, enabled := WatchdogInterval()
+			if interval != tt.expected || enabled != tt.enabled {
+				t.Errorf("Expected %v %v, got %v %v", tt.expected, tt.enabled, interval, enabled)
+			}
+		})
+	}
+}